@@ -1,12 +1,61 @@
 package controllers
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"project/dto"
+	"project/models"
 	"project/services"
 
 	"github.com/gin-gonic/gin"
 )
 
+// アップロードサイズの上限(CSV_MAX_UPLOAD_SIZEが未設定の場合に利用する)
+const defaultMaxUploadSize int64 = 512 << 20
+
+// 分割して送信するアップロードのサイズの上限(CSV_MAX_CHUNKED_UPLOAD_SIZEが未設定の場合に利用する)
+const defaultMaxChunkedUploadSize int64 = 20 << 30
+
+// 分割して送信するアップロードが準拠するtusプロトコルのバージョン
+const tusVersion = "1.0.0"
+
+// tusで定められた、Upload-Checksumが一致しない場合のステータスコード
+const statusChecksumMismatch = 460
+
+// 受け付けるContent-Typeとファイルの形式の対応
+// ブラウザによってはCSVをapplication/vnd.ms-excelやtext/plainとして送信する
+var uploadContentTypes = map[string]string{
+	"text/csv":                  models.ImportFormatCsv,
+	"application/csv":           models.ImportFormatCsv,
+	"application/vnd.ms-excel":  models.ImportFormatCsv,
+	"text/plain":                models.ImportFormatCsv,
+	"text/tab-separated-values": models.ImportFormatCsv,
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": models.ImportFormatXlsx,
+	"application/json":             models.ImportFormatJson,
+	"application/x-ndjson":         models.ImportFormatJsonl,
+	"application/jsonl":            models.ImportFormatJsonl,
+	"application/x-jsonlines":      models.ImportFormatJsonl,
+	"application/zip":              models.ImportFormatZip,
+	"application/x-zip-compressed": models.ImportFormatZip,
+	// gzipは展開してから取り込むため、ファイル名で形式が分からない場合はCSVとみなす
+	"application/gzip":   models.ImportFormatCsv,
+	"application/x-gzip": models.ImportFormatCsv,
+}
+
 type CsvController struct {
 	services services.ICsvService
 }
@@ -15,11 +64,934 @@ func NewCsvController(services services.ICsvService) *CsvController {
 	return &CsvController{services: services}
 }
 
+// multipart/form-dataのfileフィールド、またはtext/csvのリクエストボディを受け取り、取り込みジョブを登録する
+// gzipで圧縮されたファイルや、複数のファイルをまとめたzipも受け付ける
+// 取り込みはバックグラウンドで行うため、ジョブの状態はGET /csv/jobs/:idで確認する
 func (c *CsvController) ProcessCsv(ctx *gin.Context) {
-	err := c.services.ProcessCsv()
+	userId, ok := currentUserId(ctx)
+	if !ok {
+		return
+	}
+
+	// 取り込みのオプションはクエリパラメータで指定する
+	var input dto.ImportCsvInput
+	if err := ctx.ShouldBindQuery(&input); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// リクエストボディのサイズを制限する
+	ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxUploadSize())
+
+	reader, fileName, format, cleanup, err := openUpload(ctx)
 	if err != nil {
+		respondUploadError(ctx, err)
+		return
+	}
+	defer cleanup()
+
+	// 形式はクエリパラメータの指定を優先する
+	if input.Format == "" {
+		input.Format = format
+	}
+	if input.Format == "" {
+		respondUploadError(ctx, errUnsupportedMediaType)
+		return
+	}
+
+	// ドライランの場合は登録せずに結果の見込みを返す
+	if input.DryRun {
+		c.previewImport(ctx, reader, input, userId)
+		return
+	}
+
+	job, err := c.services.StartImport(reader, fileName, input, userId)
+	if err != nil {
+		// 読み込み途中でサイズ上限を超えた場合や、展開後のサイズ・ファイル数が上限を超えた場合
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) || errors.Is(err, services.ErrArchiveLimitExceeded) {
+			respondUploadError(ctx, err)
+			return
+		}
+		// 必須の列が無いなど、ヘッダーが不正な場合や、対応していない文字コード・区切り文字が指定された場合
+		if isInvalidCsvError(err) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	ctx.JSON(http.StatusOK, gin.H{"message": "CSV processed successfully"})
+	ctx.JSON(http.StatusAccepted, gin.H{"data": job})
+}
+
+// 取り込み結果の見込みを同期的に返す
+func (c *CsvController) previewImport(ctx *gin.Context, reader io.Reader, input dto.ImportCsvInput, userId uint) {
+	// クライアントが切断した場合は検証を中断する
+	preview, err := c.services.PreviewImport(ctx.Request.Context(), reader, input, userId)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		var parseErr *csv.ParseError
+		switch {
+		case errors.As(err, &maxBytesErr), errors.Is(err, services.ErrArchiveLimitExceeded):
+			respondUploadError(ctx, err)
+		case isInvalidCsvError(err), errors.As(err, &parseErr), errors.Is(err, services.ErrEmptyCsv):
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"data": preview})
+}
+
+// 取り込みジョブの一覧を取得
+func (c *CsvController) FindAllJobs(ctx *gin.Context) {
+	userId, ok := currentUserId(ctx)
+	if !ok {
+		return
+	}
+
+	jobs, err := c.services.FindAllJobs(userId)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Unexpected error"})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"data": jobs})
+}
+
+// IDで取り込みジョブを取得
+func (c *CsvController) FindJobById(ctx *gin.Context) {
+	userId, ok := currentUserId(ctx)
+	if !ok {
+		return
+	}
+
+	jobId, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return
+	}
+
+	job, err := c.services.FindJobById(uint(jobId), userId)
+	if err != nil {
+		if err.Error() == "import job not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Unexpected error"})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"data": job})
+}
+
+// 実行中の取り込みジョブをキャンセルする, 中断するまで待ってからジョブの状態を返す
+func (c *CsvController) CancelJob(ctx *gin.Context) {
+	userId, ok := currentUserId(ctx)
+	if !ok {
+		return
+	}
+
+	jobId, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return
+	}
+
+	job, err := c.services.CancelJob(uint(jobId), userId)
+	if err != nil {
+		switch {
+		case err.Error() == "import job not found":
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrJobNotRunning):
+			ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Unexpected error"})
+		}
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"data": job})
+}
+
+// サーバーの終了などで中断した取り込みジョブを、中断した位置から同じジョブIDで再開する
+func (c *CsvController) ResumeJob(ctx *gin.Context) {
+	userId, ok := currentUserId(ctx)
+	if !ok {
+		return
+	}
+
+	jobId, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return
+	}
+
+	job, err := c.services.ResumeJob(ctx.Request.Context(), uint(jobId), userId)
+	if err != nil {
+		switch {
+		case err.Error() == "import job not found":
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrJobNotResumable), errors.Is(err, services.ErrImportUploadMissing):
+			ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Unexpected error"})
+		}
+		return
+	}
+	ctx.JSON(http.StatusAccepted, gin.H{"data": job})
+}
+
+// 取り込みジョブの進捗をServer-Sent Eventsで送信する
+// 途中経過をprogressイベントとして送信し、ジョブが終了したらステータス名のイベントを送信して接続を閉じる
+func (c *CsvController) StreamJobEvents(ctx *gin.Context) {
+	userId, ok := currentUserId(ctx)
+	if !ok {
+		return
+	}
+
+	jobId, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return
+	}
+
+	events, unsubscribe, err := c.services.SubscribeJob(uint(jobId), userId)
+	if err != nil {
+		if err.Error() == "import job not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Unexpected error"})
+		return
+	}
+	defer unsubscribe()
+
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("Connection", "keep-alive")
+	// nginxなどのプロキシにバッファリングさせない
+	ctx.Header("X-Accel-Buffering", "no")
+	ctx.Status(http.StatusOK)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			ctx.SSEvent(event.Event, event)
+			ctx.Writer.Flush()
+		case <-ctx.Request.Context().Done():
+			// クライアントが切断した場合
+			return
+		}
+	}
+}
+
+// 取り込めなかった行の一覧を取得
+func (c *CsvController) FindRejectedRows(ctx *gin.Context) {
+	userId, ok := currentUserId(ctx)
+	if !ok {
+		return
+	}
+
+	jobId, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return
+	}
+
+	rows, err := c.services.FindRejectedRows(uint(jobId), userId)
+	if err != nil {
+		if err.Error() == "import job not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Unexpected error"})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"data": rows})
+}
+
+// 取り込めなかった行をCSVファイルとしてダウンロードする
+// zipの場合はfileクエリパラメータでzip内のファイルを指定する
+func (c *CsvController) DownloadRejectedRows(ctx *gin.Context) {
+	userId, ok := currentUserId(ctx)
+	if !ok {
+		return
+	}
+
+	jobId, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return
+	}
+
+	// ヘッダーを送信した後はステータスコードを変更できないため、一度バッファに書き出す
+	var buf bytes.Buffer
+	if err := c.services.WriteRejectedRowsCsv(uint(jobId), ctx.Query("file"), userId, &buf); err != nil {
+		switch {
+		case err.Error() == "import job not found", err.Error() == "import file not found":
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		case errors.Is(err, services.ErrImportFileRequired):
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Unexpected error"})
+		return
+	}
+
+	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="import-job-%d-rejects.csv"`, jobId))
+	ctx.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+}
+
+// 取り込んだ連絡先を条件で絞り込み、1ページ分を取得する
+func (c *CsvController) FindCsvs(ctx *gin.Context) {
+	c.findCsvs(ctx, c.services.FindCsvs)
+}
+
+// 論理削除した連絡先を条件で絞り込み、1ページ分を取得する
+func (c *CsvController) FindDeletedCsvs(ctx *gin.Context) {
+	c.findCsvs(ctx, c.services.FindDeletedCsvs)
+}
+
+func (c *CsvController) findCsvs(ctx *gin.Context, find func(context.Context, dto.FindCsvsInput, uint) (*dto.CsvPageOutput, error)) {
+	userId, ok := currentUserId(ctx)
+	if !ok {
+		return
+	}
+
+	var input dto.FindCsvsInput
+	if err := ctx.ShouldBindQuery(&input); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	page, err := find(ctx.Request.Context(), input, userId)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidCsvQuery):
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case err.Error() == "import batch not found":
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		default:
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Unexpected error"})
+		}
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"data": page})
+}
+
+// 取り込んだファイルの記録の一覧を取得
+func (c *CsvController) FindAllBatches(ctx *gin.Context) {
+	userId, ok := currentUserId(ctx)
+	if !ok {
+		return
+	}
+
+	batches, err := c.services.FindAllBatches(userId)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Unexpected error"})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"data": batches})
+}
+
+// IDで取り込んだファイルの記録を取得
+func (c *CsvController) FindBatchById(ctx *gin.Context) {
+	userId, ok := currentUserId(ctx)
+	if !ok {
+		return
+	}
+
+	batchId, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return
+	}
+
+	batch, err := c.services.FindBatchById(uint(batchId), userId)
+	if err != nil {
+		if err.Error() == "import batch not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Unexpected error"})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"data": batch})
+}
+
+// 指定したファイルから取り込んだ連絡先を1ページ分取得する
+func (c *CsvController) FindBatchCsvs(ctx *gin.Context) {
+	batchId, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return
+	}
+
+	c.findCsvs(ctx, func(reqCtx context.Context, input dto.FindCsvsInput, userId uint) (*dto.CsvPageOutput, error) {
+		return c.services.FindBatchCsvs(reqCtx, uint(batchId), input, userId)
+	})
+}
+
+// 取り込みを取り消す, dry_runの場合は取り消さずに対象の行を返す
+func (c *CsvController) RollbackBatch(ctx *gin.Context) {
+	userId, ok := currentUserId(ctx)
+	if !ok {
+		return
+	}
+
+	batchId, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return
+	}
+
+	var input dto.RollbackImportInput
+	if err := ctx.ShouldBindQuery(&input); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rollback, err := c.services.RollbackBatch(ctx.Request.Context(), uint(batchId), input, userId)
+	if err != nil {
+		switch {
+		case err.Error() == "import batch not found":
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrBatchRolledBack), errors.Is(err, services.ErrBatchImportRunning):
+			ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Unexpected error"})
+		}
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"data": rollback})
+}
+
+// IDで取り込んだ連絡先を取得
+func (c *CsvController) FindCsvById(ctx *gin.Context) {
+	userId, ok := currentUserId(ctx)
+	if !ok {
+		return
+	}
+
+	csvId, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return
+	}
+
+	csv, err := c.services.FindCsvById(ctx.Request.Context(), uint(csvId), userId)
+	if err != nil {
+		if err.Error() == "csv not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Unexpected error"})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"data": csv})
+}
+
+// 連絡先を取り込んだファイルと行番号を取得
+func (c *CsvController) FindCsvProvenance(ctx *gin.Context) {
+	userId, ok := currentUserId(ctx)
+	if !ok {
+		return
+	}
+
+	csvId, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return
+	}
+
+	provenance, err := c.services.FindCsvProvenance(ctx.Request.Context(), uint(csvId), userId)
+	if err != nil {
+		if err.Error() == "csv not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Unexpected error"})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"data": provenance})
+}
+
+// 連絡先を1件登録する
+func (c *CsvController) CreateCsv(ctx *gin.Context) {
+	userId, ok := currentUserId(ctx)
+	if !ok {
+		return
+	}
+
+	var input dto.CreateCsvInput
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	csv, err := c.services.CreateCsv(ctx.Request.Context(), input, userId)
+	if err != nil {
+		respondContactError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusCreated, gin.H{"data": csv})
+}
+
+// 連絡先の指定した項目を更新する
+func (c *CsvController) UpdateCsv(ctx *gin.Context) {
+	userId, ok := currentUserId(ctx)
+	if !ok {
+		return
+	}
+
+	csvId, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return
+	}
+
+	var input dto.UpdateCsvInput
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	csv, err := c.services.UpdateCsv(ctx.Request.Context(), uint(csvId), input, userId)
+	if err != nil {
+		respondContactError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"data": csv})
+}
+
+// 連絡先を論理削除する
+func (c *CsvController) DeleteCsv(ctx *gin.Context) {
+	userId, ok := currentUserId(ctx)
+	if !ok {
+		return
+	}
+
+	csvId, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return
+	}
+
+	if err := c.services.DeleteCsv(ctx.Request.Context(), uint(csvId), userId); err != nil {
+		respondContactError(ctx, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// 論理削除した連絡先を元に戻す
+func (c *CsvController) RestoreCsv(ctx *gin.Context) {
+	userId, ok := currentUserId(ctx)
+	if !ok {
+		return
+	}
+
+	csvId, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return
+	}
+
+	csv, err := c.services.RestoreCsv(ctx.Request.Context(), uint(csvId), userId)
+	if err != nil {
+		respondContactError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"data": csv})
+}
+
+// 論理削除した連絡先を完全に削除する
+func (c *CsvController) PurgeCsv(ctx *gin.Context) {
+	userId, ok := currentUserId(ctx)
+	if !ok {
+		return
+	}
+
+	csvId, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return
+	}
+
+	if err := c.services.PurgeCsv(ctx.Request.Context(), uint(csvId), userId); err != nil {
+		respondContactError(ctx, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// 認証ミドルウェアが設定したユーザーのIDを返す, ユーザーが無い場合は401を返す
+func currentUserId(ctx *gin.Context) (uint, bool) {
+	user, exists := ctx.Get("user")
+	if !exists {
+		ctx.AbortWithStatus(http.StatusUnauthorized)
+		return 0, false
+	}
+	return user.(*models.User).ID, true
+}
+
+// 連絡先の登録・更新・削除のエラーをステータスコードに変換して返す
+func respondContactError(ctx *gin.Context, err error) {
+	var validationErr *services.CsvValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "errors": validationErr.Errors})
+	case err.Error() == "csv not found":
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrEmailAlreadyExists), err.Error() == "csv is not deleted":
+		ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Unexpected error"})
+	}
+}
+
+// 連絡先を条件で絞り込み、CSVファイルとしてダウンロードする
+// 件数が多くてもメモリに載せないよう、DBから読み込みながら少しずつ送信する
+func (c *CsvController) ExportCsv(ctx *gin.Context) {
+	userId, ok := currentUserId(ctx)
+	if !ok {
+		return
+	}
+
+	var input dto.ExportCsvInput
+	if err := ctx.ShouldBindQuery(&input); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.Header("Content-Type", "text/csv; charset=utf-8")
+	ctx.Header("Content-Disposition", `attachment; filename="contacts.csv"`)
+	// クライアントが切断した場合は読み込みを中断する
+	err := c.services.ExportCsv(ctx.Request.Context(), input, userId, ctx.Writer)
+	if err == nil {
+		return
+	}
+	// 送信を始めた後はステータスコードを変更できないため、ログに残して打ち切る
+	if ctx.Writer.Written() {
+		log.Printf("failed to export contacts: %v", err)
+		return
+	}
+	ctx.Writer.Header().Del("Content-Disposition")
+	ctx.Writer.Header().Del("Content-Type")
+	if errors.Is(err, services.ErrInvalidCsvQuery) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Unexpected error"})
+}
+
+// 分割して送信するアップロードを登録する(tusのCreation)
+// ファイル全体のバイト数をUpload-Lengthヘッダーで、ファイル名とContent-TypeをUpload-Metadataヘッダーで指定する
+// 続きのデータはPATCH /csv/uploads/:idで送信し、全て送信した後にPOST /csv/uploads/:id/finalizeで取り込む
+func (c *CsvController) CreateUpload(ctx *gin.Context) {
+	userId, ok := currentUserId(ctx)
+	if !ok {
+		return
+	}
+	ctx.Header("Tus-Resumable", tusVersion)
+
+	length, err := strconv.ParseInt(ctx.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Length must be a positive integer"})
+		return
+	}
+	if length > maxChunkedUploadSize() {
+		ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "file is too large"})
+		return
+	}
+	metadata, err := parseUploadMetadata(ctx.GetHeader("Upload-Metadata"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	upload, err := c.services.CreateUpload(metadata["filename"], metadata["filetype"], length, userId)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Unexpected error"})
+		return
+	}
+	ctx.Header("Location", fmt.Sprintf("/csv/uploads/%d", upload.ID))
+	ctx.Header("Upload-Offset", "0")
+	ctx.JSON(http.StatusCreated, gin.H{"data": upload})
+}
+
+// 受け取り済みの位置をUpload-Offsetヘッダーで返す(tusのHEAD), 通信が途切れた後はこの位置から送り直す
+func (c *CsvController) HeadUpload(ctx *gin.Context) {
+	userId, ok := currentUserId(ctx)
+	if !ok {
+		return
+	}
+	ctx.Header("Tus-Resumable", tusVersion)
+	ctx.Header("Cache-Control", "no-store")
+
+	uploadId, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.Status(http.StatusBadRequest)
+		return
+	}
+
+	upload, err := c.services.FindUploadById(uint(uploadId), userId)
+	if err != nil {
+		if err.Error() == "import upload not found" {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		ctx.Status(http.StatusInternalServerError)
+		return
+	}
+	ctx.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	ctx.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	ctx.Status(http.StatusOK)
+}
+
+// Upload-Offsetヘッダーの位置から続きのデータを書き込む(tusのPATCH)
+// Upload-Offsetが受け取り済みの位置と一致しない場合は409を返す
+func (c *CsvController) AppendUpload(ctx *gin.Context) {
+	userId, ok := currentUserId(ctx)
+	if !ok {
+		return
+	}
+	ctx.Header("Tus-Resumable", tusVersion)
+
+	uploadId, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(ctx.GetHeader("Content-Type")); mediaType != "application/offset+octet-stream" {
+		ctx.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "content type must be application/offset+octet-stream"})
+		return
+	}
+	offset, err := strconv.ParseInt(ctx.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Offset must be a non-negative integer"})
+		return
+	}
+
+	upload, err := c.services.AppendUpload(uint(uploadId), offset, ctx.Request.Body, userId)
+	if upload != nil {
+		ctx.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	}
+	if err != nil {
+		// 読み込みの途中で失敗した場合も、受け取った分までは保存している
+		if upload != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		respondChunkedUploadError(ctx, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// 全てのデータを受け取ったアップロードを検証し、取り込みジョブを登録する
+// Upload-Checksumヘッダーに"sha256 <Base64のハッシュ値>"の形式でファイル全体のSHA-256を指定する
+// 取り込みのオプションはPOST /csv/processと同じくクエリパラメータで指定する
+// ヘッダーの検証もジョブの中で行うため、不正な場合は400ではなくジョブの失敗になる, その場合は別のオプションで再度取り込める
+func (c *CsvController) FinalizeUpload(ctx *gin.Context) {
+	userId, ok := currentUserId(ctx)
+	if !ok {
+		return
+	}
+	ctx.Header("Tus-Resumable", tusVersion)
+
+	uploadId, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return
+	}
+	var input dto.ImportCsvInput
+	if err := ctx.ShouldBindQuery(&input); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.DryRun {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "dry run is not supported for chunked uploads"})
+		return
+	}
+	checksum, err := parseUploadChecksum(ctx.GetHeader("Upload-Checksum"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 形式はクエリパラメータの指定を優先し、省略時はUpload-Metadataのファイル名とContent-Typeから判定する
+	if input.Format == "" {
+		upload, err := c.services.FindUploadById(uint(uploadId), userId)
+		if err != nil {
+			respondChunkedUploadError(ctx, err)
+			return
+		}
+		mediaType, _, _ := mime.ParseMediaType(upload.ContentType)
+		if input.Format = uploadFormat(upload.FileName, mediaType); input.Format == "" {
+			respondUploadError(ctx, errUnsupportedMediaType)
+			return
+		}
+	}
+
+	job, err := c.services.FinalizeUpload(uint(uploadId), checksum, input, userId)
+	if err != nil {
+		respondChunkedUploadError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusAccepted, gin.H{"data": job})
+}
+
+// アップロードの形式を判定し、データのReader・ファイル名・ファイルの形式・後始末用の関数を返す
+// 形式が判定できない場合は空文字を返す
+func openUpload(ctx *gin.Context) (io.Reader, string, string, func(), error) {
+	mediaType, _, err := mime.ParseMediaType(ctx.GetHeader("Content-Type"))
+	if err != nil {
+		return nil, "", "", nil, errUnsupportedMediaType
+	}
+
+	switch {
+	case mediaType == "multipart/form-data":
+		fileHeader, err := ctx.FormFile("file")
+		// multipartの解析時に作成された一時ファイルを削除する
+		cleanup := func() {
+			if ctx.Request.MultipartForm != nil {
+				ctx.Request.MultipartForm.RemoveAll()
+			}
+		}
+		if err != nil {
+			cleanup()
+			return nil, "", "", nil, err
+		}
+
+		partType, _, _ := mime.ParseMediaType(fileHeader.Header.Get("Content-Type"))
+		format := uploadFormat(fileHeader.Filename, partType)
+
+		file, err := fileHeader.Open()
+		if err != nil {
+			cleanup()
+			return nil, "", "", nil, err
+		}
+		return file, fileHeader.Filename, format, func() {
+			file.Close()
+			cleanup()
+		}, nil
+	case uploadContentTypes[mediaType] != "" || mediaType == "application/octet-stream":
+		// ボディで送信された場合はファイル名が無いため、クエリパラメータで指定できるようにする
+		fileName := ctx.Query("filename")
+		return ctx.Request.Body, fileName, uploadFormat(fileName, mediaType), func() {}, nil
+	default:
+		return nil, "", "", nil, errUnsupportedMediaType
+	}
+}
+
+// ファイル名の拡張子、またはContent-Typeからファイルの形式を判定する, 拡張子を優先する
+// contacts.csv.gzのようにgzipで圧縮されたファイルは、.gzを除いたファイル名で判定する
+func uploadFormat(fileName string, mediaType string) string {
+	if strings.ToLower(filepath.Ext(fileName)) == ".gz" {
+		mediaType = "application/gzip"
+		fileName = strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	}
+	if format := services.ImportFormatFromFileName(fileName); format != "" {
+		return format
+	}
+	return uploadContentTypes[mediaType]
+}
+
+var errUnsupportedMediaType = errors.New("content type must be multipart/form-data, text/csv, application/json, application/x-ndjson, application/zip, application/gzip or an xlsx spreadsheet")
+
+// アップロード時のエラーをステータスコードに変換して返す
+func respondUploadError(ctx *gin.Context, err error) {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "file is too large"})
+	case errors.Is(err, services.ErrArchiveLimitExceeded):
+		ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	case errors.Is(err, errUnsupportedMediaType):
+		ctx.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+	case errors.Is(err, http.ErrMissingFile):
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+	default:
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+// ファイルの内容や取り込みの設定が不正なため、クライアントのエラーとして扱うエラーかどうか
+func isInvalidCsvError(err error) bool {
+	return errors.Is(err, services.ErrInvalidHeader) ||
+		errors.Is(err, services.ErrUnsupportedEncoding) ||
+		errors.Is(err, services.ErrInvalidDialect) ||
+		errors.Is(err, services.ErrInvalidWorkbook) ||
+		errors.Is(err, services.ErrInvalidJson) ||
+		errors.Is(err, services.ErrInvalidArchive)
+}
+
+// 環境変数CSV_MAX_UPLOAD_SIZE(バイト数)からアップロードサイズの上限を取得する
+func maxUploadSize() int64 {
+	size, err := strconv.ParseInt(os.Getenv("CSV_MAX_UPLOAD_SIZE"), 10, 64)
+	if err != nil || size <= 0 {
+		return defaultMaxUploadSize
+	}
+	return size
+}
+
+// 環境変数CSV_MAX_CHUNKED_UPLOAD_SIZE(バイト数)から分割して送信するアップロードのサイズの上限を取得する
+func maxChunkedUploadSize() int64 {
+	size, err := strconv.ParseInt(os.Getenv("CSV_MAX_CHUNKED_UPLOAD_SIZE"), 10, 64)
+	if err != nil || size <= 0 {
+		return defaultMaxChunkedUploadSize
+	}
+	return size
+}
+
+// Upload-Metadataヘッダー("キー Base64の値"をカンマで区切った形式)を解析する, 値の無いキーは空文字とする
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata: %s", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// Upload-Checksumヘッダー("sha256 <Base64のハッシュ値>")からSHA-256のハッシュ値を取得する
+func parseUploadChecksum(header string) ([]byte, error) {
+	algorithm, encoded, _ := strings.Cut(strings.TrimSpace(header), " ")
+	if algorithm != "sha256" {
+		return nil, errors.New("Upload-Checksum must be a sha256 checksum")
+	}
+	checksum, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(checksum) != sha256.Size {
+		return nil, errors.New("invalid Upload-Checksum")
+	}
+	return checksum, nil
+}
+
+// 分割して送信するアップロードのエラーをステータスコードに変換して返す
+func respondChunkedUploadError(ctx *gin.Context, err error) {
+	switch {
+	case err.Error() == "import upload not found":
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrUploadOffsetMismatch), errors.Is(err, services.ErrUploadIncomplete), errors.Is(err, services.ErrUploadFinalized):
+		ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrUploadLocked):
+		ctx.JSON(http.StatusLocked, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrUploadTooLarge):
+		ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrUploadChecksumMismatch):
+		ctx.JSON(statusChecksumMismatch, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrImportUploadMissing):
+		ctx.JSON(http.StatusGone, gin.H{"error": err.Error()})
+	default:
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Unexpected error"})
+	}
 }
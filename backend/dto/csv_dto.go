@@ -0,0 +1,230 @@
+package dto
+
+import "project/models"
+
+type ImportCsvInput struct {
+	// メールアドレスが重複した場合の扱い, 省略時はfail
+	OnConflict string `form:"on_conflict" binding:"omitempty,oneof=fail skip overwrite merge"`
+	// trueの場合は取り込める行だけを登録する, 省略時は1行でも取り込めない行があれば全ての行を登録しない
+	Partial bool `form:"partial"`
+	// trueの場合は登録せずに取り込み結果の見込みだけを返す
+	DryRun bool `form:"dry_run"`
+	// ドライランで返す行数, 省略時は20
+	PreviewLimit int `form:"preview_limit" binding:"omitempty,min=1,max=1000"`
+	// ファイルの形式(csv, xlsx, json, jsonl, zip), 省略時はファイル名の拡張子とContent-Typeから判定する
+	Format string `form:"format" binding:"omitempty,oneof=csv xlsx json jsonl zip"`
+	// Excelの場合に取り込むシート名または1始まりのシートの番号, 省略時は先頭のシート
+	Sheet string `form:"sheet"`
+	// 文字コード(utf-8, shift_jis, euc-jp), 省略時はファイルの内容から判定する
+	Encoding string `form:"encoding"`
+	// 区切り文字(",", ";", "|", "tab"など), 省略時またはautoの場合はファイルの先頭から判定する
+	Delimiter string `form:"delimiter"`
+	// trueの場合は引用符の誤り(引用符で囲まれていない列の中の引用符など)を許容する
+	LazyQuotes bool `form:"lazy_quotes"`
+	// この文字で始まる行をコメントとして読み飛ばす
+	Comment string `form:"comment"`
+	// trueの場合は列の先頭の空白を無視する, 空白の後の引用符も列の囲みとして扱われる
+	TrimLeadingSpace bool `form:"trim_leading_space"`
+	// ヘッダー行の位置, 省略時は先頭から必須の列を含む行を探す
+	// CSV・JSONは1始まりの行数(空の行は数えない)、Excelは空の行も含めたシートの行番号で指定する
+	HeaderRow int `form:"header_row" binding:"omitempty,min=1,max=100"`
+	// ワーカーの数・1回の登録でまとめる行数・キューの長さ, 省略時はサーバーの設定に従う
+	Workers   int `form:"workers" binding:"omitempty,min=1,max=100"`
+	BatchSize int `form:"batch_size" binding:"omitempty,min=1,max=10000"`
+	QueueSize int `form:"queue_size" binding:"omitempty,min=1,max=1000"`
+	// trueの場合は登録にかかる時間と失敗の割合に応じてワーカーの数を増減する, workersは上限になる
+	Adaptive *bool `form:"adaptive"`
+}
+
+// 連絡先の絞り込みの条件, 省略した条件は絞り込まない
+type CsvFilterInput struct {
+	// 完全一致で絞り込む
+	FirstName   string `form:"first_name"`
+	LastName    string `form:"last_name"`
+	Email       string `form:"email"`
+	PhoneNumber string `form:"phone_number"`
+	Address     string `form:"address"`
+	City        string `form:"city"`
+	State       string `form:"state"`
+	ZipCode     string `form:"zip_code"`
+	Country     string `form:"country"`
+	// 登録日時の範囲("2006-01-02"またはRFC3339), fromはその時刻を含み、toは含まない
+	// 日付だけを指定した場合はその日の0時(UTC)とみなす
+	CreatedFrom string `form:"created_from"`
+	CreatedTo   string `form:"created_to"`
+	// 取り込んだファイルの記録のIDで絞り込む
+	ImportBatchID uint `form:"import_batch_id"`
+}
+
+// CSV出力の条件
+type ExportCsvInput struct {
+	CsvFilterInput
+	// 出力する列をカンマ区切りで指定する("email,first_name"など), 省略時は全ての列
+	// 列名は取り込み時と同じく大文字小文字・空白・区切り文字の違いを区別しない
+	Columns string `form:"columns"`
+}
+
+// 連絡先の一覧の取得条件
+type FindCsvsInput struct {
+	CsvFilterInput
+	// 名・姓・メールアドレスのいずれかに含まれる文字列で検索する, 大文字小文字は区別しない
+	Q string `form:"q"`
+	// 検索の方法(prefix: 前方一致, contains: 部分一致), 省略時はcontains
+	Match string `form:"match" binding:"omitempty,oneof=prefix contains"`
+	// 並び順の列("created_at"など), 先頭に"-"を付けると降順, 省略時はid
+	Sort string `form:"sort"`
+	// 1ページの件数, 省略時は50
+	Limit int `form:"limit" binding:"omitempty,min=1,max=1000"`
+	// 読み飛ばす件数(オフセット方式), cursorと同時には指定できない
+	Offset int `form:"offset" binding:"omitempty,min=0"`
+	// 前のページのnextCursor(カーソル方式), 件数が多い場合はオフセット方式より速い
+	Cursor string `form:"cursor"`
+}
+
+// 連絡先の登録, 取り込みと同じ検証を行うため必須・文字数の制約はサービス層で確認する
+type CreateCsvInput struct {
+	FirstName   string `json:"firstName"`
+	LastName    string `json:"lastName"`
+	Email       string `json:"email"`
+	PhoneNumber string `json:"phoneNumber"`
+	Address     string `json:"address"`
+	City        string `json:"city"`
+	State       string `json:"state"`
+	ZipCode     string `json:"zipCode"`
+	Country     string `json:"country"`
+}
+
+// 連絡先の更新, 指定した項目だけを更新する
+type UpdateCsvInput struct {
+	FirstName   *string `json:"firstName"`
+	LastName    *string `json:"lastName"`
+	Email       *string `json:"email"`
+	PhoneNumber *string `json:"phoneNumber"`
+	Address     *string `json:"address"`
+	City        *string `json:"city"`
+	State       *string `json:"state"`
+	ZipCode     *string `json:"zipCode"`
+	Country     *string `json:"country"`
+}
+
+// 連絡先の一覧の1ページ分
+type CsvPageOutput struct {
+	Records []models.Csv `json:"records"`
+	// 条件に一致する全件の件数
+	Total  int64 `json:"total"`
+	Limit  int   `json:"limit"`
+	Offset int   `json:"offset"`
+	// 次のページを取得するためのcursor, 最後のページの場合は空
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// 連絡先と、最後に登録・更新した取り込みの記録
+type CsvProvenanceOutput struct {
+	Contact *models.Csv `json:"contact"`
+	// APIから登録した連絡先の場合はnil
+	Batch *models.ImportBatch `json:"batch"`
+	// 取り込んだファイル内の行番号
+	Line int `json:"line"`
+}
+
+// 取り込みの取り消しのオプション
+type RollbackImportInput struct {
+	// 取り込みで登録した連絡先の削除方法, softは論理削除、hardはDBから削除する, 省略時はsoft
+	// 論理削除した連絡先のメールアドレスはon_conflict=failでは取り込めないため、取り込み直す場合はhardを指定する
+	Mode string `form:"mode" binding:"omitempty,oneof=soft hard"`
+	// trueの場合は取り消さずに対象の行だけを返す
+	DryRun bool `form:"dry_run"`
+	// ドライランで返す行数, 省略時は20
+	PreviewLimit int `form:"preview_limit" binding:"omitempty,min=1,max=1000"`
+}
+
+// 取り込みの取り消しの結果, ドライランの場合は取り消した場合の見込み
+type ImportRollbackOutput struct {
+	Batch  *models.ImportBatch `json:"batch"`
+	Mode   string              `json:"mode"`
+	DryRun bool                `json:"dryRun"`
+	// 取り込みで登録したため削除する行数と、上書きしたため取り込み前の値に戻す行数
+	DeleteRows  int64 `json:"deleteRows"`
+	RestoreRows int64 `json:"restoreRows"`
+	// 後の取り込みで更新された・削除されたため元に戻さない行数
+	SupersededRows int64 `json:"supersededRows"`
+	// ドライランの場合に、削除・復元する行の先頭から指定した件数ずつ
+	Records []RollbackRecord `json:"records,omitempty"`
+}
+
+// 取り消しの対象の1行分
+type RollbackRecord struct {
+	// deleteまたはrestore
+	Action  string     `json:"action"`
+	Contact models.Csv `json:"contact"`
+	// restoreの場合に戻す取り込み前の値
+	Previous *models.Csv `json:"previous,omitempty"`
+}
+
+// ドライランの結果
+type ImportPreviewOutput struct {
+	// 判定または指定されたファイルの形式とシート名
+	Format string `json:"format"`
+	Sheet  string `json:"sheet,omitempty"`
+	// 判定または指定された文字コード
+	Encoding string `json:"encoding"`
+	// 判定または指定された区切り文字とヘッダー行の位置
+	Delimiter   string `json:"delimiter"`
+	HeaderRow   int    `json:"headerRow"`
+	TotalRows   int    `json:"totalRows"`
+	ValidRows   int    `json:"validRows"`
+	InvalidRows int    `json:"invalidRows"`
+	// 既存の連絡先、またはファイル内の前の行とメールアドレスが重複している行数
+	DuplicateRows int `json:"duplicateRows"`
+	// on_conflictに従って取り込んだ場合の見込みの件数
+	InsertRows int `json:"insertRows"`
+	UpdateRows int `json:"updateRows"`
+	SkipRows   int `json:"skipRows"`
+	FailRows   int `json:"failRows"`
+	// 先頭から指定した件数の行
+	Records []PreviewRecord `json:"records"`
+}
+
+// ドライランで返す1行分のデータ
+type PreviewRecord struct {
+	Line int `json:"line"`
+	// insert, update, skip, fail, invalidのいずれか
+	Action      string         `json:"action"`
+	FirstName   string         `json:"firstName"`
+	LastName    string         `json:"lastName"`
+	Email       string         `json:"email"`
+	PhoneNumber string         `json:"phoneNumber"`
+	Address     string         `json:"address"`
+	City        string         `json:"city"`
+	State       string         `json:"state"`
+	ZipCode     string         `json:"zipCode"`
+	Country     string         `json:"country"`
+	Errors      []PreviewError `json:"errors,omitempty"`
+}
+
+type PreviewError struct {
+	Column string `json:"column"`
+	Reason string `json:"reason"`
+}
+
+// 取り込みの進捗, GET /csv/jobs/:id/eventsでServer-Sent Eventsのデータとして送信する
+type ImportProgressEvent struct {
+	// SSEのイベント名, 途中経過はprogress, 終了時はジョブのステータス(completed, failed, cancelled)
+	Event        string `json:"-"`
+	JobID        uint   `json:"jobId"`
+	Status       string `json:"status"`
+	ReadRows     int    `json:"readRows"`
+	InsertedRows int    `json:"insertedRows"`
+	UpdatedRows  int    `json:"updatedRows"`
+	SkippedRows  int    `json:"skippedRows"`
+	FailedRows   int    `json:"failedRows"`
+	// 稼働中のワーカーの数
+	Workers    int   `json:"workers"`
+	BytesRead  int64 `json:"bytesRead"`
+	TotalBytes int64 `json:"totalBytes"`
+	// 開始からの平均の読み込み行数(行/秒)
+	RowsPerSecond float64 `json:"rowsPerSecond"`
+	// 残り時間の見込み(秒), 見積もれない場合はnull
+	EtaSeconds   *float64 `json:"etaSeconds"`
+	ErrorSummary string   `json:"errorSummary,omitempty"`
+}
@@ -4,12 +4,16 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
+// SQLITE_PATHが設定されていない場合のsqliteのDBのファイル
+const defaultSqlitePath = "tmp/app.db"
+
 func SetupDB() *gorm.DB {
 	env := os.Getenv("ENV")
 	dsn := fmt.Sprintf(
@@ -31,9 +35,16 @@ func SetupDB() *gorm.DB {
 		db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
 		log.Println("Setup postgrresql database")
 	} else {
-		// :memory:を指定してsqliteのインメモリDBに接続
-		db, err = gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
-		log.Println("Setup in memory database")
+		// 再起動しても中断した取り込みジョブを再開できるよう、SQLITE_PATH(省略時はtmp/app.db)のファイルに保存する
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = defaultSqlitePath
+		}
+		if dirErr := os.MkdirAll(filepath.Dir(path), 0o755); dirErr != nil {
+			panic("failed to create database directory")
+		}
+		db, err = OpenSqlite(path)
+		log.Println("Setup sqlite database")
 	}
 	if err != nil {
 		panic("failed to connect database")
@@ -41,3 +52,11 @@ func SetupDB() *gorm.DB {
 
 	return db
 }
+
+// pathのファイルのsqliteのDBに接続する
+// WALモードにして、他の接続の書き込み中も読み込めるようにする
+// 書き込みはbusy_timeoutの間ロックの解放を待ち、トランザクションは開始時に書き込みのロックを取得する
+func OpenSqlite(path string) (*gorm.DB, error) {
+	dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate", path)
+	return gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+}
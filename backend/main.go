@@ -1,6 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"project/controllers"
 	"project/infra"
 	"project/middlewares"
@@ -14,7 +23,8 @@ import (
 	"gorm.io/gorm"
 )
 
-func setupRouter(db *gorm.DB) *gin.Engine {
+// ctxはバックグラウンドで実行する取り込みジョブの親になる, キャンセルすると実行中のジョブを中断する
+func setupRouter(ctx context.Context, db *gorm.DB) *gin.Engine {
 	itemRepository := repositories.NewItemRepository(db)
 	itemService := services.NewItemService(itemRepository)
 	itemController := controllers.NewItemController(itemService)
@@ -24,21 +34,29 @@ func setupRouter(db *gorm.DB) *gin.Engine {
 	authController := controllers.NewAuthController(authService)
 
 	csvRepository := repositories.NewCsvRepository(db)
-	filepath := "./data/sample_data_100000.csv"
-	csvService := services.NewCsvService(csvRepository, filepath)
+	importJobRepository := repositories.NewImportJobRepository(db)
+	csvService := services.NewCsvService(ctx, csvRepository, importJobRepository, services.CsvImportConfigFromEnv())
 	csvController := controllers.NewCsvController(csvService)
+	// 前回の終了時に実行中だったジョブは、再開できるよう中断したものとして記録し、期限切れのアップロードを破棄する
+	if err := csvService.InterruptJobs(); err != nil {
+		log.Printf("failed to clean up import jobs: %v", err)
+	}
 
 	// ルーターの作成
 	r := gin.Default()
 
-	// CORSの設定
-	r.Use(cors.Default())
+	// CORSの設定, 分割アップロードのヘッダーをブラウザから送信・参照できるようにする
+	corsConfig := cors.DefaultConfig()
+	corsConfig.AllowAllOrigins = true
+	corsConfig.AddAllowHeaders("Tus-Resumable", "Upload-Length", "Upload-Metadata", "Upload-Offset", "Upload-Checksum")
+	corsConfig.AddExposeHeaders("Location", "Tus-Resumable", "Upload-Offset", "Upload-Length")
+	r.Use(cors.New(corsConfig))
 
 	// ルーティンググループの作成
 	itemRouter := r.Group("/items")
 	itemRouterWithAuth := r.Group("/items", middlewares.AuthMiddleware(authService))
 	authRouter := r.Group("/auth")
-	csvRouter := r.Group("/csv")
+	csvRouter := r.Group("/csv", middlewares.AuthMiddleware(authService))
 
 	// ルーティングの設定
 	itemRouter.GET("", itemController.FindAll)
@@ -52,6 +70,31 @@ func setupRouter(db *gorm.DB) *gin.Engine {
 	authRouter.POST("/login", authController.Login)
 
 	csvRouter.POST("/process", csvController.ProcessCsv)
+	csvRouter.GET("/jobs", csvController.FindAllJobs)
+	csvRouter.GET("/jobs/:id", csvController.FindJobById)
+	csvRouter.DELETE("/jobs/:id", csvController.CancelJob)
+	csvRouter.POST("/jobs/:id/resume", csvController.ResumeJob)
+	csvRouter.POST("/uploads", csvController.CreateUpload)
+	csvRouter.HEAD("/uploads/:id", csvController.HeadUpload)
+	csvRouter.PATCH("/uploads/:id", csvController.AppendUpload)
+	csvRouter.POST("/uploads/:id/finalize", csvController.FinalizeUpload)
+	csvRouter.GET("/jobs/:id/events", csvController.StreamJobEvents)
+	csvRouter.GET("/jobs/:id/errors", csvController.FindRejectedRows)
+	csvRouter.GET("/jobs/:id/rejects", csvController.DownloadRejectedRows)
+	csvRouter.GET("/export", csvController.ExportCsv)
+	csvRouter.GET("/contacts", csvController.FindCsvs)
+	csvRouter.GET("/contacts/deleted", csvController.FindDeletedCsvs)
+	csvRouter.GET("/contacts/:id", csvController.FindCsvById)
+	csvRouter.GET("/contacts/:id/provenance", csvController.FindCsvProvenance)
+	csvRouter.POST("/contacts", csvController.CreateCsv)
+	csvRouter.PUT("/contacts/:id", csvController.UpdateCsv)
+	csvRouter.DELETE("/contacts/:id", csvController.DeleteCsv)
+	csvRouter.POST("/contacts/:id/restore", csvController.RestoreCsv)
+	csvRouter.DELETE("/contacts/:id/purge", csvController.PurgeCsv)
+	csvRouter.GET("/imports", csvController.FindAllBatches)
+	csvRouter.GET("/imports/:id", csvController.FindBatchById)
+	csvRouter.GET("/imports/:id/contacts", csvController.FindBatchCsvs)
+	csvRouter.DELETE("/imports/:id", csvController.RollbackBatch)
 
 	return r
 }
@@ -63,10 +106,30 @@ func main() {
 	// DB接続
 	db := infra.SetupDB()
 
-	// ルーターの設定 引数にDBを渡すことで、各レイヤー(サービス,リポジトリ,コントローラ)でDBを利用できる
-	r := setupRouter(db)
+	// SIGINT, SIGTERMを受け取ったらキャンセルされるcontext
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	r.Run(":8080")
+	// ルーターの設定 引数にDBを渡すことで、各レイヤー(サービス,リポジトリ,コントローラ)でDBを利用できる
+	r := setupRouter(ctx, db)
+
+	server := &http.Server{Addr: ":8080", Handler: r}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	// シグナルを受け取るまで待機し、処理中のリクエストが終わるのを待ってから終了する
+	// 実行中の取り込みジョブはctxのキャンセルによって中断される
+	<-ctx.Done()
+	stop()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("failed to shutdown server: %v", err)
+		os.Exit(1)
+	}
 }
 
 // itemRepository := repositories.NewItemMemoryRepository(items)
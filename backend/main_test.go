@@ -1,26 +1,46 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
+	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/text/encoding/japanese"
 	"gorm.io/gorm"
 
 	"project/dto"
 	"project/infra"
 	"project/models"
+	"project/repositories"
 	"project/services"
+	"project/utils"
 )
 
+// テスト用のデータベースを作成するディレクトリ
+var testDBDir string
+
 func TestMain(m *testing.M) {
 	// テスト用の.envファイルを読み込む
 	if err := godotenv.Load(".env.test"); err != nil {
@@ -28,9 +48,15 @@ func TestMain(m *testing.M) {
 	}
 
 	// テスト用のデータベースをセットアップ
+	dir, err := os.MkdirTemp("", "test-db-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	testDBDir = dir
 	code := m.Run()
 
 	// テストが終わったらテスト用のデータベースを削除
+	os.RemoveAll(testDBDir)
 	os.Exit(code)
 }
 
@@ -56,13 +82,88 @@ func setupTestData(db *gorm.DB) {
 }
 
 func setup() *gin.Engine {
-	db := infra.SetupDB()
-	db.AutoMigrate(&models.User{}, &models.Item{})
+	router, _ := setupWithDB()
+	return router
+}
+
+// CSV取り込みのテストではDBの中身を確認するため、DBも返す
+func setupWithDB() (*gin.Engine, *gorm.DB) {
+	return setupWithContext(context.Background())
+}
+
+// ctxは取り込みジョブの親になるcontext
+// テストごとに空のデータベースを作成する
+func setupWithContext(ctx context.Context) (*gin.Engine, *gorm.DB) {
+	dir, err := os.MkdirTemp(testDBDir, "")
+	if err != nil {
+		panic(err)
+	}
+	db, err := infra.OpenSqlite(filepath.Join(dir, "app.db"))
+	if err != nil {
+		panic(err)
+	}
+	db.AutoMigrate(&models.User{}, &models.Item{}, &models.Csv{}, &models.ImportJob{}, &models.ImportJobFile{}, &models.ImportRejectedRow{}, &models.ImportBatch{}, &models.CsvSnapshot{}, &models.ImportUpload{})
 
 	setupTestData(db)
-	router := setupRouter(db)
+	router := setupRouter(ctx, db)
 
-	return router
+	return router, db
+}
+
+// utils.CreateCSVFileと同じレイアウトのCSVデータを作成する
+func createCsvData(numRecords int) []byte {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write([]string{"ID", "First Name", "Last Name", "Email", "Phone Number", "Address", "City", "State", "Zip Code", "Country"})
+	for i := 1; i <= numRecords; i++ {
+		customer := utils.GenerateRandomCustomer(i)
+		writer.Write([]string{
+			strconv.Itoa(customer.ID),
+			customer.FirstName,
+			customer.LastName,
+			customer.Email,
+			customer.PhoneNumber,
+			customer.Address,
+			customer.City,
+			customer.State,
+			customer.ZipCode,
+			customer.Country,
+		})
+	}
+	writer.Flush()
+	return buf.Bytes()
+}
+
+// multipart/form-dataでファイルをアップロードするリクエストを作成する
+func newUploadRequest(url string, fileName string, data []byte) *http.Request {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, _ := writer.CreateFormFile("file", fileName)
+	part.Write(data)
+	writer.Close()
+
+	req, _ := newCsvRequest("POST", url, &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+// /csvのエンドポイントは認証が必要なため、テストユーザー1のトークンをセットしたリクエストを作成する
+func newCsvRequest(method string, url string, body io.Reader) (*http.Request, error) {
+	return newUserRequest(method, url, body, 1, "test1@example.com")
+}
+
+// 指定したユーザーのトークンをセットしたリクエストを作成する
+func newUserRequest(method string, url string, body io.Reader, userId uint, email string) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	token, err := services.CreateToken(userId, email)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+*token)
+	return req, nil
 }
 
 // t *testing.T はテストの状態と結果を報告するためのオブジェクト
@@ -167,3 +268,1692 @@ func TestCreateUnauthorized(t *testing.T) {
 	// アサーションを使ってテストの結果を確認
 	assert.Equal(t, http.StatusUnauthorized, w.Code)
 }
+
+// 取り込みジョブが終了するまでGET /csv/jobs/:idをポーリングする
+func waitForJob(t *testing.T, router *gin.Engine, jobId uint) models.ImportJob {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		w := httptest.NewRecorder()
+		req, _ := newCsvRequest("GET", fmt.Sprintf("/csv/jobs/%d", jobId), nil)
+		router.ServeHTTP(w, req)
+
+		var res map[string]models.ImportJob
+		json.Unmarshal(w.Body.Bytes(), &res)
+		job := res["data"]
+		switch job.Status {
+		case models.ImportJobStatusCompleted, models.ImportJobStatusFailed, models.ImportJobStatusCancelled, models.ImportJobStatusInterrupted:
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("import job %d did not finish: %+v", jobId, job)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// リクエストを実行し、登録された取り込みジョブを返す
+func startImport(t *testing.T, router *gin.Engine, req *http.Request) models.ImportJob {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	var res map[string]models.ImportJob
+	json.Unmarshal(w.Body.Bytes(), &res)
+	return res["data"]
+}
+
+func TestProcessCsvUpload(t *testing.T) {
+	router, db := setupWithDB()
+
+	req := newUploadRequest("/csv/process", "contacts.csv", createCsvData(100))
+	job := waitForJob(t, router, startImport(t, router, req).ID)
+
+	assert.Equal(t, models.ImportJobStatusCompleted, job.Status)
+	assert.Equal(t, "contacts.csv", job.FileName)
+	assert.Equal(t, 100, job.TotalRows)
+	assert.Equal(t, 100, job.InsertedRows)
+
+	// 全ての行が登録されていることを確認
+	var count int64
+	db.Model(&models.Csv{}).Count(&count)
+	assert.Equal(t, int64(100), count)
+}
+
+func TestProcessCsvRawBody(t *testing.T) {
+	router, db := setupWithDB()
+
+	req, _ := newCsvRequest("POST", "/csv/process", bytes.NewReader(createCsvData(10)))
+	req.Header.Set("Content-Type", "text/csv")
+	job := waitForJob(t, router, startImport(t, router, req).ID)
+
+	assert.Equal(t, models.ImportJobStatusCompleted, job.Status)
+
+	var count int64
+	db.Model(&models.Csv{}).Count(&count)
+	assert.Equal(t, int64(10), count)
+}
+
+func TestProcessCsvUnsupportedMediaType(t *testing.T) {
+	router := setup()
+
+	w := httptest.NewRecorder()
+	req, _ := newCsvRequest("POST", "/csv/process", bytes.NewBufferString(`<name>test</name>`))
+	req.Header.Set("Content-Type", "application/xml")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+}
+
+func TestFindAllJobs(t *testing.T) {
+	router := setup()
+
+	req := newUploadRequest("/csv/process", "contacts.csv", createCsvData(10))
+	waitForJob(t, router, startImport(t, router, req).ID)
+
+	w := httptest.NewRecorder()
+	req, _ = newCsvRequest("GET", "/csv/jobs", nil)
+	router.ServeHTTP(w, req)
+
+	var res map[string][]models.ImportJob
+	json.Unmarshal(w.Body.Bytes(), &res)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, len(res["data"]))
+}
+
+func TestFindJobByIdNotFound(t *testing.T) {
+	router := setup()
+
+	w := httptest.NewRecorder()
+	req, _ := newCsvRequest("GET", "/csv/jobs/999", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestProcessCsvReorderedColumns(t *testing.T) {
+	router, db := setupWithDB()
+
+	// 列の順番が異なり、別名のヘッダーと余分な列、列が足りない行を含むCSV
+	data := "email,Note,last_name,FirstName,zip\n" +
+		"reorder1@example.com,memo,Yamada,Taro,01234\n" +
+		"reorder2@example.com,memo,Suzuki,Hanako\n"
+	req, _ := newCsvRequest("POST", "/csv/process", bytes.NewBufferString(data))
+	req.Header.Set("Content-Type", "text/csv")
+	job := waitForJob(t, router, startImport(t, router, req).ID)
+
+	assert.Equal(t, models.ImportJobStatusCompleted, job.Status)
+
+	var contact models.Csv
+	db.First(&contact, "email = ?", "reorder1@example.com")
+	assert.Equal(t, "Taro", contact.FirstName)
+	assert.Equal(t, "Yamada", contact.LastName)
+	assert.Equal(t, "01234", contact.ZipCode)
+}
+
+func TestProcessCsvMissingRequiredColumns(t *testing.T) {
+	router, db := setupWithDB()
+
+	data := "First Name,Last Name\nTaro,Yamada\n"
+	w := httptest.NewRecorder()
+	req, _ := newCsvRequest("POST", "/csv/process", bytes.NewBufferString(data))
+	req.Header.Set("Content-Type", "text/csv")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Email")
+
+	// ジョブが登録されていないことを確認
+	var count int64
+	db.Model(&models.ImportJob{}).Count(&count)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestProcessCsvRejectedRows(t *testing.T) {
+	router := setup()
+
+	data := "First Name,Last Name,Email\n" +
+		"Taro,Yamada,taro@example.com\n" +
+		",Suzuki,hanako@example.com\n" +
+		"Jiro,Sato,not-an-email\n" +
+		"Saburo,Tanaka,taro@example.com\n"
+	req, _ := newCsvRequest("POST", "/csv/process?partial=true", bytes.NewBufferString(data))
+	req.Header.Set("Content-Type", "text/csv")
+	job := waitForJob(t, router, startImport(t, router, req).ID)
+
+	assert.Equal(t, models.ImportJobStatusCompleted, job.Status)
+	assert.Equal(t, 4, job.TotalRows)
+	assert.Equal(t, 1, job.InsertedRows)
+	assert.Equal(t, 3, job.FailedRows)
+
+	// エラー行の一覧を取得
+	w := httptest.NewRecorder()
+	req, _ = newCsvRequest("GET", fmt.Sprintf("/csv/jobs/%d/errors", job.ID), nil)
+	router.ServeHTTP(w, req)
+
+	var res map[string][]models.ImportRejectedRow
+	json.Unmarshal(w.Body.Bytes(), &res)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 3, len(res["data"]))
+	assert.Equal(t, 3, res["data"][0].Line)
+	assert.Equal(t, "First Name", res["data"][0].Errors[0].Column)
+	assert.Equal(t, 4, res["data"][1].Line)
+	assert.Equal(t, "Email", res["data"][1].Errors[0].Column)
+	assert.Equal(t, 5, res["data"][2].Line)
+
+	// エラー行をCSVでダウンロード
+	w = httptest.NewRecorder()
+	req, _ = newCsvRequest("GET", fmt.Sprintf("/csv/jobs/%d/rejects", job.ID), nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	records, err := csv.NewReader(w.Body).ReadAll()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 4, len(records))
+	assert.Equal(t, []string{"First Name", "Last Name", "Email", "Error Line", "Error Reason"}, records[0])
+	assert.Equal(t, []string{"", "Suzuki", "hanako@example.com", "3", "First Name is required"}, records[1])
+}
+
+func TestProcessCsvOnConflict(t *testing.T) {
+	router, db := setupWithDB()
+
+	importData := func(query string, data string) models.ImportJob {
+		req, _ := newCsvRequest("POST", "/csv/process"+query, bytes.NewBufferString(data))
+		req.Header.Set("Content-Type", "text/csv")
+		return waitForJob(t, router, startImport(t, router, req).ID)
+	}
+
+	importData("", "First Name,Last Name,Email,City\nTaro,Yamada,taro@example.com,Tokyo\nHanako,Suzuki,hanako@example.com,Osaka\n")
+
+	// 既存の行をエラーにする
+	job := importData("?partial=true", "First Name,Last Name,Email,City\nTaro,Yamada,taro@example.com,Tokyo\nSaburo,Tanaka,saburo@example.com,Kobe\n")
+	assert.Equal(t, models.OnConflictFail, job.OnConflict)
+	assert.Equal(t, 1, job.InsertedRows)
+	assert.Equal(t, 1, job.FailedRows)
+
+	// 既存の行を読み飛ばす
+	job = importData("?on_conflict=skip", "First Name,Last Name,Email,City\nTaro,Yamada,taro@example.com,Nagoya\nJiro,Sato,jiro@example.com,Kyoto\n")
+	assert.Equal(t, 1, job.InsertedRows)
+	assert.Equal(t, 1, job.SkippedRows)
+
+	var contact models.Csv
+	db.First(&contact, "email = ?", "taro@example.com")
+	assert.Equal(t, "Tokyo", contact.City)
+
+	// 既存の行を上書きする
+	job = importData("?on_conflict=overwrite", "First Name,Last Name,Email,City\nTaro,Yamada,taro@example.com,Nagoya\n")
+	assert.Equal(t, 1, job.UpdatedRows)
+
+	var overwritten models.Csv
+	db.First(&overwritten, "email = ?", "taro@example.com")
+	assert.Equal(t, "Nagoya", overwritten.City)
+
+	// 空でない列だけを更新する
+	job = importData("?on_conflict=merge", "First Name,Last Name,Email,City\nHanako,Tanaka,hanako@example.com,\n")
+	assert.Equal(t, 1, job.UpdatedRows)
+
+	var merged models.Csv
+	db.First(&merged, "email = ?", "hanako@example.com")
+	assert.Equal(t, "Tanaka", merged.LastName)
+	assert.Equal(t, "Osaka", merged.City)
+}
+
+func TestProcessCsvInvalidOnConflict(t *testing.T) {
+	router := setup()
+
+	w := httptest.NewRecorder()
+	req, _ := newCsvRequest("POST", "/csv/process?on_conflict=replace", bytes.NewReader(createCsvData(1)))
+	req.Header.Set("Content-Type", "text/csv")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestProcessCsvDryRun(t *testing.T) {
+	router, db := setupWithDB()
+	db.Create(&models.Csv{UserID: 1, FirstName: "Taro", LastName: "Yamada", Email: "taro@example.com"})
+
+	data := "First Name,Last Name,Email\n" +
+		"Taro,Yamada,taro@example.com\n" +
+		"Jiro,Sato,jiro@example.com\n" +
+		"Jiro,Sato,jiro@example.com\n" +
+		"Saburo,,saburo@example.com\n"
+	w := httptest.NewRecorder()
+	req, _ := newCsvRequest("POST", "/csv/process?dry_run=true&on_conflict=skip&preview_limit=2", bytes.NewBufferString(data))
+	req.Header.Set("Content-Type", "text/csv")
+	router.ServeHTTP(w, req)
+
+	var res map[string]dto.ImportPreviewOutput
+	json.Unmarshal(w.Body.Bytes(), &res)
+	preview := res["data"]
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 4, preview.TotalRows)
+	assert.Equal(t, 3, preview.ValidRows)
+	assert.Equal(t, 1, preview.InvalidRows)
+	assert.Equal(t, 2, preview.DuplicateRows)
+	assert.Equal(t, 1, preview.InsertRows)
+	assert.Equal(t, 2, preview.SkipRows)
+	assert.Equal(t, 2, len(preview.Records))
+	assert.Equal(t, "skip", preview.Records[0].Action)
+	assert.Equal(t, "insert", preview.Records[1].Action)
+
+	// 何も登録されていないことを確認
+	var count int64
+	db.Model(&models.Csv{}).Count(&count)
+	assert.Equal(t, int64(1), count)
+	db.Model(&models.ImportJob{}).Count(&count)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestProcessCsvAtomic(t *testing.T) {
+	router, db := setupWithDB()
+	db.Create(&models.Csv{UserID: 1, FirstName: "Taro", LastName: "Yamada", Email: "taro@example.com"})
+
+	// 既存の連絡先と重複する行を含むため、全ての行がロールバックされる
+	data := "First Name,Last Name,Email\n" +
+		"Jiro,Sato,jiro@example.com\n" +
+		"Taro,Yamada,taro@example.com\n" +
+		"Saburo,Tanaka,saburo@example.com\n"
+	req, _ := newCsvRequest("POST", "/csv/process", bytes.NewBufferString(data))
+	req.Header.Set("Content-Type", "text/csv")
+	job := waitForJob(t, router, startImport(t, router, req).ID)
+
+	assert.Equal(t, models.ImportJobStatusFailed, job.Status)
+	assert.Equal(t, false, job.Partial)
+	assert.Equal(t, 0, job.InsertedRows)
+	assert.Equal(t, 1, job.FailedRows)
+
+	var count int64
+	db.Model(&models.Csv{}).Count(&count)
+	assert.Equal(t, int64(1), count)
+
+	// 失敗した行はエラー行として確認できる
+	var rejected []models.ImportRejectedRow
+	db.Where("import_job_id = ?", job.ID).Find(&rejected)
+	assert.Equal(t, 1, len(rejected))
+	assert.Equal(t, 3, rejected[0].Line)
+
+	// 上書きした既存の連絡先も取り込み前の値に戻る
+	data = "First Name,Last Name,Email,City\n" +
+		"Taro,Yamada,taro@example.com,Nagoya\n" +
+		"Jiro,Sato,invalid-email,Osaka\n"
+	req, _ = newCsvRequest("POST", "/csv/process?on_conflict=overwrite", bytes.NewBufferString(data))
+	req.Header.Set("Content-Type", "text/csv")
+	job = waitForJob(t, router, startImport(t, router, req).ID)
+	assert.Equal(t, models.ImportJobStatusFailed, job.Status)
+	assert.Equal(t, 0, job.UpdatedRows)
+
+	var taro models.Csv
+	db.Where("email = ?", "taro@example.com").First(&taro)
+	assert.Equal(t, "", taro.City)
+	assert.Nil(t, taro.ImportBatchID)
+	db.Model(&models.Csv{}).Count(&count)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestCancelJob(t *testing.T) {
+	router := setup()
+
+	// 存在しないジョブ
+	w := httptest.NewRecorder()
+	req, _ := newCsvRequest("DELETE", "/csv/jobs/999", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// 終了済みのジョブはキャンセルできない
+	req = newUploadRequest("/csv/process", "contacts.csv", createCsvData(10))
+	job := waitForJob(t, router, startImport(t, router, req).ID)
+	assert.Equal(t, models.ImportJobStatusCompleted, job.Status)
+
+	w = httptest.NewRecorder()
+	req, _ = newCsvRequest("DELETE", fmt.Sprintf("/csv/jobs/%d", job.ID), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestCancelRunningJob(t *testing.T) {
+	router, db := setupWithDB()
+
+	// 1行ずつ登録して、キャンセルするまでアトミックな取り込みが続くようにする
+	req := newUploadRequest("/csv/process?batch_size=1", "contacts.csv", createCsvData(20000))
+	job := startImport(t, router, req)
+	deadline := time.Now().Add(10 * time.Second)
+	for job.Status != models.ImportJobStatusRunning {
+		if time.Now().After(deadline) {
+			t.Fatalf("import job %d did not start: %+v", job.ID, job)
+		}
+		time.Sleep(10 * time.Millisecond)
+		w := httptest.NewRecorder()
+		req, _ := newCsvRequest("GET", fmt.Sprintf("/csv/jobs/%d", job.ID), nil)
+		router.ServeHTTP(w, req)
+		var res map[string]models.ImportJob
+		json.Unmarshal(w.Body.Bytes(), &res)
+		job = res["data"]
+	}
+
+	// 取り込み中も他のリクエストの書き込みは待たされない
+	w := httptest.NewRecorder()
+	req, _ = newCsvRequest("POST", "/csv/contacts", bytes.NewBufferString(`{"firstName": "Taro", "lastName": "Yamada", "email": "manual@example.com"}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	// 取り込み中のジョブをキャンセルすると、中断するまで待ってからジョブの状態を返す
+	w = httptest.NewRecorder()
+	req, _ = newCsvRequest("DELETE", fmt.Sprintf("/csv/jobs/%d", job.ID), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var res map[string]models.ImportJob
+	json.Unmarshal(w.Body.Bytes(), &res)
+	assert.Equal(t, models.ImportJobStatusCancelled, res["data"].Status)
+	assert.Equal(t, "import was cancelled", res["data"].ErrorSummary)
+
+	// 取り込みは取り消され、取り込んだ行は1行も残らない
+	var count int64
+	db.Model(&models.Csv{}).Where("email <> ?", "manual@example.com").Count(&count)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestStreamJobEventsOtherUser(t *testing.T) {
+	router := setup()
+
+	// ユーザー1の取り込み中のジョブの進捗は、ユーザー2には送信しない
+	req := newUploadRequest("/csv/process?batch_size=1", "contacts.csv", createCsvData(20000))
+	job := startImport(t, router, req)
+	w := httptest.NewRecorder()
+	req, _ = newUserRequest("GET", fmt.Sprintf("/csv/jobs/%d/events", job.ID), nil, 2, "test2@example.com")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.NotContains(t, w.Body.String(), "event:")
+
+	// 取り込み中だったことを確認する
+	w = httptest.NewRecorder()
+	req, _ = newCsvRequest("DELETE", fmt.Sprintf("/csv/jobs/%d", job.ID), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestProcessCsvInterruptedOnShutdown(t *testing.T) {
+	uploadDir := t.TempDir()
+	t.Setenv("CSV_UPLOAD_DIR", uploadDir)
+
+	// サーバーの終了時と同じく、親のcontextがキャンセルされた状態で取り込む
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	router, db := setupWithContext(ctx)
+
+	req := newUploadRequest("/csv/process", "contacts.csv", createCsvData(1000))
+	job := waitForJob(t, router, startImport(t, router, req).ID)
+
+	assert.Equal(t, models.ImportJobStatusInterrupted, job.Status)
+	assert.Equal(t, "import was interrupted by server shutdown", job.ErrorSummary)
+
+	// アトミックな取り込みのため1行も登録されない
+	var count int64
+	db.Model(&models.Csv{}).Count(&count)
+	assert.Equal(t, int64(0), count)
+
+	// 再起動後に同じジョブIDで再開する
+	router = setupRouter(context.Background(), db)
+	w := httptest.NewRecorder()
+	req, _ = newCsvRequest("POST", fmt.Sprintf("/csv/jobs/%d/resume", job.ID), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	job = waitForJob(t, router, job.ID)
+	assert.Equal(t, models.ImportJobStatusCompleted, job.Status)
+	assert.Equal(t, 1000, job.TotalRows)
+	assert.Equal(t, 1000, job.InsertedRows)
+	db.Model(&models.Csv{}).Count(&count)
+	assert.Equal(t, int64(1000), count)
+
+	// 終了したジョブは再開できず、保存したファイルは削除されている
+	w = httptest.NewRecorder()
+	req, _ = newCsvRequest("POST", fmt.Sprintf("/csv/jobs/%d/resume", job.ID), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	entries, _ := os.ReadDir(uploadDir)
+	assert.Empty(t, entries)
+}
+
+func TestResumeJobFromCheckpoint(t *testing.T) {
+	uploadDir := t.TempDir()
+	_, db := setupWithDB()
+
+	// 10行のうち5行目までの登録が確定し、8行目も別のワーカーが登録した時点で異常終了したジョブを作成する
+	data := createCsvData(10)
+	uploadPath := filepath.Join(uploadDir, "contacts.csv")
+	assert.NoError(t, os.WriteFile(uploadPath, data, 0o600))
+	offset := 0
+	for i := 0; i < 5; i++ {
+		offset += bytes.IndexByte(data[offset:], '\n') + 1
+	}
+	job := models.ImportJob{
+		UserID:     1,
+		Status:     models.ImportJobStatusRunning,
+		FileName:   "contacts.csv",
+		OnConflict: models.OnConflictFail,
+		Partial:    true,
+		Format:     models.ImportFormatCsv,
+	}
+	db.Create(&job)
+	options, _ := json.Marshal(dto.ImportCsvInput{Format: models.ImportFormatCsv, Delimiter: ",", HeaderRow: 1, OnConflict: models.OnConflictFail, Partial: true})
+	batch := models.ImportBatch{UserID: 1, ImportJobID: job.ID, FileName: "contacts.csv", UploadPath: uploadPath, Options: string(options)}
+	db.Create(&batch)
+	job.Checkpoint = &models.ImportCheckpoint{BatchID: batch.ID, Line: 5, Offset: int64(offset), ReadRows: 4, InsertedRows: 4}
+	db.Save(&job)
+	for _, line := range []int{2, 3, 4, 5, 8} {
+		customer := utils.GenerateRandomCustomer(line - 1)
+		db.Create(&models.Csv{FirstName: customer.FirstName, LastName: customer.LastName, Email: customer.Email, UserID: 1, ImportBatchID: &batch.ID, SourceLine: line})
+	}
+
+	// 起動時に実行中のジョブは中断したものとして記録される
+	router := setupRouter(context.Background(), db)
+	w := httptest.NewRecorder()
+	req, _ := newCsvRequest("GET", fmt.Sprintf("/csv/jobs/%d", job.ID), nil)
+	router.ServeHTTP(w, req)
+	var res map[string]models.ImportJob
+	json.Unmarshal(w.Body.Bytes(), &res)
+	assert.Equal(t, models.ImportJobStatusInterrupted, res["data"].Status)
+
+	// 他のユーザーのジョブは再開できない
+	w = httptest.NewRecorder()
+	req, _ = newUserRequest("POST", fmt.Sprintf("/csv/jobs/%d/resume", job.ID), nil, 2, "test2@example.com")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = newCsvRequest("POST", fmt.Sprintf("/csv/jobs/%d/resume", job.ID), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	resumed := waitForJob(t, router, job.ID)
+	assert.Equal(t, models.ImportJobStatusCompleted, resumed.Status)
+	assert.Equal(t, 10, resumed.TotalRows)
+	assert.Equal(t, 10, resumed.InsertedRows)
+	assert.Equal(t, 0, resumed.FailedRows)
+	assert.Equal(t, 11, resumed.Checkpoint.Line)
+
+	// 登録済みの行は登録し直さない, 重複すればエラー行になる
+	var csvs []models.Csv
+	db.Order("source_line").Find(&csvs)
+	assert.Equal(t, 10, len(csvs))
+	for i, csv := range csvs {
+		assert.Equal(t, i+2, csv.SourceLine)
+		assert.Equal(t, fmt.Sprintf("user%d@example.com", i+1), csv.Email)
+	}
+	_, err := os.Stat(uploadPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStreamJobEvents(t *testing.T) {
+	router := setup()
+
+	// 存在しないジョブ
+	w := httptest.NewRecorder()
+	req, _ := newCsvRequest("GET", "/csv/jobs/999/events", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// 取り込みの終了まで進捗を受信し、最後に終了イベントを受信する
+	req = newUploadRequest("/csv/process", "contacts.csv", createCsvData(1000))
+	job := startImport(t, router, req)
+
+	w = httptest.NewRecorder()
+	req, _ = newCsvRequest("GET", fmt.Sprintf("/csv/jobs/%d/events", job.ID), nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+
+	events := strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+	last := strings.SplitN(events[len(events)-1], "\n", 2)
+	assert.Equal(t, "event:completed", last[0])
+
+	var event dto.ImportProgressEvent
+	json.Unmarshal([]byte(strings.TrimPrefix(last[1], "data:")), &event)
+	assert.Equal(t, job.ID, event.JobID)
+	assert.Equal(t, 1000, event.ReadRows)
+	assert.Equal(t, 1000, event.InsertedRows)
+}
+
+func TestProcessCsvWorkerPoolOptions(t *testing.T) {
+	router, db := setupWithDB()
+
+	// ワーカーの数とバッチサイズを指定し、ワーカーの数を自動で調整しながら取り込む
+	req := newUploadRequest("/csv/process?partial=true&workers=4&batch_size=50&queue_size=2&adaptive=true", "contacts.csv", createCsvData(1000))
+	job := waitForJob(t, router, startImport(t, router, req).ID)
+
+	assert.Equal(t, models.ImportJobStatusCompleted, job.Status)
+	assert.Equal(t, 1000, job.InsertedRows)
+
+	var count int64
+	db.Model(&models.Csv{}).Count(&count)
+	assert.Equal(t, int64(1000), count)
+
+	// 範囲外の値はエラー
+	w := httptest.NewRecorder()
+	req = newUploadRequest("/csv/process?workers=1000", "contacts.csv", createCsvData(1))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestProcessCsvWorkersDuplicateEmails(t *testing.T) {
+	router, db := setupWithDB()
+	db.Create(&models.Csv{UserID: 1, FirstName: "Taro", LastName: "Yamada", Email: "dup0@example.com", City: "Before"})
+
+	// 同じメールアドレスの行が別々のバッチに含まれても、複数のワーカーでファイル内の順番どおりに登録する
+	var data strings.Builder
+	data.WriteString("first_name,last_name,email,city\n")
+	lastLines := make(map[string]int)
+	for line := 2; line <= 401; line++ {
+		email := fmt.Sprintf("dup%d@example.com", line%10)
+		fmt.Fprintf(&data, "Taro,Yamada,%s,City%d\n", email, line)
+		lastLines[email] = line
+	}
+	req := newUploadRequest("/csv/process?partial=true&on_conflict=overwrite&workers=8&batch_size=3", "contacts.csv", []byte(data.String()))
+	job := waitForJob(t, router, startImport(t, router, req).ID)
+	assert.Equal(t, models.ImportJobStatusCompleted, job.Status)
+	assert.Equal(t, 9, job.InsertedRows)
+	assert.Equal(t, 391, job.UpdatedRows)
+
+	for email, line := range lastLines {
+		var csv models.Csv
+		db.Where("email = ?", email).First(&csv)
+		assert.Equal(t, fmt.Sprintf("City%d", line), csv.City)
+		assert.Equal(t, line, csv.SourceLine)
+	}
+
+	// 取り込み前からあった連絡先は取り込み前の値に戻り、登録した連絡先は削除される
+	var batches map[string][]models.ImportBatch
+	w := httptest.NewRecorder()
+	req, _ = newCsvRequest("GET", "/csv/imports", nil)
+	router.ServeHTTP(w, req)
+	json.Unmarshal(w.Body.Bytes(), &batches)
+	w = httptest.NewRecorder()
+	req, _ = newCsvRequest("DELETE", fmt.Sprintf("/csv/imports/%d?mode=hard", batches["data"][0].ID), nil)
+	router.ServeHTTP(w, req)
+	var res map[string]dto.ImportRollbackOutput
+	json.Unmarshal(w.Body.Bytes(), &res)
+	assert.Equal(t, int64(9), res["data"].DeleteRows)
+	assert.Equal(t, int64(1), res["data"].RestoreRows)
+
+	var rows []models.Csv
+	db.Unscoped().Find(&rows)
+	assert.Equal(t, 1, len(rows))
+	assert.Equal(t, "Before", rows[0].City)
+}
+
+func TestProcessCsvEncodings(t *testing.T) {
+	data := "姓,名,メールアドレス,都道府県\n" +
+		"山田,太郎,yamada@example.com,東京都\n"
+	shiftJIS, _ := japanese.ShiftJIS.NewEncoder().String(data)
+	eucJP, _ := japanese.EUCJP.NewEncoder().String(data)
+	// BOM付きのUTF-8ではBOMが先頭の列名に含まれる
+	withBOM := "\xef\xbb\xbf" + data
+
+	tests := []struct {
+		name     string
+		data     string
+		query    string
+		encoding string
+	}{
+		{name: "shift_jis", data: shiftJIS, encoding: "shift_jis"},
+		{name: "euc-jp", data: eucJP, encoding: "euc-jp"},
+		{name: "utf-8 with bom", data: withBOM, encoding: "utf-8"},
+		{name: "explicit", data: shiftJIS, query: "?encoding=Shift_JIS", encoding: "shift_jis"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router, db := setupWithDB()
+
+			req, _ := newCsvRequest("POST", "/csv/process"+tt.query, bytes.NewBufferString(tt.data))
+			req.Header.Set("Content-Type", "text/csv")
+			job := waitForJob(t, router, startImport(t, router, req).ID)
+
+			assert.Equal(t, models.ImportJobStatusCompleted, job.Status)
+			assert.Equal(t, tt.encoding, job.Encoding)
+			assert.Equal(t, 1, job.InsertedRows)
+
+			var contact models.Csv
+			db.Where("email = ?", "yamada@example.com").First(&contact)
+			assert.Equal(t, "太郎", contact.FirstName)
+			assert.Equal(t, "山田", contact.LastName)
+			assert.Equal(t, "東京都", contact.State)
+		})
+	}
+
+	// 対応していない文字コード
+	router := setup()
+	w := httptest.NewRecorder()
+	req, _ := newCsvRequest("POST", "/csv/process?encoding=latin1", bytes.NewBufferString(data))
+	req.Header.Set("Content-Type", "text/csv")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestProcessCsvDialects(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		query     string
+		delimiter string
+		headerRow int
+	}{
+		{
+			name:      "tsv",
+			data:      "First Name\tLast Name\tEmail\tCity\nTaro\tYamada\tdialect@example.com\tTokyo, Chiyoda\n",
+			delimiter: "\t",
+			headerRow: 1,
+		},
+		{
+			name:      "semicolon",
+			data:      "First Name;Last Name;Email;City\nTaro;Yamada;dialect@example.com;Tokyo, Chiyoda\n",
+			delimiter: ";",
+			headerRow: 1,
+		},
+		{
+			// ヘッダーの前にタイトル行とコメント行があるファイル
+			name:      "preamble",
+			data:      "Contacts export\n# exported at 2024-01-01\nFirst Name,Last Name,Email,City\nTaro,Yamada,dialect@example.com,\"Tokyo, Chiyoda\"\n",
+			query:     "?comment=%23",
+			delimiter: ",",
+			headerRow: 2,
+		},
+		{
+			name:      "explicit",
+			data:      "x|y|z|w\nFirst Name|Last Name|Email|City\n Taro| Yamada| dialect@example.com| \"Tokyo, Chiyoda\"\n",
+			query:     "?delimiter=pipe&header_row=2&trim_leading_space=true",
+			delimiter: "|",
+			headerRow: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router, db := setupWithDB()
+
+			req, _ := newCsvRequest("POST", "/csv/process"+tt.query, bytes.NewBufferString(tt.data))
+			req.Header.Set("Content-Type", "text/csv")
+			job := waitForJob(t, router, startImport(t, router, req).ID)
+
+			assert.Equal(t, models.ImportJobStatusCompleted, job.Status)
+			assert.Equal(t, tt.delimiter, job.Delimiter)
+			assert.Equal(t, tt.headerRow, job.HeaderRow)
+			assert.Equal(t, 1, job.InsertedRows)
+
+			var contact models.Csv
+			db.Where("email = ?", "dialect@example.com").First(&contact)
+			assert.Equal(t, "Taro", contact.FirstName)
+			assert.Equal(t, "Tokyo, Chiyoda", contact.City)
+		})
+	}
+
+	// 区切り文字と同じコメント文字
+	router := setup()
+	w := httptest.NewRecorder()
+	req, _ := newCsvRequest("POST", "/csv/process?delimiter=semicolon&comment=%3B", bytes.NewBufferString(tests[1].data))
+	req.Header.Set("Content-Type", "text/csv")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// シート名とシートのXML(sheetDataの中身)からExcelのファイルを作成する
+func createXlsxData(sheets [][2]string, sharedStrings []string, numFmts map[int]string) []byte {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	write := func(name string, content string) {
+		w, _ := archive.Create(name)
+		w.Write([]byte(xml.Header + content))
+	}
+
+	var sheetList, rels strings.Builder
+	for i, sheet := range sheets {
+		fmt.Fprintf(&sheetList, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, sheet[0], i+1, i+1)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, i+1, i+1)
+		write(fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1),
+			`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`+sheet[1]+`</sheetData></worksheet>`)
+	}
+	write("xl/workbook.xml", `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`+sheetList.String()+`</sheets></workbook>`)
+	write("xl/_rels/workbook.xml.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`+rels.String()+`</Relationships>`)
+
+	var sst strings.Builder
+	for _, s := range sharedStrings {
+		fmt.Fprintf(&sst, "<si><t>%s</t></si>", s)
+	}
+	write("xl/sharedStrings.xml", `<sst xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`+sst.String()+`</sst>`)
+
+	// スタイルのインデックスはnumFmtsのキーの昇順に1から割り当てる
+	var fmts, xfs strings.Builder
+	xfs.WriteString(`<xf numFmtId="0"/>`)
+	for id := 164; id < 164+len(numFmts); id++ {
+		fmt.Fprintf(&fmts, `<numFmt numFmtId="%d" formatCode="%s"/>`, id, numFmts[id])
+		fmt.Fprintf(&xfs, `<xf numFmtId="%d"/>`, id)
+	}
+	write("xl/styles.xml", `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><numFmts>`+fmts.String()+`</numFmts><cellXfs>`+xfs.String()+`</cellXfs></styleSheet>`)
+
+	archive.Close()
+	return buf.Bytes()
+}
+
+func TestProcessCsvXlsx(t *testing.T) {
+	router, db := setupWithDB()
+
+	sharedStrings := []string{"Contacts", "First Name", "Last Name", "Email", "Zip Code", "Phone Number", "Taro", "Yamada", "xlsx1@example.com", "Hanako", "Suzuki", "xlsx2@example.com"}
+	numFmts := map[int]string{
+		164: "00000",
+		165: `[&lt;=999]000;[&lt;=9999]000\-00;000\-0000`,
+		166: "0##########",
+	}
+	contacts := `<row r="1"><c r="A1" t="s"><v>0</v></c></row>` +
+		`<row r="3"><c r="A3" t="s"><v>1</v></c><c r="B3" t="s"><v>2</v></c><c r="C3" t="s"><v>3</v></c><c r="D3" t="s"><v>4</v></c><c r="E3" t="s"><v>5</v></c></row>` +
+		`<row r="4"><c r="A4" t="s"><v>6</v></c><c r="B4" t="s"><v>7</v></c><c r="C4" t="s"><v>8</v></c><c r="D4" s="1"><v>1234</v></c><c r="E4" s="3"><v>9012345678</v></c></row>` +
+		`<row r="5"><c r="A5" t="s"><v>9</v></c><c r="B5" t="s"><v>10</v></c><c r="C5" t="s"><v>11</v></c><c r="D5" s="2"><v>600001</v></c><c r="E5" t="inlineStr"><is><t>03-1234-5678</t></is></c></row>`
+	data := createXlsxData([][2]string{{"Notes", ""}, {"Contacts", contacts}}, sharedStrings, numFmts)
+
+	req := newUploadRequest("/csv/process?sheet=Contacts", "contacts.xlsx", data)
+	job := waitForJob(t, router, startImport(t, router, req).ID)
+
+	assert.Equal(t, models.ImportJobStatusCompleted, job.Status)
+	assert.Equal(t, models.ImportFormatXlsx, job.Format)
+	assert.Equal(t, "Contacts", job.Sheet)
+	// ヘッダー行は空の行も含めたシートの行番号になる
+	assert.Equal(t, 3, job.HeaderRow)
+	assert.Equal(t, 2, job.InsertedRows)
+
+	// 数値のセルは表示形式に従って先頭の0を補う
+	var contact models.Csv
+	db.Where("email = ?", "xlsx1@example.com").First(&contact)
+	assert.Equal(t, "Taro", contact.FirstName)
+	assert.Equal(t, "01234", contact.ZipCode)
+	assert.Equal(t, "09012345678", contact.PhoneNumber)
+
+	var other models.Csv
+	db.Where("email = ?", "xlsx2@example.com").First(&other)
+	assert.Equal(t, "060-0001", other.ZipCode)
+	assert.Equal(t, "03-1234-5678", other.PhoneNumber)
+
+	// 存在しないシート
+	w := httptest.NewRecorder()
+	req = newUploadRequest("/csv/process?sheet=Missing", "contacts.xlsx", data)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// ヘッダー行はシートの行番号で指定する, 空の行を指定した場合はジョブを登録しない
+	req = newUploadRequest("/csv/process?sheet=Contacts&header_row=3&on_conflict=skip", "contacts.xlsx", data)
+	job = waitForJob(t, router, startImport(t, router, req).ID)
+	assert.Equal(t, models.ImportJobStatusCompleted, job.Status)
+	assert.Equal(t, 2, job.SkippedRows)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newUploadRequest("/csv/process?sheet=Contacts&header_row=2", "contacts.xlsx", data))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "row 2 of the sheet is empty")
+}
+
+func TestProcessCsvXlsxSharedStringsLimit(t *testing.T) {
+	t.Setenv("CSV_MAX_UNCOMPRESSED_SIZE", "4096")
+	router, db := setupWithDB()
+
+	header := `<row r="1"><c r="A1" t="s"><v>0</v></c><c r="B1" t="s"><v>1</v></c><c r="C1" t="s"><v>2</v></c></row>`
+	row := `<row r="2"><c r="A2" t="s"><v>3</v></c><c r="B2" t="s"><v>3</v></c><c r="C2" t="s"><v>4</v></c></row>`
+
+	// 展開後の共有文字列が上限を超える場合は、メモリに載せずに不正なファイルとして扱う
+	sharedStrings := []string{"First Name", "Last Name", "Email", strings.Repeat("x", 8192), "xlsx1@example.com"}
+	data := createXlsxData([][2]string{{"Contacts", header + row}}, sharedStrings, nil)
+	assert.Less(t, len(data), 4096)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newUploadRequest("/csv/process", "contacts.xlsx", data))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid xlsx workbook: xl/sharedStrings.xml")
+	var count int64
+	db.Model(&models.ImportJob{}).Count(&count)
+	assert.Equal(t, int64(0), count)
+
+	// 上限以内であれば取り込める
+	sharedStrings[3] = "Taro"
+	data = createXlsxData([][2]string{{"Contacts", header + row}}, sharedStrings, nil)
+	job := waitForJob(t, router, startImport(t, router, newUploadRequest("/csv/process", "contacts.xlsx", data)).ID)
+	assert.Equal(t, models.ImportJobStatusCompleted, job.Status)
+	assert.Equal(t, 1, job.InsertedRows)
+}
+
+func TestProcessCsvXlsxColumnOutOfRange(t *testing.T) {
+	router, db := setupWithDB()
+
+	header := `<row r="1"><c r="A1" t="inlineStr"><is><t>First Name</t></is></c><c r="B1" t="inlineStr"><is><t>Last Name</t></is></c><c r="C1" t="inlineStr"><is><t>Email</t></is></c></row>`
+	row := `<row r="2"><c r="A2" t="inlineStr"><is><t>Taro</t></is></c><c r="B2" t="inlineStr"><is><t>Yamada</t></is></c><c r="C2" t="inlineStr"><is><t>xlsx1@example.com</t></is></c></row>`
+
+	// 最終列(XFD)を超える位置のセルを含む行は、巨大な行を作らずにファイルの取り込みを失敗にする
+	data := createXlsxData([][2]string{{"Contacts", header + row + `<row r="3"><c r="AAAAAAA3" t="inlineStr"><is><t>x</t></is></c></row>`}}, nil, nil)
+	req := newUploadRequest("/csv/process?partial=true", "contacts.xlsx", data)
+	job := waitForJob(t, router, startImport(t, router, req).ID)
+	assert.Equal(t, models.ImportJobStatusFailed, job.Status)
+	assert.Contains(t, job.ErrorSummary, "invalid xlsx workbook")
+
+	// 桁あふれする位置のセルがヘッダー行にある場合はジョブを登録しない
+	data = createXlsxData([][2]string{{"Contacts", strings.Replace(header, `r="C1"`, `r="AAAAAAAAAAAAAAAAC1"`, 1) + row}}, nil, nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newUploadRequest("/csv/process", "contacts.xlsx", data))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// XFDまでの列は取り込める
+	data = createXlsxData([][2]string{{"Contacts", header + row + `<row r="3"><c r="XFD3" t="inlineStr"><is><t>x</t></is></c></row>`}}, nil, nil)
+	req = newUploadRequest("/csv/process?partial=true", "contacts.xlsx", data)
+	job = waitForJob(t, router, startImport(t, router, req).ID)
+	assert.Equal(t, models.ImportJobStatusCompleted, job.Status)
+	var count int64
+	db.Model(&models.Csv{}).Where("email = ?", "xlsx1@example.com").Count(&count)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestProcessCsvJson(t *testing.T) {
+	router, db := setupWithDB()
+
+	// JSON Lines, 空行は読み飛ばし、行番号はファイルの行で数える
+	data := `{"first_name": "Taro", "last_name": "Yamada", "email": "jsonl1@example.com", "zip": "01234", "id": 1}` + "\n" +
+		"\n" +
+		`{"FirstName": "Hanako", "LastName": "Suzuki", "Email": "jsonl2@example.com", "Phone": null}` + "\n" +
+		`{"first_name": "Jiro", "last_name": "Sato"}` + "\n"
+	req, _ := newCsvRequest("POST", "/csv/process?partial=true", bytes.NewBufferString(data))
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	job := waitForJob(t, router, startImport(t, router, req).ID)
+
+	assert.Equal(t, models.ImportJobStatusCompleted, job.Status)
+	assert.Equal(t, models.ImportFormatJsonl, job.Format)
+	assert.Equal(t, 2, job.InsertedRows)
+	assert.Equal(t, 1, job.FailedRows)
+
+	var rejected []models.ImportRejectedRow
+	db.Where("import_job_id = ?", job.ID).Find(&rejected)
+	assert.Equal(t, 1, len(rejected))
+	assert.Equal(t, 4, rejected[0].Line)
+
+	var contact models.Csv
+	db.Where("email = ?", "jsonl1@example.com").First(&contact)
+	assert.Equal(t, "Taro", contact.FirstName)
+	assert.Equal(t, "01234", contact.ZipCode)
+
+	// トップレベルが配列のJSON
+	data = `[{"first_name": "Saburo", "last_name": "Tanaka", "email": "json1@example.com", "zip_code": 1234567}]`
+	req = newUploadRequest("/csv/process", "contacts.json", []byte(data))
+	job = waitForJob(t, router, startImport(t, router, req).ID)
+
+	assert.Equal(t, models.ImportJobStatusCompleted, job.Status)
+	assert.Equal(t, models.ImportFormatJson, job.Format)
+	assert.Equal(t, 1, job.InsertedRows)
+
+	var other models.Csv
+	db.Where("email = ?", "json1@example.com").First(&other)
+	assert.Equal(t, "1234567", other.ZipCode)
+
+	// JSON Linesの不正な行と、同じ列に対応するキーが複数あるオブジェクトは、その行だけを取り込めない行とする
+	data = `{"first_name": "Shiro", "last_name": "Ito", "email": "jsonl3@example.com"}` + "\n" +
+		`{"first_name": "Goro", "last_name": ` + "\n" +
+		`{"first_name": "Rokuro", "last_name": "Kato", "email": "jsonl4@example.com", "Email": "jsonl5@example.com"}` + "\n" +
+		`{"first_name": "Nana", "last_name": "Kimura", "email": "jsonl6@example.com"}` + "\n"
+	req, _ = newCsvRequest("POST", "/csv/process?partial=true", bytes.NewBufferString(data))
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	job = waitForJob(t, router, startImport(t, router, req).ID)
+	assert.Equal(t, models.ImportJobStatusCompleted, job.Status)
+	assert.Equal(t, 2, job.InsertedRows)
+	assert.Equal(t, 2, job.FailedRows)
+	db.Where("import_job_id = ?", job.ID).Order("line").Find(&rejected)
+	assert.Equal(t, 2, len(rejected))
+	assert.Equal(t, 2, rejected[0].Line)
+	assert.Contains(t, rejected[0].Errors[0].Reason, "invalid json")
+	assert.Equal(t, 3, rejected[1].Line)
+	assert.Equal(t, `duplicate keys: "Email" and "email"`, rejected[1].Errors[0].Reason)
+
+	// 配列のオブジェクトでない要素も、その要素だけを取り込めない行とする
+	data = `[{"first_name": "Hachiro", "last_name": "Mori", "email": "json2@example.com"}, "not an object"]`
+	req = newUploadRequest("/csv/process?partial=true", "contacts.json", []byte(data))
+	job = waitForJob(t, router, startImport(t, router, req).ID)
+	assert.Equal(t, models.ImportJobStatusCompleted, job.Status)
+	assert.Equal(t, 1, job.InsertedRows)
+	assert.Equal(t, 1, job.FailedRows)
+
+	// 不正なJSONはドライランでエラーになる
+	w := httptest.NewRecorder()
+	req, _ = newCsvRequest("POST", "/csv/process?dry_run=true", bytes.NewBufferString(`[{"email": }]`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// ファイル名と内容の組からzipを作成する
+func createZipData(files [][2]string) []byte {
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	for _, file := range files {
+		part, _ := writer.Create(file[0])
+		part.Write([]byte(file[1]))
+	}
+	writer.Close()
+	return buf.Bytes()
+}
+
+func TestProcessCsvGzip(t *testing.T) {
+	router, db := setupWithDB()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("First Name,Last Name,Email\nTaro,Yamada,gzip1@example.com\n"))
+	gz.Close()
+
+	// 拡張子の.gzを除いたファイル名で形式を判定する
+	req := newUploadRequest("/csv/process", "contacts.csv.gz", buf.Bytes())
+	job := waitForJob(t, router, startImport(t, router, req).ID)
+	assert.Equal(t, models.ImportJobStatusCompleted, job.Status)
+	assert.Equal(t, models.ImportFormatCsv, job.Format)
+	assert.Equal(t, 1, job.InsertedRows)
+
+	// Content-Typeがgzip以外でも、先頭のマジックナンバーで判定して展開する
+	buf.Reset()
+	gz = gzip.NewWriter(&buf)
+	gz.Write([]byte(`{"first_name": "Hanako", "last_name": "Suzuki", "email": "gzip2@example.com"}` + "\n"))
+	gz.Close()
+	req, _ = newCsvRequest("POST", "/csv/process", bytes.NewReader(buf.Bytes()))
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	job = waitForJob(t, router, startImport(t, router, req).ID)
+	assert.Equal(t, models.ImportJobStatusCompleted, job.Status)
+	assert.Equal(t, 1, job.InsertedRows)
+
+	var count int64
+	db.Model(&models.Csv{}).Where("email IN ?", []string{"gzip1@example.com", "gzip2@example.com"}).Count(&count)
+	assert.Equal(t, int64(2), count)
+}
+
+func TestProcessCsvZip(t *testing.T) {
+	router, db := setupWithDB()
+
+	data := createZipData([][2]string{
+		{"contacts/a.csv", "First Name,Last Name,Email\nTaro,Yamada,zip1@example.com\nJiro,Sato,not-an-email\n"},
+		{"contacts/b.jsonl", `{"first_name": "Hanako", "last_name": "Suzuki", "email": "zip2@example.com"}` + "\n"},
+		{"contacts/c.csv", "Name,Phone\nTaro,0000\n"},
+		{"README.md", "not imported"},
+		{"__MACOSX/contacts/._a.csv", "not imported"},
+	})
+	req := newUploadRequest("/csv/process?partial=true", "contacts.zip", data)
+	started := startImport(t, router, req)
+	assert.Equal(t, 3, len(started.Files))
+	job := waitForJob(t, router, started.ID)
+
+	// ヘッダーが不正なファイルがあるため、他のファイルを取り込んだうえでジョブは失敗になる
+	assert.Equal(t, models.ImportJobStatusFailed, job.Status)
+	assert.Equal(t, "1 of 3 files failed", job.ErrorSummary)
+	assert.Equal(t, models.ImportFormatZip, job.Format)
+	assert.Equal(t, 3, job.TotalRows)
+	assert.Equal(t, 2, job.InsertedRows)
+	assert.Equal(t, 1, job.FailedRows)
+
+	assert.Equal(t, 3, len(job.Files))
+	assert.Equal(t, "contacts/a.csv", job.Files[0].FileName)
+	assert.Equal(t, models.ImportJobStatusCompleted, job.Files[0].Status)
+	assert.Equal(t, 1, job.Files[0].InsertedRows)
+	assert.Equal(t, 1, job.Files[0].FailedRows)
+	assert.Equal(t, models.ImportFormatJsonl, job.Files[1].Format)
+	assert.Equal(t, models.ImportJobStatusCompleted, job.Files[1].Status)
+	assert.Equal(t, 1, job.Files[1].InsertedRows)
+	assert.Equal(t, models.ImportJobStatusFailed, job.Files[2].Status)
+	assert.Contains(t, job.Files[2].ErrorSummary, "missing required columns")
+
+	var count int64
+	db.Model(&models.Csv{}).Where("email IN ?", []string{"zip1@example.com", "zip2@example.com"}).Count(&count)
+	assert.Equal(t, int64(2), count)
+
+	// zipのエラー行はファイルを指定してダウンロードする
+	w := httptest.NewRecorder()
+	req, _ = newCsvRequest("GET", fmt.Sprintf("/csv/jobs/%d/rejects", job.ID), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = newCsvRequest("GET", fmt.Sprintf("/csv/jobs/%d/rejects?file=contacts/a.csv", job.ID), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	records, err := csv.NewReader(w.Body).ReadAll()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, []string{"Jiro", "Sato", "not-an-email", "3", "Email is not a valid email address"}, records[1])
+
+	// 取り込めるファイルが無いzip
+	w = httptest.NewRecorder()
+	req = newUploadRequest("/csv/process", "empty.zip", createZipData([][2]string{{"README.md", "x"}}))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestProcessCsvZipLimits(t *testing.T) {
+	data := createZipData([][2]string{
+		{"a.csv", "First Name,Last Name,Email\nTaro,Yamada,limit1@example.com\n"},
+		{"b.csv", "First Name,Last Name,Email\nHanako,Suzuki,limit2@example.com\n"},
+	})
+
+	// ファイル数の上限
+	t.Setenv("CSV_ZIP_MAX_ENTRIES", "1")
+	router := setup()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newUploadRequest("/csv/process", "contacts.zip", data))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// 展開後のサイズの上限
+	t.Setenv("CSV_ZIP_MAX_ENTRIES", "")
+	t.Setenv("CSV_MAX_UNCOMPRESSED_SIZE", "64")
+	router = setup()
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newUploadRequest("/csv/process", "contacts.zip", data))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(createCsvData(10))
+	gz.Close()
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newUploadRequest("/csv/process", "contacts.csv.gz", buf.Bytes()))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+}
+
+func TestExportCsv(t *testing.T) {
+	router, db := setupWithDB()
+
+	db.Create(&[]models.Csv{
+		{UserID: 1, FirstName: "Taro", LastName: "Yamada", Email: "export1@example.com", City: "Shibuya", State: "Tokyo", Country: "Japan"},
+		{UserID: 1, FirstName: "Hanako", LastName: "Suzuki", Email: "export2@example.com", City: "Osaka", State: "Osaka", Country: "Japan"},
+		{UserID: 1, FirstName: "John", LastName: "Smith", Email: "export3@example.com", City: "City1", State: "CA", Country: "USA"},
+	})
+
+	// 全ての列はutils.CreateCSVFileと同じヘッダーになる
+	w := httptest.NewRecorder()
+	req, _ := newCsvRequest("GET", "/csv/export", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	records, err := csv.NewReader(w.Body).ReadAll()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 4, len(records))
+	assert.Equal(t, []string{"ID", "First Name", "Last Name", "Email", "Phone Number", "Address", "City", "State", "Zip Code", "Country"}, records[0])
+	assert.Equal(t, "export1@example.com", records[1][3])
+
+	// 条件で絞り込み、列を選んで出力する
+	w = httptest.NewRecorder()
+	req, _ = newCsvRequest("GET", "/csv/export?country=Japan&state=Tokyo&columns=email,first_name&created_from=2000-01-01", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	records, err = csv.NewReader(w.Body).ReadAll()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, [][]string{{"Email", "First Name"}, {"export1@example.com", "Taro"}}, records)
+
+	// 登録日時の範囲外
+	w = httptest.NewRecorder()
+	req, _ = newCsvRequest("GET", "/csv/export?created_to=2000-01-01", nil)
+	router.ServeHTTP(w, req)
+	records, _ = csv.NewReader(w.Body).ReadAll()
+	assert.Equal(t, 1, len(records))
+
+	// 存在しない列・不正な日付
+	for _, query := range []string{"columns=email,unknown", "created_from=yesterday"} {
+		w = httptest.NewRecorder()
+		req, _ = newCsvRequest("GET", "/csv/export?"+query, nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.NotEqual(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestFindCsvs(t *testing.T) {
+	router, db := setupWithDB()
+
+	contacts := []models.Csv{
+		{UserID: 1, FirstName: "Taro", LastName: "Yamada", Email: "taro@example.com", Country: "Japan"},
+		{UserID: 1, FirstName: "Hanako", LastName: "Yamamoto", Email: "hanako@example.com", Country: "Japan"},
+		{UserID: 1, FirstName: "John", LastName: "Smith", Email: "john@example.com", Country: "USA"},
+		{UserID: 1, FirstName: "Jane", LastName: "Doe", Email: "jane_doe@example.com", Country: "USA"},
+		{UserID: 1, FirstName: "Jiro", LastName: "Sato", Email: "jiro@example.org", Country: "Japan"},
+	}
+	db.Create(&contacts)
+
+	findCsvs := func(query string) (int, dto.CsvPageOutput) {
+		w := httptest.NewRecorder()
+		req, _ := newCsvRequest("GET", "/csv/contacts?"+query, nil)
+		router.ServeHTTP(w, req)
+		var res map[string]dto.CsvPageOutput
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w.Code, res["data"]
+	}
+	emails := func(page dto.CsvPageOutput) []string {
+		var emails []string
+		for _, record := range page.Records {
+			emails = append(emails, record.Email)
+		}
+		return emails
+	}
+
+	// オフセット方式
+	code, page := findCsvs("limit=2&offset=2")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, int64(5), page.Total)
+	assert.Equal(t, []string{"john@example.com", "jane_doe@example.com"}, emails(page))
+
+	// カーソル方式, 並び順の列の値が同じ行はidで並べる
+	var all []string
+	cursor := ""
+	for i := 0; i < 5; i++ {
+		code, page = findCsvs("limit=2&sort=-country&cursor=" + cursor)
+		assert.Equal(t, http.StatusOK, code)
+		all = append(all, emails(page)...)
+		if cursor = page.NextCursor; cursor == "" {
+			break
+		}
+	}
+	assert.Equal(t, []string{"jane_doe@example.com", "john@example.com", "jiro@example.org", "hanako@example.com", "taro@example.com"}, all)
+
+	// 絞り込みと検索
+	_, page = findCsvs("country=Japan&q=yama&match=prefix")
+	assert.Equal(t, []string{"taro@example.com", "hanako@example.com"}, emails(page))
+	_, page = findCsvs("q=.ORG")
+	assert.Equal(t, []string{"jiro@example.org"}, emails(page))
+	// LIKEの特殊文字は文字として検索する
+	_, page = findCsvs("q=e_d")
+	assert.Equal(t, []string{"jane_doe@example.com"}, emails(page))
+
+	// 不正な条件
+	for _, query := range []string{"sort=password", "cursor=invalid", "offset=1&cursor=" + page.NextCursor + "x", "match=exact"} {
+		code, _ = findCsvs(query)
+		assert.Equal(t, http.StatusBadRequest, code, query)
+	}
+
+	// IDで取得
+	w := httptest.NewRecorder()
+	req, _ := newCsvRequest("GET", fmt.Sprintf("/csv/contacts/%d", contacts[2].ID), nil)
+	router.ServeHTTP(w, req)
+	var res map[string]models.Csv
+	json.Unmarshal(w.Body.Bytes(), &res)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "john@example.com", res["data"].Email)
+
+	w = httptest.NewRecorder()
+	req, _ = newCsvRequest("GET", "/csv/contacts/9999", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestCsvCrud(t *testing.T) {
+	router, db := setupWithDB()
+
+	request := func(method string, url string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := newCsvRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// 登録, 取り込みと同じ検証を行う
+	w := request("POST", "/csv/contacts", `{"firstName": " Taro ", "lastName": "Yamada", "email": "crud@example.com", "country": "Japan"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var res map[string]models.Csv
+	json.Unmarshal(w.Body.Bytes(), &res)
+	created := res["data"]
+	assert.Equal(t, "Taro", created.FirstName)
+
+	w = request("POST", "/csv/contacts", `{"firstName": "Hanako", "email": "not-an-email"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var invalid map[string][]models.ImportRowError
+	json.Unmarshal(w.Body.Bytes(), &invalid)
+	assert.Equal(t, 2, len(invalid["errors"]))
+
+	w = request("POST", "/csv/contacts", `{"firstName": "Hanako", "lastName": "Suzuki", "email": "crud@example.com"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// 指定した項目だけを更新する
+	url := fmt.Sprintf("/csv/contacts/%d", created.ID)
+	w = request("PUT", url, `{"city": "Shibuya"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	json.Unmarshal(w.Body.Bytes(), &res)
+	assert.Equal(t, "Shibuya", res["data"].City)
+	assert.Equal(t, "Japan", res["data"].Country)
+
+	w = request("PUT", url, `{"lastName": ""}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// 重複の確認の後に他のリクエストが同じメールアドレスを登録した場合も409を返す
+	db.Callback().Create().Before("gorm:begin_transaction").Register("test:race", func(tx *gorm.DB) {
+		if csv, ok := tx.Statement.Dest.(*models.Csv); ok && csv.Email == "race@example.com" {
+			db.Exec("INSERT INTO csvs (created_at, updated_at, first_name, last_name, email, user_id) VALUES (?, ?, 'Jiro', 'Sato', ?, ?)", time.Now(), time.Now(), csv.Email, csv.UserID)
+		}
+	})
+	w = request("POST", "/csv/contacts", `{"firstName": "Jiro", "lastName": "Sato", "email": "race@example.com"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	db.Callback().Create().Remove("test:race")
+
+	// 論理削除すると一覧と取得の対象外になり、削除済みの一覧に表示される
+	w = request("DELETE", url, "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = request("GET", url, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = request("GET", "/csv/contacts/deleted", "")
+	var page map[string]dto.CsvPageOutput
+	json.Unmarshal(w.Body.Bytes(), &page)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(1), page["data"].Total)
+	assert.Equal(t, created.ID, page["data"].Records[0].ID)
+
+	// 論理削除した連絡先のメールアドレスは使えない
+	w = request("POST", "/csv/contacts", `{"firstName": "Hanako", "lastName": "Suzuki", "email": "crud@example.com"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// 元に戻す
+	w = request("POST", url+"/restore", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = request("GET", url, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = request("POST", url+"/restore", "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// 論理削除していない連絡先は完全に削除できない
+	w = request("DELETE", url+"/purge", "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	request("DELETE", url, "")
+	w = request("DELETE", url+"/purge", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	var count int64
+	db.Unscoped().Model(&models.Csv{}).Where("id = ?", created.ID).Count(&count)
+	assert.Equal(t, int64(0), count)
+	w = request("POST", url+"/restore", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestCsvUserScope(t *testing.T) {
+	router, db := setupWithDB()
+
+	// トークンが無い場合は401を返す
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/csv/contacts", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// 取り込んだ行には取り込んだユーザーのIDが記録される
+	data := "first_name,last_name,email\nTaro,Yamada,scope@example.com\n"
+	req, _ = newCsvRequest("POST", "/csv/process", bytes.NewBufferString(data))
+	req.Header.Set("Content-Type", "text/csv")
+	job := waitForJob(t, router, startImport(t, router, req).ID)
+	assert.Equal(t, models.ImportJobStatusCompleted, job.Status)
+	var imported models.Csv
+	db.Where("email = ?", "scope@example.com").First(&imported)
+	assert.Equal(t, uint(1), imported.UserID)
+
+	request := func(method string, url string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := newUserRequest(method, url, bytes.NewBufferString(body), 2, "test2@example.com")
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// 他のユーザーの連絡先・ジョブは参照できない
+	w = request("GET", "/csv/contacts", "")
+	var page map[string]dto.CsvPageOutput
+	json.Unmarshal(w.Body.Bytes(), &page)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(0), page["data"].Total)
+
+	w = request("GET", fmt.Sprintf("/csv/contacts/%d", imported.ID), "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = request("DELETE", fmt.Sprintf("/csv/contacts/%d", imported.ID), "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = request("GET", fmt.Sprintf("/csv/jobs/%d", job.ID), "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = request("GET", fmt.Sprintf("/csv/jobs/%d/errors", job.ID), "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = request("GET", "/csv/jobs", "")
+	var jobs map[string][]models.ImportJob
+	json.Unmarshal(w.Body.Bytes(), &jobs)
+	assert.Equal(t, 0, len(jobs["data"]))
+
+	w = request("GET", "/csv/export", "")
+	assert.Equal(t, 1, strings.Count(w.Body.String(), "\n"))
+
+	// メールアドレスはユーザーごとにユニークになる
+	w = request("POST", "/csv/contacts", `{"firstName": "Hanako", "lastName": "Suzuki", "email": "scope@example.com"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var count int64
+	db.Model(&models.Csv{}).Where("email = ?", "scope@example.com").Count(&count)
+	assert.Equal(t, int64(2), count)
+}
+
+func TestImportLineage(t *testing.T) {
+	router, _ := setupWithDB()
+
+	get := func(url string, res any) int {
+		w := httptest.NewRecorder()
+		req, _ := newCsvRequest("GET", url, nil)
+		router.ServeHTTP(w, req)
+		json.Unmarshal(w.Body.Bytes(), res)
+		return w.Code
+	}
+
+	data := "first_name,last_name,email\nTaro,Yamada,lineage1@example.com\nHanako,Suzuki,lineage2@example.com\n"
+	job := waitForJob(t, router, startImport(t, router, newUploadRequest("/csv/process", "contacts.csv", []byte(data))).ID)
+	assert.Equal(t, models.ImportJobStatusCompleted, job.Status)
+
+	// ファイル名・ハッシュ値・行数が記録される
+	var batches map[string][]models.ImportBatch
+	assert.Equal(t, http.StatusOK, get("/csv/imports", &batches))
+	assert.Equal(t, 1, len(batches["data"]))
+	batch := batches["data"][0]
+	sum := sha256.Sum256([]byte(data))
+	assert.Equal(t, "contacts.csv", batch.FileName)
+	assert.Equal(t, hex.EncodeToString(sum[:]), batch.Sha256)
+	assert.Equal(t, 2, batch.RowCount)
+	assert.Equal(t, job.ID, batch.ImportJobID)
+	assert.Equal(t, uint(1), batch.UserID)
+
+	var page map[string]dto.CsvPageOutput
+	assert.Equal(t, http.StatusOK, get(fmt.Sprintf("/csv/imports/%d/contacts", batch.ID), &page))
+	assert.Equal(t, int64(2), page["data"].Total)
+	assert.Equal(t, http.StatusNotFound, get("/csv/imports/9999/contacts", &page))
+
+	// 連絡先ごとに取り込んだファイルと行番号を返す
+	hanako := page["data"].Records[1]
+	var provenance map[string]dto.CsvProvenanceOutput
+	assert.Equal(t, http.StatusOK, get(fmt.Sprintf("/csv/contacts/%d/provenance", hanako.ID), &provenance))
+	assert.Equal(t, "lineage2@example.com", provenance["data"].Contact.Email)
+	assert.Equal(t, batch.ID, provenance["data"].Batch.ID)
+	assert.Equal(t, 3, provenance["data"].Line)
+
+	// 上書きした連絡先は後の取り込みのファイルと行番号になる
+	data = "email,first_name,last_name\nother@example.com,Jiro,Sato\nlineage2@example.com,Hanako,Tanaka\n"
+	req := newUploadRequest("/csv/process?on_conflict=overwrite", "update.csv", []byte(data))
+	waitForJob(t, router, startImport(t, router, req).ID)
+	get(fmt.Sprintf("/csv/contacts/%d/provenance", hanako.ID), &provenance)
+	assert.Equal(t, "update.csv", provenance["data"].Batch.FileName)
+	assert.Equal(t, 3, provenance["data"].Line)
+	get(fmt.Sprintf("/csv/imports/%d/contacts", batch.ID), &page)
+	assert.Equal(t, int64(1), page["data"].Total)
+
+	// APIから登録した連絡先には取り込み元が無い
+	w := httptest.NewRecorder()
+	req, _ = newCsvRequest("POST", "/csv/contacts", bytes.NewBufferString(`{"firstName": "Api", "lastName": "User", "email": "api@example.com"}`))
+	router.ServeHTTP(w, req)
+	var created map[string]models.Csv
+	json.Unmarshal(w.Body.Bytes(), &created)
+	get(fmt.Sprintf("/csv/contacts/%d/provenance", created["data"].ID), &provenance)
+	assert.Nil(t, provenance["data"].Batch)
+	assert.Equal(t, 0, provenance["data"].Line)
+}
+
+func TestRollbackImport(t *testing.T) {
+	router, db := setupWithDB()
+
+	request := func(method string, url string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := newCsvRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+	importData := func(data string) models.ImportBatch {
+		req := newUploadRequest("/csv/process?on_conflict=overwrite", "contacts.csv", []byte(data))
+		job := waitForJob(t, router, startImport(t, router, req).ID)
+		assert.Equal(t, models.ImportJobStatusCompleted, job.Status)
+		var batches map[string][]models.ImportBatch
+		json.Unmarshal(request("GET", "/csv/imports", "").Body.Bytes(), &batches)
+		return batches["data"][0]
+	}
+	city := func(email string) string {
+		var csv models.Csv
+		db.Unscoped().Where("email = ?", email).First(&csv)
+		return csv.City
+	}
+
+	request("POST", "/csv/contacts", `{"firstName": "Taro", "lastName": "Yamada", "email": "keep@example.com", "city": "Shibuya"}`)
+	w := request("POST", "/csv/contacts", `{"firstName": "Jiro", "lastName": "Sato", "email": "deleted@example.com", "city": "Sapporo"}`)
+	var created map[string]models.Csv
+	json.Unmarshal(w.Body.Bytes(), &created)
+	request("DELETE", fmt.Sprintf("/csv/contacts/%d", created["data"].ID), "")
+
+	batch := importData("first_name,last_name,email,city\n" +
+		"New,One,new1@example.com,Osaka\n" +
+		"New,Two,new2@example.com,Osaka\n" +
+		"Taro,Yamada,keep@example.com,Osaka\n" +
+		"Jiro,Sato,deleted@example.com,Osaka\n")
+	url := fmt.Sprintf("/csv/imports/%d", batch.ID)
+
+	// ドライランでは登録した行と上書きした行を返し、何も変更しない
+	w = request("DELETE", url+"?dry_run=true&mode=hard", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var preview map[string]dto.ImportRollbackOutput
+	json.Unmarshal(w.Body.Bytes(), &preview)
+	assert.Equal(t, int64(2), preview["data"].DeleteRows)
+	assert.Equal(t, int64(2), preview["data"].RestoreRows)
+	assert.Equal(t, 4, len(preview["data"].Records))
+	assert.Equal(t, "restore", preview["data"].Records[2].Action)
+	assert.Equal(t, "Osaka", preview["data"].Records[2].Contact.City)
+	assert.Equal(t, "Shibuya", preview["data"].Records[2].Previous.City)
+	assert.Equal(t, "Osaka", city("keep@example.com"))
+
+	// 登録した行は削除し、上書きした行は論理削除も含めて取り込み前の状態に戻す
+	w = request("DELETE", url+"?mode=hard", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var res map[string]dto.ImportRollbackOutput
+	json.Unmarshal(w.Body.Bytes(), &res)
+	assert.Equal(t, int64(2), res["data"].DeleteRows)
+	assert.Equal(t, int64(2), res["data"].RestoreRows)
+	assert.NotNil(t, res["data"].Batch.RolledBackAt)
+
+	var count int64
+	db.Unscoped().Model(&models.Csv{}).Where("email IN ?", []string{"new1@example.com", "new2@example.com"}).Count(&count)
+	assert.Equal(t, int64(0), count)
+	assert.Equal(t, "Shibuya", city("keep@example.com"))
+	assert.Equal(t, "Sapporo", city("deleted@example.com"))
+	db.Model(&models.Csv{}).Where("email = ?", "deleted@example.com").Count(&count)
+	assert.Equal(t, int64(0), count)
+
+	assert.Equal(t, http.StatusConflict, request("DELETE", url, "").Code)
+	assert.Equal(t, http.StatusNotFound, request("DELETE", "/csv/imports/9999", "").Code)
+	assert.Equal(t, http.StatusBadRequest, request("DELETE", url+"?mode=truncate", "").Code)
+
+	// 後の取り込みで上書きされた行は後の取り込みの値を残す
+	first := importData("first_name,last_name,email,city\nTaro,Yamada,keep@example.com,Nagoya\nSoft,Delete,soft@example.com,Nagoya\n")
+	importData("first_name,last_name,email,city\nTaro,Yamada,keep@example.com,Kyoto\n")
+	w = request("DELETE", fmt.Sprintf("/csv/imports/%d", first.ID), "")
+	json.Unmarshal(w.Body.Bytes(), &res)
+	assert.Equal(t, "soft", res["data"].Mode)
+	assert.Equal(t, int64(1), res["data"].DeleteRows)
+	assert.Equal(t, int64(0), res["data"].RestoreRows)
+	assert.Equal(t, int64(1), res["data"].SupersededRows)
+	assert.Equal(t, "Kyoto", city("keep@example.com"))
+
+	// 手動で編集した連絡先は取り込み元の記録が外れ、取り込みを取り消しても編集した値が残る
+	edited := importData("first_name,last_name,email,city\nEdit,Hand,edited@example.com,Nagoya\n")
+	var editedCsv models.Csv
+	db.Where("email = ?", "edited@example.com").First(&editedCsv)
+	w = request("PUT", fmt.Sprintf("/csv/contacts/%d", editedCsv.ID), `{"city": "Fukuoka"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var updated map[string]models.Csv
+	json.Unmarshal(w.Body.Bytes(), &updated)
+	assert.Nil(t, updated["data"].ImportBatchID)
+	assert.Equal(t, 0, updated["data"].SourceLine)
+	w = request("DELETE", fmt.Sprintf("/csv/imports/%d", edited.ID), "")
+	json.Unmarshal(w.Body.Bytes(), &res)
+	assert.Equal(t, int64(0), res["data"].DeleteRows)
+	db.Model(&models.Csv{}).Where("email = ?", "edited@example.com").Count(&count)
+	assert.Equal(t, int64(1), count)
+	assert.Equal(t, "Fukuoka", city("edited@example.com"))
+
+	// 論理削除した場合は削除済みの一覧に表示される
+	var page map[string]dto.CsvPageOutput
+	json.Unmarshal(request("GET", "/csv/contacts/deleted?email=soft@example.com", "").Body.Bytes(), &page)
+	assert.Equal(t, int64(1), page["data"].Total)
+
+	// 論理削除した連絡先のメールアドレスはon_conflict=failでは取り込めず、原因がエラー行に記録される
+	req := newUploadRequest("/csv/process?partial=true", "contacts.csv", []byte("first_name,last_name,email\nSoft,Delete,soft@example.com\nNew,Three,new3@example.com\n"))
+	job := waitForJob(t, router, startImport(t, router, req).ID)
+	assert.Equal(t, 1, job.InsertedRows)
+	assert.Equal(t, 1, job.FailedRows)
+	var rejected []models.ImportRejectedRow
+	db.Where("import_job_id = ?", job.ID).Find(&rejected)
+	assert.Equal(t, 1, len(rejected))
+	assert.Equal(t, repositories.ErrEmailHeldByDeletedCsv.Error()+": soft@example.com", rejected[0].Errors[0].Reason)
+}
+
+// 分割アップロードのリクエストを作成する
+func newChunkRequest(method string, url string, body []byte, headers map[string]string) *http.Request {
+	req, _ := newCsvRequest(method, url, bytes.NewReader(body))
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	return req
+}
+
+func TestChunkedUpload(t *testing.T) {
+	t.Setenv("CSV_UPLOAD_DIR", t.TempDir())
+	router, db := setupWithDB()
+	data := createCsvData(100)
+	half := len(data) / 2
+
+	// アップロードを登録する
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newChunkRequest("POST", "/csv/uploads", nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(len(data)),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("contacts.csv")) + ",filetype " + base64.StdEncoding.EncodeToString([]byte("text/csv")),
+	}))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created map[string]models.ImportUpload
+	json.Unmarshal(w.Body.Bytes(), &created)
+	upload := created["data"]
+	url := fmt.Sprintf("/csv/uploads/%d", upload.ID)
+	assert.Equal(t, url, w.Header().Get("Location"))
+	assert.Equal(t, "contacts.csv", upload.FileName)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newChunkRequest("POST", "/csv/uploads", nil, nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// 前半を送信する
+	chunk := map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": "0"}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newChunkRequest("PATCH", url, data[:half], chunk))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, strconv.Itoa(half), w.Header().Get("Upload-Offset"))
+
+	// 受け取り済みの位置と異なる位置からは送信できない
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newChunkRequest("PATCH", url, data[:half], chunk))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// 受け取り済みの位置を確認する, 他のユーザーのアップロードは見つからない
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newChunkRequest("HEAD", url, nil, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, strconv.Itoa(half), w.Header().Get("Upload-Offset"))
+	assert.Equal(t, strconv.Itoa(len(data)), w.Header().Get("Upload-Length"))
+	w = httptest.NewRecorder()
+	req, _ := newUserRequest("HEAD", url, nil, 2, "test2@example.com")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// 全て受け取る前は取り込めない
+	sum := sha256.Sum256(data)
+	checksum := map[string]string{"Upload-Checksum": "sha256 " + base64.StdEncoding.EncodeToString(sum[:])}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newChunkRequest("POST", url+"/finalize", nil, checksum))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// ファイル全体のバイト数を超えて送信できない
+	chunk["Upload-Offset"] = strconv.Itoa(half)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newChunkRequest("PATCH", url, append(data[half:len(data):len(data)], 'x'), chunk))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// 後半を送信する
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newChunkRequest("PATCH", url, data[half:], chunk))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, strconv.Itoa(len(data)), w.Header().Get("Upload-Offset"))
+
+	// チェックサムが一致しない場合は取り込まない
+	wrong := sha256.Sum256(data[:half])
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newChunkRequest("POST", url+"/finalize", nil, map[string]string{"Upload-Checksum": "sha256 " + base64.StdEncoding.EncodeToString(wrong[:])}))
+	assert.Equal(t, 460, w.Code)
+
+	// 取り込みの準備はジョブの中で行うため、形式が不正な場合はジョブが失敗し、別の設定で取り込み直せる
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newChunkRequest("POST", url+"/finalize?format=xlsx", nil, checksum))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var invalid map[string]models.ImportJob
+	json.Unmarshal(w.Body.Bytes(), &invalid)
+	failed := waitForJob(t, router, invalid["data"].ID)
+	assert.Equal(t, models.ImportJobStatusFailed, failed.Status)
+	assert.Contains(t, failed.ErrorSummary, "invalid xlsx workbook")
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newChunkRequest("POST", url+"/finalize?on_conflict=skip", nil, checksum))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var started map[string]models.ImportJob
+	json.Unmarshal(w.Body.Bytes(), &started)
+	job := waitForJob(t, router, started["data"].ID)
+	assert.Equal(t, models.ImportJobStatusCompleted, job.Status)
+	assert.Equal(t, "contacts.csv", job.FileName)
+	assert.Equal(t, models.OnConflictSkip, job.OnConflict)
+	assert.Equal(t, 100, job.InsertedRows)
+
+	var count int64
+	db.Model(&models.Csv{}).Count(&count)
+	assert.Equal(t, int64(100), count)
+	var batch models.ImportBatch
+	db.Where("import_job_id = ?", job.ID).First(&batch)
+	assert.Equal(t, hex.EncodeToString(sum[:]), batch.Sha256)
+	// 受け取ったファイルは取り込みの準備が済んだ時点で削除される
+	var path string
+	db.Model(&models.ImportUpload{}).Where("id = ?", upload.ID).Pluck("path", &path)
+	assert.NotEmpty(t, path)
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	// 取り込み後は続きを送信・取り込みできない
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newChunkRequest("POST", url+"/finalize", nil, checksum))
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestExpireChunkedUploads(t *testing.T) {
+	t.Setenv("CSV_UPLOAD_DIR", t.TempDir())
+	router, db := setupWithDB()
+
+	createUpload := func() models.ImportUpload {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newChunkRequest("POST", "/csv/uploads", nil, map[string]string{"Upload-Length": "100"}))
+		assert.Equal(t, http.StatusCreated, w.Code)
+		var created map[string]models.ImportUpload
+		json.Unmarshal(w.Body.Bytes(), &created)
+		return created["data"]
+	}
+	expired := createUpload()
+	active := createUpload()
+	var path string
+	db.Model(&models.ImportUpload{}).Where("id = ?", expired.ID).Pluck("path", &path)
+	assert.FileExists(t, path)
+	db.Model(&models.ImportUpload{}).Where("id = ?", expired.ID).UpdateColumn("updated_at", time.Now().Add(-25*time.Hour))
+
+	// 再起動時に、最後に送信してからCSV_UPLOAD_TTLが過ぎたアップロードだけを破棄する
+	router = setupRouter(context.Background(), db)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newChunkRequest("HEAD", fmt.Sprintf("/csv/uploads/%d", expired.ID), nil, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newChunkRequest("HEAD", fmt.Sprintf("/csv/uploads/%d", active.ID), nil, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -1,17 +1,51 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"os"
+	"strconv"
+
 	"project/infra"
 	"project/models"
+
+	"gorm.io/gorm"
 )
 
 func main() {
 	infra.Initialize()
 	db := infra.SetupDB()
 
-	if err := db.AutoMigrate(&models.Item{}, &models.Csv{}); err != nil {
+	// 所有者の無い既存の連絡先・取り込みジョブはCSV_LEGACY_OWNER_IDのユーザーのものとする
+	ownerId, _ := strconv.ParseUint(os.Getenv("CSV_LEGACY_OWNER_ID"), 10, 64)
+	for _, model := range []interface{}{&models.Csv{}, &models.ImportJob{}} {
+		if err := addOwnerColumn(db, model, uint(ownerId)); err != nil {
+			panic("failed to migrate")
+		}
+	}
+	// メールアドレスの一意制約はユーザーごとの複合ユニークインデックスに置き換える
+	if db.Migrator().HasConstraint(&models.Csv{}, "uni_csvs_email") {
+		if err := db.Migrator().DropConstraint(&models.Csv{}, "uni_csvs_email"); err != nil {
+			panic("failed to migrate")
+		}
+	}
+
+	if err := db.AutoMigrate(&models.Item{}, &models.Csv{}, &models.ImportJob{}, &models.ImportJobFile{}, &models.ImportRejectedRow{}, &models.ImportBatch{}, &models.CsvSnapshot{}, &models.ImportUpload{}); err != nil {
 		panic("failed to migrate")
 	}
 	log.Println("migration has been processed")
 }
+
+// 既存のテーブルにuser_idの列が無い場合は、ownerIdを初期値として追加する
+// NOT NULLの列は既存の行があると初期値なしでは追加できないため、AutoMigrateの前に追加する
+func addOwnerColumn(db *gorm.DB, model interface{}, ownerId uint) error {
+	migrator := db.Migrator()
+	if !migrator.HasTable(model) || migrator.HasColumn(model, "UserID") {
+		return nil
+	}
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(model); err != nil {
+		return err
+	}
+	return db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN user_id bigint NOT NULL DEFAULT %d", stmt.Table, ownerId)).Error
+}
@@ -4,13 +4,20 @@ import "gorm.io/gorm"
 
 type Csv struct {
 	gorm.Model
-	FirstName   string `gorm:"not null"`
-	LastName    string `gorm:"not null"`
-	Email       string `gorm:"not null;unique"`
+	FirstName string `gorm:"not null"`
+	LastName  string `gorm:"not null"`
+	// メールアドレスはユーザーごとに一意にする
+	Email       string `gorm:"not null;uniqueIndex:idx_csvs_user_email"`
 	PhoneNumber string
 	Address     string
 	City        string
 	State       string
 	ZipCode     string
 	Country     string
+	// 取り込んだユーザー
+	UserID uint `gorm:"not null;uniqueIndex:idx_csvs_user_email"`
+	// 最後に登録・更新した取り込みと、そのファイル内の行番号
+	// APIから登録・更新した連絡先はnilと0になる
+	ImportBatchID *uint `gorm:"index"`
+	SourceLine    int   `gorm:"not null;default:0"`
 }
@@ -0,0 +1,14 @@
+package models
+
+import "gorm.io/gorm"
+
+// 取り込みで上書き・マージした連絡先の、取り込み前の値
+// 取り込みを取り消す際に元の値へ戻すために利用する
+type CsvSnapshot struct {
+	gorm.Model
+	// 上書きした取り込みの記録と連絡先, 同じ取り込みで複数回更新した場合は最初の値だけを残す
+	ImportBatchID uint `gorm:"not null;uniqueIndex:idx_csv_snapshots_batch_csv"`
+	CsvID         uint `gorm:"not null;uniqueIndex:idx_csv_snapshots_batch_csv"`
+	// 取り込み前の連絡先, 論理削除されていた場合はDeletedAtも含む
+	Previous Csv `gorm:"serializer:json"`
+}
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 取り込んだファイル1つ分の記録, 取り込んだ連絡先のImportBatchIDから参照する
+// zipの場合は中のファイルごとに作成する
+type ImportBatch struct {
+	gorm.Model
+	// アップロードしたユーザー
+	UserID      uint `gorm:"not null;index"`
+	ImportJobID uint `gorm:"not null;index"`
+	// ファイル名, zipの場合はzip内のパス
+	FileName string
+	// ファイルの内容のSHA-256(16進数), gzipの場合は展開後の内容から求める
+	Sha256 string `gorm:"size:64;index"`
+	// ファイルに含まれていたデータ行の数
+	RowCount int `gorm:"not null;default:0"`
+	// 取り込みを取り消した日時, 取り消していない場合はnil
+	RolledBackAt *time.Time
+	// 中断した取り込みを再開するための、保存したファイルのパスと取り込みの設定(JSON)
+	// ファイルは取り込みが終了した時点で削除する
+	UploadPath string `json:"-"`
+	Options    string `json:"-"`
+}
@@ -0,0 +1,128 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 取り込みジョブのステータス
+const (
+	ImportJobStatusPending   = "pending"
+	ImportJobStatusRunning   = "running"
+	ImportJobStatusCompleted = "completed"
+	ImportJobStatusFailed    = "failed"
+	ImportJobStatusCancelled = "cancelled"
+	// サーバーの終了・異常終了によって中断された, 中断した位置から再開できる
+	ImportJobStatusInterrupted = "interrupted"
+)
+
+// メールアドレスが既存の連絡先と重複した場合の扱い
+const (
+	// 重複した行をエラーにする
+	OnConflictFail = "fail"
+	// 重複した行を登録せずに読み飛ばす
+	OnConflictSkip = "skip"
+	// 既存の連絡先を取り込んだ値で上書きする
+	OnConflictOverwrite = "overwrite"
+	// 取り込んだ値のうち空でない列だけで既存の連絡先を更新する
+	OnConflictMerge = "merge"
+)
+
+// アップロードされたファイルの形式
+const (
+	ImportFormatCsv  = "csv"
+	ImportFormatXlsx = "xlsx"
+	// トップレベルが配列のJSON, 先頭が"["でない場合はJSON Linesとして扱う
+	ImportFormatJson  = "json"
+	ImportFormatJsonl = "jsonl"
+	// CSV・Excel・JSONのファイルをまとめたzip, 中のファイルごとに取り込む
+	ImportFormatZip = "zip"
+)
+
+// CSV取り込みジョブ, バックグラウンドで実行される取り込みの進捗と結果を保持する
+type ImportJob struct {
+	gorm.Model
+	// ジョブを登録したユーザー, 本人だけが参照・キャンセルできる
+	UserID     uint   `gorm:"not null;index"`
+	Status     string `gorm:"not null;default:pending"`
+	FileName   string
+	OnConflict string `gorm:"not null;default:fail"`
+	// trueの場合は取り込める行だけを登録する, falseの場合は全ての行を1つのトランザクションで登録する
+	Partial bool `gorm:"not null;default:false"`
+	// ファイルの形式(csv, xlsx, json, jsonl)
+	Format string `gorm:"not null;default:csv"`
+	// アップロードされたファイルの文字コード, 取り込み時にUTF-8に変換する
+	Encoding string
+	// 区切り文字とヘッダー行の位置(1始まりのレコード数, Excelはシートの行番号), 省略された場合はファイルの先頭から判定した値
+	Delimiter string
+	HeaderRow int
+	// Excelの場合に取り込んだシート名
+	Sheet        string
+	TotalRows    int `gorm:"not null;default:0"`
+	InsertedRows int `gorm:"not null;default:0"`
+	UpdatedRows  int `gorm:"not null;default:0"`
+	SkippedRows  int `gorm:"not null;default:0"`
+	FailedRows   int `gorm:"not null;default:0"`
+	StartedAt    *time.Time
+	FinishedAt   *time.Time
+	ErrorSummary string
+	// 取り込んだファイルのヘッダー, エラー行をCSVで出力する際に利用する
+	Header []string `gorm:"serializer:json"`
+	// zipの場合の中のファイルごとの結果
+	Files []ImportJobFile `gorm:"foreignKey:ImportJobID"`
+	// 中断した場合に再開する位置, 部分取り込みの場合だけ記録する
+	Checkpoint *ImportCheckpoint `gorm:"serializer:json"`
+}
+
+// 取り込み中のファイルのうち、先頭から途切れずに登録が確定した位置と、その時点のジョブ全体の件数
+// ワーカーは並行して登録するため、この位置より後ろにも登録済みの行が含まれることがある
+type ImportCheckpoint struct {
+	BatchID      uint
+	Line         int
+	Offset       int64
+	ReadRows     int
+	InsertedRows int
+	UpdatedRows  int
+	SkippedRows  int
+	FailedRows   int
+}
+
+// zipで取り込んだ場合の中のファイル1つ分の進捗と結果
+// ジョブ全体の件数は全てのファイルの合計になる
+type ImportJobFile struct {
+	gorm.Model
+	ImportJobID uint   `gorm:"not null;index"`
+	Status      string `gorm:"not null;default:pending"`
+	// zip内のパス
+	FileName     string
+	Format       string
+	Encoding     string
+	Delimiter    string
+	HeaderRow    int
+	Sheet        string
+	TotalRows    int `gorm:"not null;default:0"`
+	InsertedRows int `gorm:"not null;default:0"`
+	UpdatedRows  int `gorm:"not null;default:0"`
+	SkippedRows  int `gorm:"not null;default:0"`
+	FailedRows   int `gorm:"not null;default:0"`
+	ErrorSummary string
+	Header       []string `gorm:"serializer:json"`
+}
+
+// 取り込めなかった行, 元の行の内容とエラーの理由を保持する
+type ImportRejectedRow struct {
+	gorm.Model
+	ImportJobID uint             `gorm:"not null;index"`
+	Line        int              `gorm:"not null"`
+	Record      []string         `gorm:"serializer:json"`
+	Errors      []ImportRowError `gorm:"serializer:json"`
+	// zipの場合の行を含むファイル(zip内のパス)
+	FileName string
+}
+
+// 行のエラー, どの列がなぜ不正だったかを表す
+type ImportRowError struct {
+	Column string
+	Reason string
+}
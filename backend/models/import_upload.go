@@ -0,0 +1,25 @@
+package models
+
+import "gorm.io/gorm"
+
+// 分割して送信中のアップロード, 全てのデータを受け取った後に取り込みジョブを登録する
+// 通信が途切れた場合は、受け取り済みの位置から続きを送信できる
+type ImportUpload struct {
+	gorm.Model
+	// アップロードしたユーザー, 本人だけが続きを送信・取り込みできる
+	UserID uint `gorm:"not null;index"`
+	// Upload-Metadataで指定されたファイル名とContent-Type, 取り込む形式の判定に利用する
+	FileName    string
+	ContentType string
+	// ファイル全体のバイト数と、受け取り済みのバイト数
+	Length int64 `gorm:"not null"`
+	Offset int64 `gorm:"not null;default:0"`
+	// 受け取ったデータを保存しているファイル, 取り込みの準備が済んだ時点で削除する
+	Path string `json:"-"`
+	// 受け取り済みの内容のSHA-256の途中の状態, 取り込む際にファイル全体を読み直さずにチェックサムを検証する
+	HashState []byte `json:"-"`
+	// 全体の内容のSHA-256(16進数), 取り込みジョブを登録した時点で記録する
+	Sha256 string `gorm:"size:64"`
+	// 登録した取り込みジョブ, 登録後は続きを送信できない
+	ImportJobID *uint
+}
@@ -1,16 +1,223 @@
 package repositories
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
 	"project/models"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/mattn/go-sqlite3"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type ICsvRepository interface {
 	// 引数はmodels.Csv型、戻り値はmodels.Csv型とerror型
-	CreateCsv(csv models.Csv) (models.Csv, error)
+	// ctxがキャンセルされた場合は実行中のクエリを中断する(以降のメソッドも同様)
+	// メールアドレスが他の連絡先と重複した場合はErrDuplicateEmailを返す(UpdateCsvも同様)
+	CreateCsv(ctx context.Context, csv models.Csv) (models.Csv, error)
+	// 複数件をbatchSize件ずつまとめてINSERTする
+	CreateCsvsInBatches(ctx context.Context, csvs []models.Csv, batchSize int) error
+	// PostgreSQLの場合はCOPY FROMで一括登録する, それ以外のDBではCreateCsvsInBatchesで代替する
+	// 論理削除した連絡先とメールアドレスが重複した場合はErrEmailHeldByDeletedCsvを返す
+	CopyCsvs(ctx context.Context, csvs []models.Csv) error
+	// メールアドレスが既存の行と重複した場合にonConflictに従って登録・更新する
+	UpsertCsvs(ctx context.Context, csvs []models.Csv, onConflict string) (CsvUpsertResult, error)
+	// 指定したメールアドレスのうち、userIdのユーザーが既に登録しているものを返す
+	FindExistingEmails(ctx context.Context, userId uint, emails []string) ([]string, error)
+	// 条件に一致する連絡先をID順に1件ずつfnに渡す, 全件をメモリに載せないようにカーソルで読み込む
+	// fnがエラーを返した場合はその時点で読み込みを中断する
+	FindCsvsEach(ctx context.Context, filter CsvFilter, fn func(csv models.Csv) error) error
+	// 条件に一致する連絡先を1ページ分取得する
+	FindCsvs(ctx context.Context, query CsvQuery) ([]models.Csv, error)
+	// 条件に一致する連絡先の件数, query.Limit・Offset・Afterは無視する
+	CountCsvs(ctx context.Context, query CsvQuery) (int64, error)
+	// IDで取得, 他のユーザーの連絡先は見つからないものとして扱う(以降のメソッドも同様)
+	FindCsvById(ctx context.Context, csvId uint, userId uint) (*models.Csv, error)
+	// 全ての列を更新する
+	UpdateCsv(ctx context.Context, csv models.Csv) (*models.Csv, error)
+	// 論理削除する
+	DeleteCsv(ctx context.Context, csvId uint, userId uint) error
+	// 論理削除した連絡先を元に戻す
+	RestoreCsv(ctx context.Context, csvId uint, userId uint) (*models.Csv, error)
+	// 論理削除した連絡先をDBから削除する
+	PurgeCsv(ctx context.Context, csvId uint, userId uint) error
+	// 取り込みを取り消した場合に削除・復元する行を数え、先頭のlimit件ずつを返す
+	PlanBatchRollback(ctx context.Context, batchId uint, userId uint, hard bool, limit int) (CsvRollbackResult, error)
+	// 取り込みで登録した行を削除し、上書きした行を取り込み前の値に戻す
+	// hardの場合は登録した行をDBから削除し、それ以外は論理削除する
+	// 同じトランザクションで取り込みの記録に取り消しの日時を記録し、既に取り消されていた場合は何もせずにErrBatchRolledBackを返す
+	RollbackBatch(ctx context.Context, batchId uint, userId uint, hard bool) (CsvRollbackResult, error)
+	// 取り込みでafterLine行目より後ろの行から登録・更新した連絡先の行番号と、既存の連絡先を更新したかどうかを返す
+	FindImportedLines(ctx context.Context, batchId uint, afterLine int) (map[int]bool, error)
+	// fnに渡すリポジトリの操作を1つのトランザクションで実行する, fnがエラーを返した場合はロールバックする
+	// トランザクション内の登録はそれぞれセーブポイントで囲むため、失敗した登録だけを取り消して続行できる
+	Transaction(ctx context.Context, fn func(repository ICsvRepository) error) error
+	// トランザクションの書き込み中にDB全体がロックされるかどうか(sqliteの場合)
+	// trueの場合、長いトランザクションの間は他の書き込みが待たされるため、大量の行を1つのトランザクションで登録しない
+	LocksDatabaseOnWrite() bool
+}
+
+// 既に取り消した取り込みを取り消そうとした場合のエラー
+var ErrBatchRolledBack = errors.New("import batch is already rolled back")
+
+// 登録・更新しようとしたメールアドレスを同じユーザーの他の連絡先が使っている場合のエラー
+var ErrDuplicateEmail = errors.New("email is already registered")
+
+// 論理削除した連絡先もメールアドレスのユニーク制約の対象になるため、そのメールアドレスで登録できない場合のエラー
+var ErrEmailHeldByDeletedCsv = errors.New("email is held by a deleted contact; restore or purge it, or import with on_conflict=overwrite")
+
+// UpsertCsvsで登録・更新・スキップした件数
+type CsvUpsertResult struct {
+	Inserted int
+	Updated  int
+	Skipped  int
+}
+
+// 取り込みの取り消しで削除・復元する(した)件数
+// 後の取り込みで更新された行は後の取り込みの値を優先し、Supersededとして数える
+type CsvRollbackResult struct {
+	Deleted    int64
+	Restored   int64
+	Superseded int64
+	// PlanBatchRollbackの場合の、削除する行と復元する行
+	DeleteSamples  []models.Csv
+	RestoreSamples []CsvRestoreSample
+	// RollbackBatchの場合の、取り込みの記録に記録した取り消しの日時
+	RolledBackAt time.Time
+}
+
+// 復元する行の現在の値と取り込み前の値
+type CsvRestoreSample struct {
+	Current  models.Csv
+	Previous models.Csv
+}
+
+// 連絡先を検索する条件, 空の条件は絞り込まない
+// 所有者のユーザーは常に絞り込む
+type CsvFilter struct {
+	UserID      uint
+	FirstName   string
+	LastName    string
+	Email       string
+	PhoneNumber string
+	Address     string
+	City        string
+	State       string
+	ZipCode     string
+	Country     string
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	// 0の場合は絞り込まない
+	ImportBatchID uint
+}
+
+// 条件をクエリに適用する
+func (f CsvFilter) apply(db *gorm.DB) *gorm.DB {
+	db = db.Where("user_id = ?", f.UserID)
+	equals := []struct {
+		column string
+		value  string
+	}{
+		{"first_name", f.FirstName},
+		{"last_name", f.LastName},
+		{"email", f.Email},
+		{"phone_number", f.PhoneNumber},
+		{"address", f.Address},
+		{"city", f.City},
+		{"state", f.State},
+		{"zip_code", f.ZipCode},
+		{"country", f.Country},
+	}
+	for _, equal := range equals {
+		if equal.value != "" {
+			db = db.Where(equal.column+" = ?", equal.value)
+		}
+	}
+	if f.ImportBatchID != 0 {
+		db = db.Where("import_batch_id = ?", f.ImportBatchID)
+	}
+	if f.CreatedFrom != nil {
+		db = db.Where("created_at >= ?", *f.CreatedFrom)
+	}
+	if f.CreatedTo != nil {
+		db = db.Where("created_at < ?", *f.CreatedTo)
+	}
+	return db
+}
+
+// 連絡先の一覧の取得条件
+type CsvQuery struct {
+	Filter CsvFilter
+	// 名・姓・メールアドレスのいずれかに含まれる文字列, Prefixの場合は前方一致
+	Search string
+	Prefix bool
+	// 並び順の列, 同じ値の行はidで並べる
+	Sort string
+	Desc bool
+	// Afterが指定された場合は、その行より後ろの行を返す(カーソル方式)
+	Limit  int
+	Offset int
+	After  *CsvCursor
+	// trueの場合は論理削除した連絡先だけを対象にする
+	Deleted bool
 }
 
+// カーソル方式で前のページの最後の行を表す, Valueは並び順の列の値
+type CsvCursor struct {
+	Value any
+	ID    uint
+}
+
+// 並び替えに使える列
+var csvSortColumns = map[string]bool{
+	"id": true, "first_name": true, "last_name": true, "email": true, "phone_number": true, "address": true,
+	"city": true, "state": true, "zip_code": true, "country": true, "created_at": true, "updated_at": true,
+}
+
+// 絞り込みと検索の条件をクエリに適用する
+func (q CsvQuery) apply(db *gorm.DB) *gorm.DB {
+	if q.Deleted {
+		db = db.Unscoped().Where("deleted_at IS NOT NULL")
+	}
+	db = q.Filter.apply(db)
+	if q.Search == "" {
+		return db
+	}
+	// LIKEの特殊文字はエスケープし、大文字小文字を区別しないよう両辺を小文字にして比較する
+	pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(q.Search)) + "%"
+	if !q.Prefix {
+		pattern = "%" + pattern
+	}
+	return db.Where(
+		`LOWER(first_name) LIKE ? ESCAPE '\' OR LOWER(last_name) LIKE ? ESCAPE '\' OR LOWER(email) LIKE ? ESCAPE '\'`,
+		pattern, pattern, pattern,
+	)
+}
+
+// COPY FROMで登録するカラム(idはDBの連番に任せる)
+var csvCopyColumns = []string{
+	"created_at", "updated_at", "first_name", "last_name", "email",
+	"phone_number", "address", "city", "state", "zip_code", "country", "user_id",
+	"import_batch_id", "source_line",
+}
+
+// 重複時に上書き・マージするカラム
+var csvUpsertColumns = []string{
+	"first_name", "last_name", "phone_number", "address", "city", "state", "zip_code", "country",
+}
+
+// 重複時に取り込んだ行の値で置き換える、取り込み元のカラム
+var csvLineageColumns = []string{"import_batch_id", "source_line"}
+
 /*
 * 単一責任の原則に従い、CsvRepository 構造体はデータベース操作のロジックを持つにとどめる
  */
@@ -30,7 +237,577 @@ func NewCsvRepository(db *gorm.DB) ICsvRepository {
 * メソッド内で、引数で受け取ったmodels.Csv型の値をデータベースに保存する
 * rはレシーバーとして構造体のポインタを受け取る
  */
-func (r *CsvRepository) CreateCsv(csv models.Csv) (models.Csv, error) {
-	err := r.db.Create(&csv).Error
+func (r *CsvRepository) CreateCsv(ctx context.Context, csv models.Csv) (models.Csv, error) {
+	err := r.db.WithContext(ctx).Create(&csv).Error
+	if isDuplicateKey(err) {
+		return csv, ErrDuplicateEmail
+	}
 	return csv, err
 }
+
+/*
+* 1回のINSERT文で複数行を登録し、DBとの往復回数を減らす
+ */
+func (r *CsvRepository) CreateCsvsInBatches(ctx context.Context, csvs []models.Csv, batchSize int) error {
+	if len(csvs) == 0 {
+		return nil
+	}
+	// トランザクション内で呼ばれた場合はセーブポイントになる
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return tx.CreateInBatches(&csvs, batchSize).Error
+	})
+}
+
+/*
+* PostgreSQLのCOPY FROMでまとめて登録する
+* COPYはGORMを経由しないため、pgxのコネクションを直接取り出して実行する
+* トランザクション内ではコネクションを取り出せないため、CreateCsvsInBatchesで代替する
+ */
+func (r *CsvRepository) CopyCsvs(ctx context.Context, csvs []models.Csv) error {
+	if len(csvs) == 0 {
+		return nil
+	}
+	var err error
+	if r.db.Dialector.Name() != "postgres" || r.inTransaction() {
+		err = r.CreateCsvsInBatches(ctx, csvs, len(csvs))
+	} else {
+		err = r.copyCsvs(ctx, csvs)
+	}
+	if err != nil && isDuplicateKey(err) {
+		return r.deletedEmailError(ctx, csvs, err)
+	}
+	return err
+}
+
+func (r *CsvRepository) copyCsvs(ctx context.Context, csvs []models.Csv) error {
+	sqlDB, err := r.db.DB()
+	if err != nil {
+		return err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return copyCsvs(ctx, conn, csvs)
+}
+
+// 一意制約に違反したエラーかどうか
+func isDuplicateKey(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+	// 23505はpostgresのunique_violation
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+/*
+* 重複したメールアドレスが論理削除した連絡先のものだった場合は、原因がわかるエラーに置き換える
+* それ以外の場合はerrをそのまま返す
+ */
+func (r *CsvRepository) deletedEmailError(ctx context.Context, csvs []models.Csv, err error) error {
+	emails := make([]string, len(csvs))
+	for i, csv := range csvs {
+		emails[i] = csv.Email
+	}
+	var deleted []string
+	findErr := r.db.WithContext(ctx).Unscoped().Model(&models.Csv{}).
+		Where("user_id = ? AND email IN ? AND deleted_at IS NOT NULL", csvs[0].UserID, emails).
+		Order("email").
+		Pluck("email", &deleted).Error
+	if findErr != nil || len(deleted) == 0 {
+		return err
+	}
+	return fmt.Errorf("%w: %s", ErrEmailHeldByDeletedCsv, strings.Join(deleted, ", "))
+}
+
+// database/sqlのコネクションからpgxのコネクションを取り出してCOPY FROMを実行する
+func copyCsvs(ctx context.Context, conn *sql.Conn, csvs []models.Csv) error {
+	now := time.Now()
+	return conn.Raw(func(driverConn any) error {
+		stdlibConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return errors.New("copy is only supported with pgx connections")
+		}
+		_, err := stdlibConn.Conn().CopyFrom(
+			ctx,
+			pgx.Identifier{"csvs"},
+			csvCopyColumns,
+			pgx.CopyFromSlice(len(csvs), func(i int) ([]any, error) {
+				c := csvs[i]
+				return []any{
+					now, now, c.FirstName, c.LastName, c.Email,
+					c.PhoneNumber, c.Address, c.City, c.State, c.ZipCode, c.Country, c.UserID,
+					c.ImportBatchID, c.SourceLine,
+				}, nil
+			}),
+		)
+		return err
+	})
+}
+
+/*
+* ON CONFLICT (user_id, email)でまとめて登録する
+* 登録前に既存の行を検索し、新規登録と更新(スキップ)の件数を数える
+* 取り込みで上書き・マージする場合は、取り消せるように既存の行の値を保存する
+* csvsは全て同じユーザー・同じ取り込みの行で、同じメールアドレスが複数含まれていないことを前提とする
+* 同じ取り込みの別の呼び出しに同じメールアドレスが含まれる場合に、ファイル内の順番どおりに呼び出すのは呼び出し側の責務とする
+ */
+func (r *CsvRepository) UpsertCsvs(ctx context.Context, csvs []models.Csv, onConflict string) (CsvUpsertResult, error) {
+	var result CsvUpsertResult
+	if len(csvs) == 0 {
+		return result, nil
+	}
+
+	emails := make([]string, len(csvs))
+	for i, csv := range csvs {
+		emails[i] = csv.Email
+	}
+
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := lockCsvEmails(tx, csvs[0].UserID, emails); err != nil {
+			return err
+		}
+		// 論理削除された行もユニーク制約の対象になるためUnscopedで検索する
+		query := tx.Unscoped().Where("user_id = ? AND email IN ?", csvs[0].UserID, emails).Order("id")
+		if tx.Dialector.Name() == "postgres" {
+			query = query.Clauses(clause.Locking{Strength: "UPDATE"})
+		}
+		var existing []models.Csv
+		if err := query.Find(&existing).Error; err != nil {
+			return err
+		}
+		if onConflict != models.OnConflictSkip && csvs[0].ImportBatchID != nil {
+			if err := createSnapshots(tx, *csvs[0].ImportBatchID, existing); err != nil {
+				return err
+			}
+		}
+
+		onConflictClause, err := csvOnConflictClause(onConflict)
+		if err != nil {
+			return err
+		}
+		if err := tx.Clauses(onConflictClause).Create(&csvs).Error; err != nil {
+			return err
+		}
+
+		result.Inserted = len(csvs) - len(existing)
+		if onConflict == models.OnConflictSkip {
+			result.Skipped = len(existing)
+		} else {
+			result.Updated = len(existing)
+		}
+		return nil
+	})
+	if err != nil {
+		return CsvUpsertResult{}, err
+	}
+	return result, nil
+}
+
+/*
+* 登録するメールアドレスごとに、トランザクションの終了まで保持するロックを取得する
+* 既存の行の検索から登録までの間に、同じメールアドレスを他のトランザクションが登録して件数やスナップショットがずれるのを防ぐ
+* まだ存在しない行はFOR UPDATEでロックできないため、postgresではアドバイザリロックを利用する
+* sqliteは書き込むトランザクションを開始した時点で他の書き込みを待たせるため何もしない
+ */
+func lockCsvEmails(tx *gorm.DB, userId uint, emails []string) error {
+	if tx.Dialector.Name() != "postgres" {
+		return nil
+	}
+	keys := make([]string, len(emails))
+	for i, email := range emails {
+		keys[i] = fmt.Sprintf("%d:%s", userId, email)
+	}
+	// ロックを取得する順序を揃えてデッドロックを防ぐ
+	sort.Strings(keys)
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		values[i] = key
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("(?),", len(keys)), ",")
+	return tx.Exec("SELECT pg_advisory_xact_lock(hashtextextended(key, 0)) FROM (VALUES "+placeholders+") AS keys(key) ORDER BY key", values...).Error
+}
+
+// 取り込みで更新する前の行の値を保存する
+// 同じ取り込みで登録した行や、既に保存した行は取り込み前の値ではないため保存しない
+func createSnapshots(tx *gorm.DB, batchId uint, existing []models.Csv) error {
+	snapshots := make([]models.CsvSnapshot, 0, len(existing))
+	for _, csv := range existing {
+		if csv.ImportBatchID != nil && *csv.ImportBatchID == batchId {
+			continue
+		}
+		snapshots = append(snapshots, models.CsvSnapshot{ImportBatchID: batchId, CsvID: csv.ID, Previous: csv})
+	}
+	if len(snapshots) == 0 {
+		return nil
+	}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&snapshots).Error
+}
+
+// 重複時の扱いに応じたON CONFLICT句を作成する
+func csvOnConflictClause(onConflict string) (clause.OnConflict, error) {
+	columns := []clause.Column{{Name: "user_id"}, {Name: "email"}}
+	switch onConflict {
+	case models.OnConflictSkip:
+		return clause.OnConflict{Columns: columns, DoNothing: true}, nil
+	case models.OnConflictOverwrite:
+		// 論理削除されていた行は上書きした時点で復元する
+		set := clause.AssignmentColumns(append(append(append([]string{}, csvUpsertColumns...), csvLineageColumns...), "updated_at"))
+		set = append(set, clause.Assignment{Column: clause.Column{Name: "deleted_at"}, Value: nil})
+		return clause.OnConflict{Columns: columns, DoUpdates: set}, nil
+	case models.OnConflictMerge:
+		// 取り込んだ値が空の列は既存の値を残す
+		set := clause.AssignmentColumns(append([]string{"updated_at"}, csvLineageColumns...))
+		for _, column := range csvUpsertColumns {
+			set = append(set, clause.Assignment{
+				Column: clause.Column{Name: column},
+				Value:  gorm.Expr(fmt.Sprintf("CASE WHEN excluded.%[1]s <> '' THEN excluded.%[1]s ELSE csvs.%[1]s END", column)),
+			})
+		}
+		set = append(set, clause.Assignment{Column: clause.Column{Name: "deleted_at"}, Value: nil})
+		return clause.OnConflict{Columns: columns, DoUpdates: set}, nil
+	default:
+		return clause.OnConflict{}, fmt.Errorf("unsupported conflict mode: %s", onConflict)
+	}
+}
+
+/*
+* 論理削除された行もユニーク制約の対象になるためUnscopedで検索する
+ */
+func (r *CsvRepository) FindExistingEmails(ctx context.Context, userId uint, emails []string) ([]string, error) {
+	var existing []string
+	if len(emails) == 0 {
+		return existing, nil
+	}
+	err := r.db.WithContext(ctx).Unscoped().Model(&models.Csv{}).Where("user_id = ? AND email IN ?", userId, emails).Pluck("email", &existing).Error
+	return existing, err
+}
+
+/*
+* Rowsで1行ずつ読み込むため、件数が多くてもメモリ使用量は一定になる
+ */
+func (r *CsvRepository) FindCsvsEach(ctx context.Context, filter CsvFilter, fn func(csv models.Csv) error) error {
+	db := filter.apply(r.db.WithContext(ctx).Model(&models.Csv{})).Order("id")
+	rows, err := db.Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var csv models.Csv
+		if err := db.ScanRows(rows, &csv); err != nil {
+			return err
+		}
+		if err := fn(csv); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+/*
+* 並び順の列とidで並べ、カーソル方式の場合は前のページの最後の行より後ろの行を取得する
+ */
+func (r *CsvRepository) FindCsvs(ctx context.Context, query CsvQuery) ([]models.Csv, error) {
+	if !csvSortColumns[query.Sort] {
+		return nil, fmt.Errorf("unsupported sort column: %s", query.Sort)
+	}
+	direction, operator := "ASC", ">"
+	if query.Desc {
+		direction, operator = "DESC", "<"
+	}
+
+	db := query.apply(r.db.WithContext(ctx).Model(&models.Csv{}))
+	if query.After != nil {
+		if query.Sort == "id" {
+			db = db.Where("id "+operator+" ?", query.After.ID)
+		} else {
+			db = db.Where(
+				fmt.Sprintf("%[1]s %[2]s ? OR (%[1]s = ? AND id %[2]s ?)", query.Sort, operator),
+				query.After.Value, query.After.Value, query.After.ID,
+			)
+		}
+	}
+	if query.Sort != "id" {
+		db = db.Order(query.Sort + " " + direction)
+	}
+	db = db.Order("id " + direction)
+
+	var csvs []models.Csv
+	err := db.Offset(query.Offset).Limit(query.Limit).Find(&csvs).Error
+	return csvs, err
+}
+
+func (r *CsvRepository) CountCsvs(ctx context.Context, query CsvQuery) (int64, error) {
+	var count int64
+	err := query.apply(r.db.WithContext(ctx).Model(&models.Csv{})).Count(&count).Error
+	return count, err
+}
+
+func (r *CsvRepository) FindCsvById(ctx context.Context, csvId uint, userId uint) (*models.Csv, error) {
+	var csv models.Csv
+	result := r.db.WithContext(ctx).Where("user_id = ?", userId).First(&csv, csvId)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, errors.New("csv not found")
+		}
+		return nil, result.Error
+	}
+	return &csv, nil
+}
+
+func (r *CsvRepository) UpdateCsv(ctx context.Context, csv models.Csv) (*models.Csv, error) {
+	if err := r.db.WithContext(ctx).Save(&csv).Error; err != nil {
+		if isDuplicateKey(err) {
+			return nil, ErrDuplicateEmail
+		}
+		return nil, err
+	}
+	return &csv, nil
+}
+
+func (r *CsvRepository) DeleteCsv(ctx context.Context, csvId uint, userId uint) error {
+	result := r.db.WithContext(ctx).Where("user_id = ?", userId).Delete(&models.Csv{}, csvId)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("csv not found")
+	}
+	return nil
+}
+
+/*
+* 論理削除されていない連絡先の場合はエラーを返す
+ */
+func (r *CsvRepository) RestoreCsv(ctx context.Context, csvId uint, userId uint) (*models.Csv, error) {
+	csv, err := r.findDeletedCsv(ctx, csvId, userId)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.db.WithContext(ctx).Unscoped().Model(csv).Update("deleted_at", nil).Error; err != nil {
+		return nil, err
+	}
+	csv.DeletedAt = gorm.DeletedAt{}
+	return csv, nil
+}
+
+/*
+* 誤って削除しないよう、論理削除された連絡先だけを削除できる
+ */
+func (r *CsvRepository) PurgeCsv(ctx context.Context, csvId uint, userId uint) error {
+	csv, err := r.findDeletedCsv(ctx, csvId, userId)
+	if err != nil {
+		return err
+	}
+	return r.db.WithContext(ctx).Unscoped().Delete(csv).Error
+}
+
+// 論理削除された連絡先をIDで取得する
+func (r *CsvRepository) findDeletedCsv(ctx context.Context, csvId uint, userId uint) (*models.Csv, error) {
+	var csv models.Csv
+	result := r.db.WithContext(ctx).Unscoped().Where("user_id = ?", userId).First(&csv, csvId)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, errors.New("csv not found")
+		}
+		return nil, result.Error
+	}
+	if !csv.DeletedAt.Valid {
+		return nil, errors.New("csv is not deleted")
+	}
+	return &csv, nil
+}
+
+/*
+* トランザクションに紐づいたCsvRepositoryをfnに渡す
+ */
+func (r *CsvRepository) Transaction(ctx context.Context, fn func(repository ICsvRepository) error) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(&CsvRepository{db: tx})
+	})
+}
+
+func (r *CsvRepository) LocksDatabaseOnWrite() bool {
+	return r.db.Dialector.Name() == "sqlite"
+}
+
+// トランザクション内のリポジトリかどうか
+func (r *CsvRepository) inTransaction() bool {
+	_, ok := r.db.Statement.ConnPool.(gorm.TxCommitter)
+	return ok
+}
+
+// 取り消しで1回に復元する行数
+const rollbackBatchSize = 500
+
+/*
+* 取り込みで登録した行は、最後に更新した取り込みがbatchIdで、取り込み前の値が保存されていない行になる
+ */
+func batchCreatedCsvs(db *gorm.DB, batchId uint, userId uint, hard bool) *gorm.DB {
+	db = db.Model(&models.Csv{})
+	if hard {
+		db = db.Unscoped()
+	}
+	return db.Where("user_id = ? AND import_batch_id = ?", userId, batchId).
+		Where("NOT EXISTS (SELECT 1 FROM csv_snapshots WHERE csv_snapshots.import_batch_id = ? AND csv_snapshots.csv_id = csvs.id)", batchId)
+}
+
+/*
+* 取り込み前の値を保存した行のうち、その後に他の取り込みで更新されていない行
+* 行を取得する場合は連絡先の列と混ざらないようSelect("csv_snapshots.*")を指定する
+ */
+func batchRestorableSnapshots(db *gorm.DB, batchId uint, userId uint) *gorm.DB {
+	return db.Model(&models.CsvSnapshot{}).
+		Joins("JOIN csvs ON csvs.id = csv_snapshots.csv_id").
+		Where("csv_snapshots.import_batch_id = ? AND csvs.import_batch_id = ? AND csvs.user_id = ?", batchId, batchId, userId)
+}
+
+func (r *CsvRepository) PlanBatchRollback(ctx context.Context, batchId uint, userId uint, hard bool, limit int) (CsvRollbackResult, error) {
+	var result CsvRollbackResult
+	db := r.db.WithContext(ctx)
+	if err := batchCreatedCsvs(db, batchId, userId, hard).Count(&result.Deleted).Error; err != nil {
+		return result, err
+	}
+	if err := batchCreatedCsvs(db, batchId, userId, hard).Order("id").Limit(limit).Find(&result.DeleteSamples).Error; err != nil {
+		return result, err
+	}
+	if err := batchRestorableSnapshots(db, batchId, userId).Count(&result.Restored).Error; err != nil {
+		return result, err
+	}
+	var snapshots []models.CsvSnapshot
+	if err := batchRestorableSnapshots(db, batchId, userId).Select("csv_snapshots.*").Order("csv_snapshots.id").Limit(limit).Find(&snapshots).Error; err != nil {
+		return result, err
+	}
+	if len(snapshots) > 0 {
+		ids := make([]uint, len(snapshots))
+		for i, snapshot := range snapshots {
+			ids[i] = snapshot.CsvID
+		}
+		// 取り込みの後に論理削除された行も復元の対象になるためUnscopedで検索する
+		var currents []models.Csv
+		if err := db.Unscoped().Where("id IN ?", ids).Find(&currents).Error; err != nil {
+			return result, err
+		}
+		byId := make(map[uint]models.Csv, len(currents))
+		for _, csv := range currents {
+			byId[csv.ID] = csv
+		}
+		for _, snapshot := range snapshots {
+			result.RestoreSamples = append(result.RestoreSamples, CsvRestoreSample{Current: byId[snapshot.CsvID], Previous: snapshot.Previous})
+		}
+	}
+	var total int64
+	if err := db.Model(&models.CsvSnapshot{}).Where("import_batch_id = ?", batchId).Count(&total).Error; err != nil {
+		return result, err
+	}
+	result.Superseded = total - result.Restored
+	return result, nil
+}
+
+/*
+* 上書きした行を戻してから登録した行を削除し、最後に取り込み前の値を削除する
+* 件数が多くてもメモリに載せないよう、上書きした行はrollbackBatchSize件ずつ戻す
+ */
+func (r *CsvRepository) RollbackBatch(ctx context.Context, batchId uint, userId uint, hard bool) (CsvRollbackResult, error) {
+	var result CsvRollbackResult
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// 先に取り消しの日時を記録し、同時に取り消された場合も1回だけ復元する
+		result.RolledBackAt = time.Now()
+		marked := tx.Model(&models.ImportBatch{}).
+			Where("id = ? AND user_id = ? AND rolled_back_at IS NULL", batchId, userId).
+			Update("rolled_back_at", result.RolledBackAt)
+		if marked.Error != nil {
+			return marked.Error
+		}
+		if marked.RowsAffected == 0 {
+			return ErrBatchRolledBack
+		}
+
+		var snapshots int64
+		if err := tx.Model(&models.CsvSnapshot{}).Where("import_batch_id = ?", batchId).Count(&snapshots).Error; err != nil {
+			return err
+		}
+
+		var lastId uint
+		for {
+			var batch []models.CsvSnapshot
+			err := batchRestorableSnapshots(tx, batchId, userId).
+				Select("csv_snapshots.*").
+				Where("csv_snapshots.id > ?", lastId).
+				Order("csv_snapshots.id").
+				Limit(rollbackBatchSize).
+				Find(&batch).Error
+			if err != nil {
+				return err
+			}
+			for _, snapshot := range batch {
+				if err := restoreSnapshot(tx, snapshot); err != nil {
+					return err
+				}
+			}
+			result.Restored += int64(len(batch))
+			if len(batch) < rollbackBatchSize {
+				break
+			}
+			lastId = batch[len(batch)-1].ID
+		}
+		result.Superseded = snapshots - result.Restored
+
+		deleted := batchCreatedCsvs(tx, batchId, userId, hard).Delete(&models.Csv{})
+		if deleted.Error != nil {
+			return deleted.Error
+		}
+		result.Deleted = deleted.RowsAffected
+
+		return tx.Unscoped().Where("import_batch_id = ?", batchId).Delete(&models.CsvSnapshot{}).Error
+	})
+	if err != nil {
+		return CsvRollbackResult{}, err
+	}
+	return result, nil
+}
+
+// 取り込み前の値に戻す, 取り込みで論理削除を解除した行は論理削除された状態に戻る
+func restoreSnapshot(tx *gorm.DB, snapshot models.CsvSnapshot) error {
+	previous := snapshot.Previous
+	return tx.Unscoped().Model(&models.Csv{}).Where("id = ?", snapshot.CsvID).Updates(map[string]any{
+		"first_name":      previous.FirstName,
+		"last_name":       previous.LastName,
+		"phone_number":    previous.PhoneNumber,
+		"address":         previous.Address,
+		"city":            previous.City,
+		"state":           previous.State,
+		"zip_code":        previous.ZipCode,
+		"country":         previous.Country,
+		"import_batch_id": previous.ImportBatchID,
+		"source_line":     previous.SourceLine,
+		"deleted_at":      previous.DeletedAt,
+	}).Error
+}
+
+// 取り込み前の値を保存した行は既存の連絡先を更新した行になる
+// 取り込み後に論理削除された行も登録済みとして扱う
+func (r *CsvRepository) FindImportedLines(ctx context.Context, batchId uint, afterLine int) (map[int]bool, error) {
+	var rows []struct {
+		SourceLine int
+		Updated    bool
+	}
+	err := r.db.WithContext(ctx).Unscoped().Model(&models.Csv{}).
+		Select("source_line, EXISTS (SELECT 1 FROM csv_snapshots WHERE csv_snapshots.import_batch_id = csvs.import_batch_id AND csv_snapshots.csv_id = csvs.id) AS updated").
+		Where("import_batch_id = ? AND source_line > ?", batchId, afterLine).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	lines := make(map[int]bool, len(rows))
+	for _, row := range rows {
+		lines[row.SourceLine] = row.Updated
+	}
+	return lines, nil
+}
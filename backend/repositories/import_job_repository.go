@@ -0,0 +1,273 @@
+package repositories
+
+import (
+	"errors"
+	"time"
+
+	"project/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type IImportJobRepository interface {
+	Create(job models.ImportJob) (*models.ImportJob, error)
+	// userIdのユーザーが登録したジョブだけを返す
+	FindAll(userId uint) (*[]models.ImportJob, error)
+	FindById(jobId uint, userId uint) (*models.ImportJob, error)
+	Update(job models.ImportJob) (*models.ImportJob, error)
+	// zipの中のファイルごとの結果を登録・更新する
+	CreateFiles(jobId uint, files []models.ImportJobFile) ([]models.ImportJobFile, error)
+	UpdateFile(file models.ImportJobFile) (*models.ImportJobFile, error)
+	CreateRejectedRows(jobId uint, rows []models.ImportRejectedRow) error
+	FindRejectedRows(jobId uint) (*[]models.ImportRejectedRow, error)
+	// 取り込んだファイルの記録を登録・更新する
+	CreateBatches(jobId uint, batches []models.ImportBatch) ([]models.ImportBatch, error)
+	UpdateBatch(batch models.ImportBatch) (*models.ImportBatch, error)
+	// userIdのユーザーがアップロードしたファイルの記録だけを返す
+	FindAllBatches(userId uint) (*[]models.ImportBatch, error)
+	FindBatchById(batchId uint, userId uint) (*models.ImportBatch, error)
+	// ジョブで取り込むファイルの記録を登録順に返す
+	FindBatches(jobId uint) ([]models.ImportBatch, error)
+	// 中断したジョブを再開待ちにする, 既に他のリクエストで再開された場合はfalseを返す
+	MarkResumed(jobId uint) (bool, error)
+	// 実行中のまま残っているジョブとzip内のファイルを中断したものとして記録する
+	MarkInterrupted(summary string) (int64, error)
+	// 分割して送信中のアップロードを登録・取得・更新する, 他のユーザーのアップロードは見つからないものとして扱う
+	CreateUpload(upload models.ImportUpload) (*models.ImportUpload, error)
+	FindUploadById(uploadId uint, userId uint) (*models.ImportUpload, error)
+	UpdateUpload(upload models.ImportUpload) (*models.ImportUpload, error)
+	// before以降に送信されていない、取り込みジョブを登録していないアップロードを返す
+	FindExpiredUploads(before time.Time) ([]models.ImportUpload, error)
+	DeleteUpload(uploadId uint) error
+}
+
+type ImportJobRepository struct {
+	db *gorm.DB
+}
+
+func NewImportJobRepository(db *gorm.DB) IImportJobRepository {
+	return &ImportJobRepository{db: db}
+}
+
+// 作成
+func (r *ImportJobRepository) Create(job models.ImportJob) (*models.ImportJob, error) {
+	result := r.db.Create(&job)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &job, nil
+}
+
+// 全件取得, 新しいジョブから順に返す
+func (r *ImportJobRepository) FindAll(userId uint) (*[]models.ImportJob, error) {
+	var jobs []models.ImportJob
+	result := r.db.Preload("Files", orderFiles).Where("user_id = ?", userId).Order("id DESC").Find(&jobs)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &jobs, nil
+}
+
+// IDで取得, 他のユーザーのジョブは見つからないものとして扱う
+func (r *ImportJobRepository) FindById(jobId uint, userId uint) (*models.ImportJob, error) {
+	var job models.ImportJob
+	result := r.db.Preload("Files", orderFiles).Where("user_id = ?", userId).First(&job, jobId)
+	if result.Error != nil {
+		if result.Error.Error() == "record not found" {
+			return nil, errors.New("import job not found")
+		}
+		return nil, result.Error
+	}
+	return &job, nil
+}
+
+// zip内のファイルはzip内の順番(登録順)で返す
+func orderFiles(db *gorm.DB) *gorm.DB {
+	return db.Order("id")
+}
+
+// 更新, zip内のファイルの結果はUpdateFileで個別に更新するため保存しない
+func (r *ImportJobRepository) Update(job models.ImportJob) (*models.ImportJob, error) {
+	result := r.db.Omit(clause.Associations).Save(&job)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &job, nil
+}
+
+// zip内のファイルをまとめて登録
+func (r *ImportJobRepository) CreateFiles(jobId uint, files []models.ImportJobFile) ([]models.ImportJobFile, error) {
+	if len(files) == 0 {
+		return files, nil
+	}
+	for i := range files {
+		files[i].ImportJobID = jobId
+	}
+	if err := r.db.Create(&files).Error; err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// zip内のファイルの結果を更新
+func (r *ImportJobRepository) UpdateFile(file models.ImportJobFile) (*models.ImportJobFile, error) {
+	result := r.db.Save(&file)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &file, nil
+}
+
+// ジョブのエラー行をまとめて登録
+func (r *ImportJobRepository) CreateRejectedRows(jobId uint, rows []models.ImportRejectedRow) error {
+	for i := range rows {
+		rows[i].ImportJobID = jobId
+	}
+	return r.db.CreateInBatches(&rows, 500).Error
+}
+
+// ジョブのエラー行を行番号順に取得
+func (r *ImportJobRepository) FindRejectedRows(jobId uint) (*[]models.ImportRejectedRow, error) {
+	var rows []models.ImportRejectedRow
+	result := r.db.Where("import_job_id = ?", jobId).Order("line").Find(&rows)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &rows, nil
+}
+
+// 取り込むファイルの記録をまとめて登録
+func (r *ImportJobRepository) CreateBatches(jobId uint, batches []models.ImportBatch) ([]models.ImportBatch, error) {
+	if len(batches) == 0 {
+		return batches, nil
+	}
+	for i := range batches {
+		batches[i].ImportJobID = jobId
+	}
+	if err := r.db.Create(&batches).Error; err != nil {
+		return nil, err
+	}
+	return batches, nil
+}
+
+// 取り込んだファイルの記録を更新
+func (r *ImportJobRepository) UpdateBatch(batch models.ImportBatch) (*models.ImportBatch, error) {
+	result := r.db.Save(&batch)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &batch, nil
+}
+
+// 取り込んだファイルの記録を新しい順に全件取得
+func (r *ImportJobRepository) FindAllBatches(userId uint) (*[]models.ImportBatch, error) {
+	var batches []models.ImportBatch
+	result := r.db.Where("user_id = ?", userId).Order("id DESC").Find(&batches)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &batches, nil
+}
+
+// IDで取り込んだファイルの記録を取得, 他のユーザーの記録は見つからないものとして扱う
+func (r *ImportJobRepository) FindBatchById(batchId uint, userId uint) (*models.ImportBatch, error) {
+	var batch models.ImportBatch
+	result := r.db.Where("user_id = ?", userId).First(&batch, batchId)
+	if result.Error != nil {
+		if result.Error.Error() == "record not found" {
+			return nil, errors.New("import batch not found")
+		}
+		return nil, result.Error
+	}
+	return &batch, nil
+}
+
+// ジョブで取り込むファイルの記録を登録順に取得
+func (r *ImportJobRepository) FindBatches(jobId uint) ([]models.ImportBatch, error) {
+	var batches []models.ImportBatch
+	result := r.db.Where("import_job_id = ?", jobId).Order("id").Find(&batches)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return batches, nil
+}
+
+// 中断したジョブを再開待ちにする, 同時に再開されても1回だけ実行されるようステータスを条件に更新する
+func (r *ImportJobRepository) MarkResumed(jobId uint) (bool, error) {
+	result := r.db.Model(&models.ImportJob{}).
+		Where("id = ? AND status = ?", jobId, models.ImportJobStatusInterrupted).
+		Updates(map[string]interface{}{"status": models.ImportJobStatusPending, "finished_at": nil, "error_summary": ""})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// サーバーの起動時に、前回の終了時に実行中だったジョブを中断したものとして記録する
+func (r *ImportJobRepository) MarkInterrupted(summary string) (int64, error) {
+	var interrupted int64
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		result := tx.Model(&models.ImportJob{}).
+			Where("status IN ?", []string{models.ImportJobStatusPending, models.ImportJobStatusRunning}).
+			Updates(map[string]interface{}{"status": models.ImportJobStatusInterrupted, "finished_at": now, "error_summary": summary})
+		if result.Error != nil {
+			return result.Error
+		}
+		interrupted = result.RowsAffected
+		return tx.Model(&models.ImportJobFile{}).
+			Where("status = ?", models.ImportJobStatusRunning).
+			Updates(map[string]interface{}{"status": models.ImportJobStatusInterrupted, "error_summary": summary}).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	return interrupted, nil
+}
+
+// 分割して送信するアップロードを登録
+func (r *ImportJobRepository) CreateUpload(upload models.ImportUpload) (*models.ImportUpload, error) {
+	result := r.db.Create(&upload)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &upload, nil
+}
+
+// IDでアップロードを取得
+func (r *ImportJobRepository) FindUploadById(uploadId uint, userId uint) (*models.ImportUpload, error) {
+	var upload models.ImportUpload
+	result := r.db.Where("user_id = ?", userId).First(&upload, uploadId)
+	if result.Error != nil {
+		if result.Error.Error() == "record not found" {
+			return nil, errors.New("import upload not found")
+		}
+		return nil, result.Error
+	}
+	return &upload, nil
+}
+
+// アップロードの受け取り済みの位置などを更新
+func (r *ImportJobRepository) UpdateUpload(upload models.ImportUpload) (*models.ImportUpload, error) {
+	result := r.db.Save(&upload)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &upload, nil
+}
+
+// 期限切れのアップロードを全件取得
+func (r *ImportJobRepository) FindExpiredUploads(before time.Time) ([]models.ImportUpload, error) {
+	var uploads []models.ImportUpload
+	result := r.db.Where("import_job_id IS NULL AND updated_at < ?", before).Find(&uploads)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return uploads, nil
+}
+
+// アップロードの記録を削除, 保存したファイルは削除済みのため論理削除にはしない
+func (r *ImportJobRepository) DeleteUpload(uploadId uint) error {
+	return r.db.Unscoped().Delete(&models.ImportUpload{}, uploadId).Error
+}
@@ -0,0 +1,285 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"project/dto"
+	"project/models"
+)
+
+// zipとして読み込めない場合や、取り込めるファイルが含まれていない場合のエラー
+var ErrInvalidArchive = errors.New("invalid archive")
+
+// 展開後のサイズやファイル数が上限を超えた場合のエラー
+var ErrArchiveLimitExceeded = errors.New("archive exceeds the limit")
+
+// gzipのマジックナンバー
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// 拡張子とファイルの形式の対応
+var fileExtensionFormats = map[string]string{
+	".csv":    models.ImportFormatCsv,
+	".tsv":    models.ImportFormatCsv,
+	".txt":    models.ImportFormatCsv,
+	".xlsx":   models.ImportFormatXlsx,
+	".json":   models.ImportFormatJson,
+	".jsonl":  models.ImportFormatJsonl,
+	".ndjson": models.ImportFormatJsonl,
+	".zip":    models.ImportFormatZip,
+}
+
+// ファイル名の拡張子からファイルの形式を判定する, 判定できない場合は空文字を返す
+func ImportFormatFromFileName(fileName string) string {
+	return fileExtensionFormats[strings.ToLower(filepath.Ext(fileName))]
+}
+
+// 取り込みの準備が済んだアップロード全体, zipの場合は中のファイルごと、それ以外は1つのファイルになる
+type preparedImport struct {
+	entries []importEntry
+	archive bool
+	// 中断したジョブを再開する場合の、中断前に確定していた件数
+	counts importCounts
+}
+
+// 取り込み単位のファイル
+type importEntry struct {
+	// 準備の段階で取り込めないと分かったzip内のファイルはnil
+	upload *preparedUpload
+	// zipの場合のファイルごとの結果
+	file models.ImportJobFile
+	// 取り込んだ連絡先に記録する取り込み元
+	batch models.ImportBatch
+
+	// 中断したジョブを再開する場合の、登録が確定した行番号とファイル内の位置
+	resumeLine   int
+	resumeOffset int64
+	// resumeLineより後で中断前に登録済みだった行と、既存の連絡先を更新した行かどうか
+	committed map[int]bool
+	// zipの場合の、このファイルを取り込む前のジョブ全体の件数
+	resumeFrom *importCounts
+}
+
+// 全ての一時ファイルを削除する
+func (p *preparedImport) remove() {
+	for _, entry := range p.entries {
+		if entry.upload != nil {
+			entry.upload.remove()
+		}
+	}
+}
+
+// 全ての一時ファイルを削除せずに閉じる
+func (p *preparedImport) close() {
+	for _, entry := range p.entries {
+		if entry.upload != nil {
+			entry.upload.close()
+		}
+	}
+}
+
+// 取り込むファイルの合計サイズ, 残り時間の見積もりに利用する
+func (p *preparedImport) size() int64 {
+	var size int64
+	for _, entry := range p.entries {
+		if entry.upload != nil {
+			size += entry.upload.size()
+		}
+	}
+	return size
+}
+
+// アップロードがgzipで圧縮されていれば展開してから、取り込みの準備をする
+// zipの場合は中のファイルをそれぞれ準備する, 準備したファイルはdirに保存する(空の場合は一時ディレクトリ)
+func (s *CsvService) prepareImport(reader io.Reader, input dto.ImportCsvInput, dir string) (*preparedImport, error) {
+	reader, err := s.decompressGzip(reader)
+	if err != nil {
+		return nil, err
+	}
+	if input.Format == models.ImportFormatZip {
+		return s.prepareArchive(reader, input, dir)
+	}
+	upload, err := prepareUpload(reader, input, dir, s.config.MaxUncompressedSize)
+	if err != nil {
+		return nil, err
+	}
+	return &preparedImport{entries: []importEntry{{upload: upload}}}, nil
+}
+
+// 先頭がgzipのマジックナンバーであれば展開するreaderを返す, それ以外はそのまま返す
+// 展開後のサイズはMaxUncompressedSizeまでに制限する
+func (s *CsvService) decompressGzip(reader io.Reader) (io.Reader, error) {
+	reader, head, err := peekHead(reader, len(gzipMagic))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(head, gzipMagic) {
+		return reader, nil
+	}
+	gz, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	return &limitedReader{reader: gzipReader{gz}, remaining: s.config.MaxUncompressedSize}, nil
+}
+
+// 展開中のエラーを不正なアーカイブのエラーとして返す
+type gzipReader struct {
+	*gzip.Reader
+}
+
+func (r gzipReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	return n, err
+}
+
+// 読み込んだバイト数がremainingを超えた時点でErrArchiveLimitExceededを返すreader
+// zipの場合は1つのreaderを全てのファイルで使い回し、展開後の合計サイズを制限する
+type limitedReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	// 上限ちょうどで終わるファイルを許可するため、1バイト多く読み込んで超過を判定する
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.reader.Read(p)
+	if int64(n) > r.remaining {
+		r.remaining = 0
+		return 0, fmt.Errorf("%w: uncompressed size is too large", ErrArchiveLimitExceeded)
+	}
+	r.remaining -= int64(n)
+	return n, err
+}
+
+// zipを一時ファイルに保存し、中のファイルを1つずつ展開して取り込みの準備をする
+// 拡張子から形式が分からないファイル・隠しファイル・入れ子のzipは読み飛ばす
+// 中のファイルのヘッダーが不正な場合はそのファイルだけを失敗として記録し、他のファイルは取り込む
+func (s *CsvService) prepareArchive(reader io.Reader, input dto.ImportCsvInput, dir string) (_ *preparedImport, err error) {
+	// zip自体は展開した後に削除するため一時ディレクトリに保存する
+	file, err := saveUpload("", reader)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	archive, err := zip.NewReader(file, info.Size())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+
+	// 展開する前に、中央ディレクトリに記録されたファイル数とサイズで上限を確認する
+	// 記録されたサイズは偽装できるため、展開時にも実際のサイズで制限する
+	var files []*zip.File
+	var declaredSize uint64
+	for _, f := range archive.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		files = append(files, f)
+		declaredSize += f.UncompressedSize64
+	}
+	if len(files) > s.config.MaxArchiveEntries {
+		return nil, fmt.Errorf("%w: archive contains more than %d files", ErrArchiveLimitExceeded, s.config.MaxArchiveEntries)
+	}
+	if declaredSize > uint64(s.config.MaxUncompressedSize) {
+		return nil, fmt.Errorf("%w: uncompressed size is too large", ErrArchiveLimitExceeded)
+	}
+
+	prepared := &preparedImport{archive: true}
+	defer func() {
+		if err != nil {
+			prepared.remove()
+		}
+	}()
+	limit := &limitedReader{remaining: s.config.MaxUncompressedSize}
+	for _, f := range files {
+		format := ImportFormatFromFileName(f.Name)
+		if format == "" || format == models.ImportFormatZip || isHiddenEntry(f.Name) {
+			continue
+		}
+		entryInput := input
+		entryInput.Format = format
+		upload, err := prepareArchiveEntry(f, limit, entryInput, dir, s.config.MaxUncompressedSize)
+		if errors.Is(err, ErrArchiveLimitExceeded) {
+			return nil, err
+		}
+		entry := importEntry{file: models.ImportJobFile{
+			Status:   models.ImportJobStatusPending,
+			FileName: f.Name,
+			Format:   format,
+		}}
+		if err != nil {
+			entry.file.Status = models.ImportJobStatusFailed
+			entry.file.ErrorSummary = err.Error()
+		} else {
+			entry.upload = upload
+			entry.file.Encoding = upload.encoding
+			entry.file.Delimiter = upload.input.Delimiter
+			entry.file.HeaderRow = upload.input.HeaderRow
+			entry.file.Sheet = upload.input.Sheet
+			entry.file.Header = upload.header
+		}
+		prepared.entries = append(prepared.entries, entry)
+	}
+
+	if len(prepared.entries) == 0 {
+		return nil, fmt.Errorf("%w: archive contains no importable files", ErrInvalidArchive)
+	}
+	// 1つも取り込めない場合はジョブを登録せずに最初のエラーを返す
+	if !prepared.hasUploads() {
+		first := prepared.entries[0].file
+		return nil, fmt.Errorf("%w: %s: %s", ErrInvalidArchive, first.FileName, first.ErrorSummary)
+	}
+	return prepared, nil
+}
+
+// 取り込めるファイルが1つ以上あるかどうか
+func (p *preparedImport) hasUploads() bool {
+	for _, entry := range p.entries {
+		if entry.upload != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// zip内のファイル1つを展開して取り込みの準備をする
+func prepareArchiveEntry(f *zip.File, limit *limitedReader, input dto.ImportCsvInput, dir string, maxPartSize int64) (*preparedUpload, error) {
+	reader, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	limit.reader = reader
+	return prepareUpload(limit, input, dir, maxPartSize)
+}
+
+// macOSのFinderが作成する__MACOSXやドットで始まるファイルは取り込まない
+func isHiddenEntry(name string) bool {
+	for _, part := range strings.Split(path.Clean(name), "/") {
+		if strings.HasPrefix(part, ".") || part == "__MACOSX" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package services
+
+import (
+	"context"
+	"strings"
+
+	"project/dto"
+	"project/models"
+	"project/repositories"
+)
+
+// 登録・更新しようとしたメールアドレスが他の連絡先で使われている場合のエラー
+// メールアドレスはユーザーごとにユニークで、論理削除された連絡先も対象になる
+// 確認の後に他のリクエストが同じメールアドレスを登録した場合も、リポジトリ層のユニーク制約の違反として同じエラーになる
+var ErrEmailAlreadyExists = repositories.ErrDuplicateEmail
+
+// 連絡先を1件登録する, 取り込みと同じく前後の空白を除いてから検証する
+func (s *CsvService) CreateCsv(ctx context.Context, input dto.CreateCsvInput, userId uint) (*models.Csv, error) {
+	csv := models.Csv{
+		UserID:      userId,
+		FirstName:   input.FirstName,
+		LastName:    input.LastName,
+		Email:       input.Email,
+		PhoneNumber: input.PhoneNumber,
+		Address:     input.Address,
+		City:        input.City,
+		State:       input.State,
+		ZipCode:     input.ZipCode,
+		Country:     input.Country,
+	}
+	trimCsv(&csv)
+	if err := s.validateContact(ctx, csv, ""); err != nil {
+		return nil, err
+	}
+
+	created, err := s.repository.CreateCsv(ctx, csv)
+	if err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// 指定した項目だけを更新する
+// 手動で編集した値を取り込みの取り消しで消さないよう、取り込み元の記録を外す
+func (s *CsvService) UpdateCsv(ctx context.Context, csvId uint, input dto.UpdateCsvInput, userId uint) (*models.Csv, error) {
+	csv, err := s.repository.FindCsvById(ctx, csvId, userId)
+	if err != nil {
+		return nil, err
+	}
+	currentEmail := csv.Email
+
+	updates := []struct {
+		value *string
+		field *string
+	}{
+		{input.FirstName, &csv.FirstName},
+		{input.LastName, &csv.LastName},
+		{input.Email, &csv.Email},
+		{input.PhoneNumber, &csv.PhoneNumber},
+		{input.Address, &csv.Address},
+		{input.City, &csv.City},
+		{input.State, &csv.State},
+		{input.ZipCode, &csv.ZipCode},
+		{input.Country, &csv.Country},
+	}
+	for _, update := range updates {
+		if update.value != nil {
+			*update.field = *update.value
+		}
+	}
+	trimCsv(csv)
+	if err := s.validateContact(ctx, *csv, currentEmail); err != nil {
+		return nil, err
+	}
+	csv.ImportBatchID = nil
+	csv.SourceLine = 0
+
+	return s.repository.UpdateCsv(ctx, *csv)
+}
+
+// 論理削除する, RestoreCsvで元に戻せる
+func (s *CsvService) DeleteCsv(ctx context.Context, csvId uint, userId uint) error {
+	return s.repository.DeleteCsv(ctx, csvId, userId)
+}
+
+// 論理削除した連絡先を元に戻す
+func (s *CsvService) RestoreCsv(ctx context.Context, csvId uint, userId uint) (*models.Csv, error) {
+	return s.repository.RestoreCsv(ctx, csvId, userId)
+}
+
+// 論理削除した連絡先をDBから削除する, 元に戻せなくなる
+func (s *CsvService) PurgeCsv(ctx context.Context, csvId uint, userId uint) error {
+	return s.repository.PurgeCsv(ctx, csvId, userId)
+}
+
+// 各列の前後の空白を除く
+func trimCsv(csv *models.Csv) {
+	for _, field := range csvFields {
+		field.set(csv, strings.TrimSpace(field.get(csv)))
+	}
+}
+
+// 取り込みと同じ検証を行い、メールアドレスが同じユーザーの他の連絡先と重複していないことを確認する
+// currentEmailは更新前のメールアドレスで、変更していない場合は重複を確認しない
+func (s *CsvService) validateContact(ctx context.Context, csv models.Csv, currentEmail string) error {
+	if errs := validateCsv(csv); len(errs) > 0 {
+		return &CsvValidationError{Errors: errs}
+	}
+	if csv.Email == currentEmail {
+		return nil
+	}
+	existing, err := s.repository.FindExistingEmails(ctx, csv.UserID, []string{csv.Email})
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return ErrEmailAlreadyExists
+	}
+	return nil
+}
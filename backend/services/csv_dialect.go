@@ -0,0 +1,149 @@
+package services
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"project/dto"
+)
+
+// 区切り文字・コメント文字に使えない文字が指定された場合や、両方に同じ文字が指定された場合のエラー
+var ErrInvalidDialect = errors.New("invalid csv dialect")
+
+const (
+	// 区切り文字・ヘッダー行を判定するために先読みするバイト数
+	dialectSniffSize = 16 * 1024
+	// 判定に利用する先頭のレコード数
+	dialectSniffRecords = 20
+	// 区切り文字を自動で判定する場合の指定
+	delimiterAuto = "auto"
+)
+
+// 自動判定する区切り文字の候補, 同点の場合は先頭の候補を優先する
+var delimiterCandidates = []rune{',', '\t', ';', '|'}
+
+// クエリパラメータで指定しにくい区切り文字の名前
+var delimiterNames = map[string]rune{
+	"comma":     ',',
+	"tab":       '\t',
+	`\t`:        '\t',
+	"semicolon": ';',
+	"pipe":      '|',
+}
+
+// 区切り文字を解析する, 1文字または名前で指定する
+func parseDelimiter(value string) (rune, error) {
+	if r, ok := delimiterNames[value]; ok {
+		return r, nil
+	}
+	r, size := utf8.DecodeRuneInString(value)
+	if size == 0 || size != len(value) || !isValidDialectRune(r) {
+		return 0, fmt.Errorf("%w: unsupported delimiter %q", ErrInvalidDialect, value)
+	}
+	return r, nil
+}
+
+// コメント文字を解析する, 空の場合はコメント行を扱わない
+func parseComment(value string) (rune, error) {
+	if value == "" {
+		return 0, nil
+	}
+	r, size := utf8.DecodeRuneInString(value)
+	if size != len(value) || !isValidDialectRune(r) {
+		return 0, fmt.Errorf("%w: unsupported comment character %q", ErrInvalidDialect, value)
+	}
+	return r, nil
+}
+
+// encoding/csvが区切り文字・コメント文字として受け付ける文字かどうか
+func isValidDialectRune(r rune) bool {
+	return r != 0 && r != '"' && r != '\r' && r != '\n' && r != utf8.RuneError && utf8.ValidRune(r)
+}
+
+// 区切り文字とヘッダー行の位置を決めたinputを返す
+// 省略された値は先頭のheadから判定する, 決めた値はジョブに保存してバックグラウンドの取り込みでも同じ値を使う
+func resolveDialect(head []byte, input dto.ImportCsvInput) (dto.ImportCsvInput, error) {
+	comment, err := parseComment(input.Comment)
+	if err != nil {
+		return input, err
+	}
+
+	// 末尾の途中までしか読めていない行は判定に使わない
+	if len(head) == dialectSniffSize {
+		if i := bytes.LastIndexByte(head, '\n'); i >= 0 {
+			head = head[:i+1]
+		}
+	}
+
+	if input.Delimiter == "" || input.Delimiter == delimiterAuto {
+		input.Delimiter = string(sniffDelimiter(head, input))
+	}
+	comma, err := parseDelimiter(input.Delimiter)
+	if err != nil {
+		return input, err
+	}
+	if comma == comment {
+		return input, fmt.Errorf("%w: delimiter and comment character must be different", ErrInvalidDialect)
+	}
+	input.Delimiter = string(comma)
+
+	if input.HeaderRow == 0 {
+		input.HeaderRow = findHeaderRow(sniffRecords(head, input))
+	}
+	return input, nil
+}
+
+// 候補の区切り文字ごとに先頭のレコードを読み込み、列の数が2列以上で揃っている行が最も多いものを選ぶ
+// どの候補でも2列以上にならない場合はカンマとする
+func sniffDelimiter(head []byte, input dto.ImportCsvInput) rune {
+	best, bestRows, bestFields := delimiterCandidates[0], 0, 0
+	for _, candidate := range delimiterCandidates {
+		input.Delimiter = string(candidate)
+		records := sniffRecords(head, input)
+
+		// 最も多く出現する列の数と、その列の数の行数を数える
+		counts := make(map[int]int)
+		for _, record := range records {
+			counts[len(record)]++
+		}
+		rows, fields := 0, 0
+		for n, count := range counts {
+			if n > 1 && (count > rows || count == rows && n > fields) {
+				rows, fields = count, n
+			}
+		}
+		if rows > bestRows || rows == bestRows && fields > bestFields {
+			best, bestRows, bestFields = candidate, rows, fields
+		}
+	}
+	return best
+}
+
+// 判定用に先頭のレコードを読み込む
+func sniffRecords(head []byte, input dto.ImportCsvInput) [][]string {
+	csvReader := newCsvReader(bytes.NewReader(head), input)
+	// 引用符の誤りがあるファイルでも区切り文字を判定できるようにする
+	csvReader.LazyQuotes = true
+	return readSniffRecords(&csvRecordReader{reader: csvReader})
+}
+
+// inputの区切り文字・引用符・コメントの設定に従ったCSVリーダーを作成する
+// 列の数が揃っていない行も読み込み、足りない列は空文字として扱い、行ごとの検証に任せる
+// 区切り文字・コメント文字はresolveDialectで検証済みの値を前提とする
+func newCsvReader(reader io.Reader, input dto.ImportCsvInput) *csv.Reader {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+	if comma, err := parseDelimiter(input.Delimiter); err == nil {
+		csvReader.Comma = comma
+	}
+	if comment, err := parseComment(input.Comment); err == nil {
+		csvReader.Comment = comment
+	}
+	csvReader.LazyQuotes = input.LazyQuotes
+	csvReader.TrimLeadingSpace = input.TrimLeadingSpace
+	return csvReader
+}
@@ -0,0 +1,151 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// 指定された、またはBOMから判定した文字コードに対応していない場合のエラー
+var ErrUnsupportedEncoding = errors.New("unsupported encoding")
+
+// 文字コードを判定するために先読みするバイト数
+const encodingSniffSize = 64 * 1024
+
+// 取り込みに対応する文字コード
+type csvEncoding struct {
+	// ジョブ・ドライランの結果に表示する名前
+	name string
+	// 名前の別名, normalizeEncodingNameで正規化した値で比較する
+	aliases  []string
+	encoding encoding.Encoding
+}
+
+var csvEncodings = []csvEncoding{
+	{name: "utf-8", aliases: []string{"utf8"}, encoding: unicode.UTF8},
+	// 日本語版のExcelが出力するShift_JIS(Windows-31J)
+	{name: "shift_jis", aliases: []string{"sjis", "cp932", "ms932", "windows31j"}, encoding: japanese.ShiftJIS},
+	{name: "euc-jp", aliases: []string{"eucjp"}, encoding: japanese.EUCJP},
+	// BOMで判定した場合のみ利用する
+	{name: "utf-16le", aliases: []string{"utf16le"}, encoding: unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)},
+	{name: "utf-16be", aliases: []string{"utf16be"}, encoding: unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)},
+}
+
+// 大文字小文字・区切り文字の違いを吸収する
+// "Shift_JIS", "shift-jis", "SJIS"はいずれも"shiftjis"または"sjis"になる
+func normalizeEncodingName(name string) string {
+	replacer := strings.NewReplacer("-", "", "_", "", " ", "")
+	return replacer.Replace(strings.ToLower(strings.TrimSpace(name)))
+}
+
+// 名前・別名から文字コードを探す
+func findCsvEncoding(name string) (csvEncoding, bool) {
+	normalized := normalizeEncodingName(name)
+	for _, candidate := range csvEncodings {
+		if normalizeEncodingName(candidate.name) == normalized {
+			return candidate, true
+		}
+		for _, alias := range candidate.aliases {
+			if alias == normalized {
+				return candidate, true
+			}
+		}
+	}
+	return csvEncoding{}, false
+}
+
+// readerの内容をUTF-8に変換するreaderと、変換元の文字コード名を返す
+// nameが空の場合は先頭のencodingSniffSizeバイトから文字コードを判定する
+// BOMがある場合はnameより優先し、BOMは取り除く
+func newUTF8Reader(reader io.Reader, name string) (io.Reader, string, error) {
+	buffered, head, err := peekHead(reader, encodingSniffSize)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if bom := detectBOM(head); bom != "" {
+		name = bom
+	} else if name == "" {
+		name = detectEncoding(head)
+	}
+	csvEncoding, ok := findCsvEncoding(name)
+	if !ok {
+		return nil, "", fmt.Errorf("%w: %s", ErrUnsupportedEncoding, name)
+	}
+
+	return transform.NewReader(buffered, unicode.BOMOverride(csvEncoding.encoding.NewDecoder())), csvEncoding.name, nil
+}
+
+// readerの先頭sizeバイトを読み込まずに取得する, 返したreaderからは先頭から読み込める
+func peekHead(reader io.Reader, size int) (io.Reader, []byte, error) {
+	buffered := bufio.NewReaderSize(reader, size)
+	head, err := buffered.Peek(size)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	return buffered, head, nil
+}
+
+// BOMから文字コードを判定する, BOMが無い場合は空文字を返す
+func detectBOM(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte{0xEF, 0xBB, 0xBF}):
+		return "utf-8"
+	case bytes.HasPrefix(head, []byte{0xFF, 0xFE}):
+		return "utf-16le"
+	case bytes.HasPrefix(head, []byte{0xFE, 0xFF}):
+		return "utf-16be"
+	}
+	return ""
+}
+
+// BOMの無いデータの文字コードを判定する
+// UTF-8として正しければUTF-8とし、そうでなければShift_JISとEUC-JPで変換してみて不自然な文字が少ない方を選ぶ
+func detectEncoding(head []byte) string {
+	if utf8.Valid(trimIncompleteRune(head)) {
+		return "utf-8"
+	}
+	// EUC-JPの2バイト文字はShift_JISの半角カナとしても読めるため、半角カナも不自然な文字として数える
+	// 同点の場合はExcelが出力するShift_JISを優先する
+	if decodeScore(japanese.EUCJP, head) < decodeScore(japanese.ShiftJIS, head) {
+		return "euc-jp"
+	}
+	return "shift_jis"
+}
+
+// 先読みの末尾で途中までしか読めていない文字を取り除く
+func trimIncompleteRune(head []byte) []byte {
+	for i := len(head) - 1; i >= 0 && i >= len(head)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(head[i]) {
+			if !utf8.FullRune(head[i:]) {
+				return head[:i]
+			}
+			break
+		}
+	}
+	return head
+}
+
+// 変換できなかった文字と半角カナの数, 少ないほどその文字コードらしい
+func decodeScore(enc encoding.Encoding, head []byte) int {
+	decoded, _ := enc.NewDecoder().Bytes(head)
+	score := 0
+	for _, r := range string(decoded) {
+		switch {
+		case r == utf8.RuneError:
+			score += 10
+		case r >= 0xFF61 && r <= 0xFF9F:
+			score++
+		}
+	}
+	return score
+}
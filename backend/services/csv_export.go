@@ -0,0 +1,98 @@
+package services
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"project/dto"
+	"project/models"
+)
+
+// 出力中にこの行数ごとにバッファを書き出し、クライアントへ少しずつ送信する
+const exportFlushRows = 1000
+
+// 出力する列, utils.CreateCSVFileと同じ並びにするため先頭にIDの列を置き、以降はcsvFieldsの順になる
+type exportColumn struct {
+	name string
+	get  func(csv *models.Csv) string
+}
+
+var exportColumns = func() []exportColumn {
+	columns := []exportColumn{{
+		name: "ID",
+		get:  func(csv *models.Csv) string { return strconv.FormatUint(uint64(csv.ID), 10) },
+	}}
+	for _, field := range csvFields {
+		columns = append(columns, exportColumn{name: field.name, get: field.get})
+	}
+	return columns
+}()
+
+// userIdのユーザーの連絡先を条件で絞り込み、CSVとしてwriterへ書き出す
+// 条件が不正な場合は1バイトも書き出さずにエラーを返す
+func (s *CsvService) ExportCsv(ctx context.Context, input dto.ExportCsvInput, userId uint, writer io.Writer) error {
+	columns, err := selectExportColumns(input.Columns)
+	if err != nil {
+		return err
+	}
+	filter, err := toCsvFilter(input.CsvFilterInput, userId)
+	if err != nil {
+		return err
+	}
+
+	csvWriter := csv.NewWriter(writer)
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = column.name
+	}
+	if err := csvWriter.Write(header); err != nil {
+		return err
+	}
+
+	rows := 0
+	record := make([]string, len(columns))
+	err = s.repository.FindCsvsEach(ctx, filter, func(contact models.Csv) error {
+		for i, column := range columns {
+			record[i] = column.get(&contact)
+		}
+		if err := csvWriter.Write(record); err != nil {
+			return err
+		}
+		if rows++; rows%exportFlushRows == 0 {
+			csvWriter.Flush()
+			return csvWriter.Error()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// カンマ区切りの列名から出力する列を選ぶ, 空の場合は全ての列を返す
+// 列名は取り込み時のヘッダーと同じ別名も受け付ける
+func selectExportColumns(names string) ([]exportColumn, error) {
+	if strings.TrimSpace(names) == "" {
+		return exportColumns, nil
+	}
+	var columns []exportColumn
+	for _, name := range strings.Split(names, ",") {
+		normalized := normalizeHeader(name)
+		if normalized == "id" {
+			columns = append(columns, exportColumns[0])
+			continue
+		}
+		index, ok := csvFieldIndex[normalized]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown column: %s", ErrInvalidCsvQuery, strings.TrimSpace(name))
+		}
+		columns = append(columns, exportColumns[index+1])
+	}
+	return columns, nil
+}
@@ -0,0 +1,43 @@
+package services
+
+import (
+	"context"
+
+	"project/dto"
+	"project/models"
+)
+
+// 取り込んだファイルの記録を新しい順に取得
+func (s *CsvService) FindAllBatches(userId uint) (*[]models.ImportBatch, error) {
+	return s.jobRepository.FindAllBatches(userId)
+}
+
+// IDで取り込んだファイルの記録を取得
+func (s *CsvService) FindBatchById(batchId uint, userId uint) (*models.ImportBatch, error) {
+	return s.jobRepository.FindBatchById(batchId, userId)
+}
+
+// 指定したファイルから取り込んだ連絡先を1ページ分取得する, 条件はFindCsvsと同じ
+// 後の取り込みで上書きされた連絡先は、後の取り込みの連絡先になる
+func (s *CsvService) FindBatchCsvs(ctx context.Context, batchId uint, input dto.FindCsvsInput, userId uint) (*dto.CsvPageOutput, error) {
+	if _, err := s.jobRepository.FindBatchById(batchId, userId); err != nil {
+		return nil, err
+	}
+	input.ImportBatchID = batchId
+	return s.findCsvs(ctx, input, userId, false)
+}
+
+// 連絡先を取り込んだファイルと行番号を取得する
+func (s *CsvService) FindCsvProvenance(ctx context.Context, csvId uint, userId uint) (*dto.CsvProvenanceOutput, error) {
+	csv, err := s.repository.FindCsvById(ctx, csvId, userId)
+	if err != nil {
+		return nil, err
+	}
+	output := &dto.CsvProvenanceOutput{Contact: csv, Line: csv.SourceLine}
+	if csv.ImportBatchID != nil {
+		if output.Batch, err = s.jobRepository.FindBatchById(*csv.ImportBatchID, userId); err != nil {
+			return nil, err
+		}
+	}
+	return output, nil
+}
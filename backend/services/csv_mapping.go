@@ -0,0 +1,173 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"project/models"
+)
+
+// ヘッダー行を読み込めない場合や、同じフィールドに対応する列が重複している・必須の列が無い場合のエラー
+var ErrInvalidHeader = errors.New("invalid csv header")
+
+// CSVの列とmodels.Csvのフィールドの対応を定義する構造体
+type csvField struct {
+	// utils.CreateCSVFileが出力するヘッダー名
+	name string
+	// ヘッダー名の別名, normalizeHeaderで正規化した値で比較する
+	aliases  []string
+	required bool
+	set      func(csv *models.Csv, value string)
+	get      func(csv *models.Csv) string
+	// 最大文字数
+	maxLength int
+}
+
+// models.Csvに取り込むフィールドの一覧
+var csvFields = []csvField{
+	{
+		name:      "First Name",
+		aliases:   []string{"firstname", "givenname", "forename", "fname", "名"},
+		required:  true,
+		set:       func(csv *models.Csv, value string) { csv.FirstName = value },
+		get:       func(csv *models.Csv) string { return csv.FirstName },
+		maxLength: 100,
+	},
+	{
+		name:      "Last Name",
+		aliases:   []string{"lastname", "surname", "familyname", "lname", "姓"},
+		required:  true,
+		set:       func(csv *models.Csv, value string) { csv.LastName = value },
+		get:       func(csv *models.Csv) string { return csv.LastName },
+		maxLength: 100,
+	},
+	{
+		name:      "Email",
+		aliases:   []string{"email", "emailaddress", "mail", "メールアドレス"},
+		required:  true,
+		set:       func(csv *models.Csv, value string) { csv.Email = value },
+		get:       func(csv *models.Csv) string { return csv.Email },
+		maxLength: 254,
+	},
+	{
+		name:      "Phone Number",
+		aliases:   []string{"phonenumber", "phone", "tel", "telephone", "mobile", "電話番号"},
+		set:       func(csv *models.Csv, value string) { csv.PhoneNumber = value },
+		get:       func(csv *models.Csv) string { return csv.PhoneNumber },
+		maxLength: 30,
+	},
+	{
+		name:      "Address",
+		aliases:   []string{"address", "streetaddress", "street", "address1", "住所"},
+		set:       func(csv *models.Csv, value string) { csv.Address = value },
+		get:       func(csv *models.Csv) string { return csv.Address },
+		maxLength: 255,
+	},
+	{
+		name:      "City",
+		aliases:   []string{"city", "town", "市区町村"},
+		set:       func(csv *models.Csv, value string) { csv.City = value },
+		get:       func(csv *models.Csv) string { return csv.City },
+		maxLength: 100,
+	},
+	{
+		name:      "State",
+		aliases:   []string{"state", "province", "region", "prefecture", "都道府県"},
+		set:       func(csv *models.Csv, value string) { csv.State = value },
+		get:       func(csv *models.Csv) string { return csv.State },
+		maxLength: 100,
+	},
+	{
+		name:      "Zip Code",
+		aliases:   []string{"zipcode", "zip", "postalcode", "postcode", "郵便番号"},
+		set:       func(csv *models.Csv, value string) { csv.ZipCode = value },
+		get:       func(csv *models.Csv) string { return csv.ZipCode },
+		maxLength: 20,
+	},
+	{
+		name:      "Country",
+		aliases:   []string{"country", "国"},
+		set:       func(csv *models.Csv, value string) { csv.Country = value },
+		get:       func(csv *models.Csv) string { return csv.Country },
+		maxLength: 100,
+	},
+}
+
+// 正規化したヘッダー名からcsvFieldsのインデックスを引くためのマップ
+var csvFieldIndex = func() map[string]int {
+	index := make(map[string]int)
+	for i, field := range csvFields {
+		index[normalizeHeader(field.name)] = i
+		for _, alias := range field.aliases {
+			index[normalizeHeader(alias)] = i
+		}
+	}
+	return index
+}()
+
+// 大文字小文字・空白・区切り文字・BOMの違いを吸収する
+// "First Name", "first_name", "FirstName"はいずれも"firstname"になる
+func normalizeHeader(header string) string {
+	replacer := strings.NewReplacer(" ", "", "_", "", "-", "", ".", "", "　", "", "\ufeff", "")
+	return replacer.Replace(strings.ToLower(strings.TrimSpace(header)))
+}
+
+// ヘッダーから組み立てた列の対応, columns[i]はcsvFields[i]に対応する列番号(存在しない場合は-1)
+type columnMapping struct {
+	columns []int
+}
+
+// ヘッダーを解析して列の対応を作成する
+// 必須の列が無い場合や、同じフィールドに対応する列が複数ある場合はエラーを返す
+func newColumnMapping(header []string) (*columnMapping, error) {
+	columns := make([]int, len(csvFields))
+	for i := range columns {
+		columns[i] = -1
+	}
+
+	for col, name := range header {
+		fieldIndex, ok := csvFieldIndex[normalizeHeader(name)]
+		// 対応するフィールドが無い列(IDなど)は無視する
+		if !ok {
+			continue
+		}
+		if columns[fieldIndex] != -1 {
+			return nil, fmt.Errorf("%w: duplicate columns for %s", ErrInvalidHeader, csvFields[fieldIndex].name)
+		}
+		columns[fieldIndex] = col
+	}
+
+	var missing []string
+	for i, field := range csvFields {
+		if field.required && columns[i] == -1 {
+			missing = append(missing, field.name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%w: missing required columns: %s", ErrInvalidHeader, strings.Join(missing, ", "))
+	}
+
+	return &columnMapping{columns: columns}, nil
+}
+
+// レコードのメールアドレスの列の値, toCsvと同じく前後の空白を除く
+func (m *columnMapping) email(record []string) string {
+	col := m.columns[csvFieldIndex["email"]]
+	if col < 0 || col >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[col])
+}
+
+// レコードをmodels.Csvに変換する, 列が足りない行は空文字として扱う
+func (m *columnMapping) toCsv(record []string) models.Csv {
+	var csv models.Csv
+	for i, col := range m.columns {
+		if col < 0 || col >= len(record) {
+			continue
+		}
+		csvFields[i].set(&csv, strings.TrimSpace(record[col]))
+	}
+	return csv
+}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"project/dto"
+	"project/models"
+)
+
+// ドライランで返す行数の初期値
+const defaultPreviewLimit = 20
+
+// ドライランで判定する行の扱い
+const (
+	previewActionInsert  = "insert"
+	previewActionUpdate  = "update"
+	previewActionSkip    = "skip"
+	previewActionFail    = "fail"
+	previewActionInvalid = "invalid"
+)
+
+// 判定待ちの行, 既存のメールアドレスの検索をbatchSize件ごとにまとめて行う
+type pendingPreviewRow struct {
+	record csvRecord
+	csv    models.Csv
+	errs   []models.ImportRowError
+}
+
+// 1回のドライランの集計状態
+type importPreview struct {
+	output     dto.ImportPreviewOutput
+	onConflict string
+	limit      int
+	// 既存の連絡先を検索するユーザー
+	userId uint
+	// ファイル内で既に出現したメールアドレス
+	seen map[string]bool
+}
+
+// CSVデータを取り込まずに、列の対応・検証・既存の連絡先との重複を確認して結果の見込みを返す
+// ファイル内の重複を検出するため、メールアドレスだけはファイル全体分をメモリに保持する
+// 取り込みと同じ手順で形式を判定するため、アップロードは一時ファイルに保存してから読み込む
+// gzipは展開して確認するが、複数のファイルを含むzipには対応しない
+func (s *CsvService) PreviewImport(ctx context.Context, reader io.Reader, input dto.ImportCsvInput, userId uint) (*dto.ImportPreviewOutput, error) {
+	if input.OnConflict == "" {
+		input.OnConflict = models.OnConflictFail
+	}
+	if input.PreviewLimit == 0 {
+		input.PreviewLimit = defaultPreviewLimit
+	}
+
+	if input.Format == models.ImportFormatZip {
+		return nil, fmt.Errorf("%w: dry run does not support zip archives", ErrInvalidArchive)
+	}
+	prepared, err := s.prepareImport(reader, input, "")
+	if err != nil {
+		return nil, err
+	}
+	defer prepared.remove()
+	upload := prepared.entries[0].upload
+	input = upload.input
+
+	records, err := upload.open()
+	if err != nil {
+		return nil, err
+	}
+	_, mapping, err := readHeader(records, input.HeaderRow)
+	if err != nil {
+		return nil, err
+	}
+
+	preview := &importPreview{
+		output: dto.ImportPreviewOutput{
+			Format:    input.Format,
+			Encoding:  upload.encoding,
+			Delimiter: input.Delimiter,
+			Sheet:     input.Sheet,
+			HeaderRow: input.HeaderRow,
+			Records:   []dto.PreviewRecord{},
+		},
+		onConflict: input.OnConflict,
+		limit:      input.PreviewLimit,
+		userId:     userId,
+		seen:       make(map[string]bool),
+	}
+
+	batchSize := s.config.withInput(input).BatchSize
+	pending := make([]pendingPreviewRow, 0, batchSize)
+	for {
+		fields, err := records.Read()
+		if err == io.EOF {
+			break
+		}
+		record, err := newCsvRecord(records, fields, err)
+		if err != nil {
+			return nil, err
+		}
+		csv := mapping.toCsv(record.fields)
+		errs := record.errs
+		if len(errs) == 0 {
+			errs = validateCsv(csv)
+		}
+		pending = append(pending, pendingPreviewRow{record: record, csv: csv, errs: errs})
+		if len(pending) == batchSize {
+			if err := s.resolvePreviewRows(ctx, preview, pending); err != nil {
+				return nil, err
+			}
+			pending = pending[:0]
+		}
+	}
+	if err := s.resolvePreviewRows(ctx, preview, pending); err != nil {
+		return nil, err
+	}
+
+	if preview.output.TotalRows == 0 {
+		return nil, ErrEmptyCsv
+	}
+	return &preview.output, nil
+}
+
+// 既存のメールアドレスをまとめて検索し、判定待ちの行の扱いをファイル内の順番どおりに決める
+func (s *CsvService) resolvePreviewRows(ctx context.Context, preview *importPreview, rows []pendingPreviewRow) error {
+	emails := make([]string, 0, len(rows))
+	for _, row := range rows {
+		if len(row.errs) == 0 {
+			emails = append(emails, row.csv.Email)
+		}
+	}
+	existingEmails, err := s.repository.FindExistingEmails(ctx, preview.userId, emails)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool, len(existingEmails))
+	for _, email := range existingEmails {
+		existing[email] = true
+	}
+
+	for _, row := range rows {
+		preview.add(row, existing[row.csv.Email])
+	}
+	return nil
+}
+
+// 1行分の扱いを決めて集計する
+func (p *importPreview) add(row pendingPreviewRow, exists bool) {
+	p.output.TotalRows++
+
+	action := previewActionInsert
+	switch {
+	case len(row.errs) > 0:
+		action = previewActionInvalid
+		p.output.InvalidRows++
+	case exists || p.seen[row.csv.Email]:
+		p.output.ValidRows++
+		p.output.DuplicateRows++
+		action = conflictAction(p.onConflict)
+	default:
+		p.output.ValidRows++
+	}
+	if action != previewActionInvalid {
+		p.seen[row.csv.Email] = true
+	}
+
+	switch action {
+	case previewActionInsert:
+		p.output.InsertRows++
+	case previewActionUpdate:
+		p.output.UpdateRows++
+	case previewActionSkip:
+		p.output.SkipRows++
+	case previewActionFail:
+		p.output.FailRows++
+	}
+
+	if len(p.output.Records) < p.limit {
+		p.output.Records = append(p.output.Records, toPreviewRecord(row, action))
+	}
+}
+
+// メールアドレスが重複した行の扱い
+func conflictAction(onConflict string) string {
+	switch onConflict {
+	case models.OnConflictSkip:
+		return previewActionSkip
+	case models.OnConflictOverwrite, models.OnConflictMerge:
+		return previewActionUpdate
+	default:
+		return previewActionFail
+	}
+}
+
+func toPreviewRecord(row pendingPreviewRow, action string) dto.PreviewRecord {
+	record := dto.PreviewRecord{
+		Line:        row.record.line,
+		Action:      action,
+		FirstName:   row.csv.FirstName,
+		LastName:    row.csv.LastName,
+		Email:       row.csv.Email,
+		PhoneNumber: row.csv.PhoneNumber,
+		Address:     row.csv.Address,
+		City:        row.csv.City,
+		State:       row.csv.State,
+		ZipCode:     row.csv.ZipCode,
+		Country:     row.csv.Country,
+	}
+	for _, rowErr := range row.errs {
+		record.Errors = append(record.Errors, dto.PreviewError{Column: rowErr.Column, Reason: rowErr.Reason})
+	}
+	return record
+}
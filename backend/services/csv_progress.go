@@ -0,0 +1,144 @@
+package services
+
+import (
+	"time"
+
+	"project/dto"
+	"project/models"
+)
+
+const (
+	// 進捗イベントを送信する間隔
+	progressEventInterval = 500 * time.Millisecond
+	// 途中経過のイベント名, 終了時のイベント名はジョブのステータスになる
+	progressEventName = "progress"
+	// 購読者ごとに溜めておくイベントの数
+	progressEventBuffer = 16
+)
+
+// 進捗イベントを作成する, progressがnilの場合は終了済みのジョブの値だけで作成する
+func newProgressEvent(name string, job *models.ImportJob, progress *importProgress) dto.ImportProgressEvent {
+	event := dto.ImportProgressEvent{
+		Event:        name,
+		JobID:        job.ID,
+		Status:       job.Status,
+		ReadRows:     job.TotalRows,
+		InsertedRows: job.InsertedRows,
+		UpdatedRows:  job.UpdatedRows,
+		SkippedRows:  job.SkippedRows,
+		FailedRows:   job.FailedRows,
+		ErrorSummary: job.ErrorSummary,
+	}
+	var elapsed time.Duration
+	if job.StartedAt != nil {
+		elapsed = time.Since(*job.StartedAt)
+		if job.FinishedAt != nil {
+			elapsed = job.FinishedAt.Sub(*job.StartedAt)
+		}
+	}
+	if progress != nil {
+		// DBに保存する間隔より細かく送信するため、件数は進捗から直接読む
+		event.ReadRows = int(progress.read.Load())
+		event.InsertedRows = int(progress.inserted.Load())
+		event.UpdatedRows = int(progress.updated.Load())
+		event.SkippedRows = int(progress.skipped.Load())
+		event.FailedRows = int(progress.failed.Load())
+		event.Workers = int(progress.workers.Load())
+		event.BytesRead = progress.bytesRead.Load()
+		event.TotalBytes = progress.totalBytes
+	}
+	if elapsed <= 0 {
+		return event
+	}
+
+	seconds := elapsed.Seconds()
+	event.RowsPerSecond = float64(event.ReadRows) / seconds
+	// 行数はファイル全体を読むまで分からないため、残り時間は読み込んだバイト数の割合から見積もる
+	switch {
+	case name != progressEventName:
+		eta := 0.0
+		event.EtaSeconds = &eta
+	case event.BytesRead > 0 && event.TotalBytes > 0:
+		eta := float64(event.TotalBytes-event.BytesRead) / (float64(event.BytesRead) / seconds)
+		event.EtaSeconds = &eta
+	}
+	return event
+}
+
+// 進捗イベントを購読する, ジョブが終了済みの場合はfalseを返す
+func (j *runningJob) subscribe() (chan dto.ImportProgressEvent, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.finished {
+		return nil, false
+	}
+	events := make(chan dto.ImportProgressEvent, progressEventBuffer)
+	j.subscribers[events] = struct{}{}
+	return events, true
+}
+
+func (j *runningJob) unsubscribe(events chan dto.ImportProgressEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.subscribers, events)
+}
+
+// 全ての購読者にイベントを送信する
+// 受信が追いつかない購読者には古いイベントを捨てて最新のイベントを送るため、ワーカーの処理は待たされない
+func (j *runningJob) publish(event dto.ImportProgressEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for events := range j.subscribers {
+		sendLatest(events, event)
+	}
+}
+
+// 終了イベントを送信して全ての購読を終了する
+func (j *runningJob) finish(event dto.ImportProgressEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for events := range j.subscribers {
+		sendLatest(events, event)
+		close(events)
+	}
+	j.subscribers = nil
+	j.finished = true
+}
+
+// チャネルが一杯の場合は最も古いイベントを捨てて送信する
+// 送信するのはrunningJobのロックを持つgoroutineだけのため、捨てた後の送信はブロックしない
+func sendLatest(events chan dto.ImportProgressEvent, event dto.ImportProgressEvent) {
+	select {
+	case events <- event:
+	default:
+		select {
+		case <-events:
+		default:
+		}
+		events <- event
+	}
+}
+
+// ジョブの進捗イベントを購読し、イベントのチャネルと購読を解除する関数を返す
+// チャネルは終了イベントを送信した後に閉じられる, 終了済みのジョブの場合は終了イベントだけを返す
+func (s *CsvService) SubscribeJob(jobId uint, userId uint) (<-chan dto.ImportProgressEvent, func(), error) {
+	s.mu.Lock()
+	running, ok := s.running[jobId]
+	s.mu.Unlock()
+	// 他のユーザーの実行中のジョブは、終了済みのジョブと同じくnot foundになる
+	if ok && running.userId == userId {
+		if events, ok := running.subscribe(); ok {
+			return events, func() { running.unsubscribe(events) }, nil
+		}
+	}
+
+	// 終了済みのジョブは、終了イベントを保存した後に購読者を閉じるため、DBの値が最新になる
+	job, err := s.jobRepository.FindById(jobId, userId)
+	if err != nil {
+		return nil, nil, err
+	}
+	events := make(chan dto.ImportProgressEvent, 1)
+	events <- newProgressEvent(job.Status, job, nil)
+	close(events)
+	return events, func() {}, nil
+}
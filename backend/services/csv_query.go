@@ -0,0 +1,202 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"project/dto"
+	"project/models"
+	"project/repositories"
+)
+
+// 連絡先の検索・出力の条件が不正な場合のエラー
+var ErrInvalidCsvQuery = errors.New("invalid query")
+
+// 一覧の1ページの件数の初期値
+const defaultCsvPageLimit = 50
+
+// 並び替えに使える列と、カーソルに記録する列の値
+var csvSortValues = map[string]func(csv *models.Csv) any{
+	"id":           func(csv *models.Csv) any { return csv.ID },
+	"first_name":   func(csv *models.Csv) any { return csv.FirstName },
+	"last_name":    func(csv *models.Csv) any { return csv.LastName },
+	"email":        func(csv *models.Csv) any { return csv.Email },
+	"phone_number": func(csv *models.Csv) any { return csv.PhoneNumber },
+	"address":      func(csv *models.Csv) any { return csv.Address },
+	"city":         func(csv *models.Csv) any { return csv.City },
+	"state":        func(csv *models.Csv) any { return csv.State },
+	"zip_code":     func(csv *models.Csv) any { return csv.ZipCode },
+	"country":      func(csv *models.Csv) any { return csv.Country },
+	"created_at":   func(csv *models.Csv) any { return csv.CreatedAt },
+	"updated_at":   func(csv *models.Csv) any { return csv.UpdatedAt },
+}
+
+// クライアントに返すカーソルの中身, 並び順が変わった場合に誤ったページを返さないよう並び順も記録する
+type csvPageCursor struct {
+	Sort  string          `json:"s"`
+	Value json.RawMessage `json:"v"`
+	ID    uint            `json:"id"`
+}
+
+// 条件に一致する連絡先を1ページ分取得する
+// オフセット方式とカーソル方式のどちらでも、次のページのカーソルを返す
+func (s *CsvService) FindCsvs(ctx context.Context, input dto.FindCsvsInput, userId uint) (*dto.CsvPageOutput, error) {
+	return s.findCsvs(ctx, input, userId, false)
+}
+
+// 論理削除した連絡先を1ページ分取得する, 条件はFindCsvsと同じ
+func (s *CsvService) FindDeletedCsvs(ctx context.Context, input dto.FindCsvsInput, userId uint) (*dto.CsvPageOutput, error) {
+	return s.findCsvs(ctx, input, userId, true)
+}
+
+func (s *CsvService) findCsvs(ctx context.Context, input dto.FindCsvsInput, userId uint, deleted bool) (*dto.CsvPageOutput, error) {
+	filter, err := toCsvFilter(input.CsvFilterInput, userId)
+	if err != nil {
+		return nil, err
+	}
+	query := repositories.CsvQuery{
+		Filter:  filter,
+		Search:  strings.TrimSpace(input.Q),
+		Prefix:  input.Match == "prefix",
+		Sort:    strings.TrimPrefix(input.Sort, "-"),
+		Desc:    strings.HasPrefix(input.Sort, "-"),
+		Limit:   input.Limit,
+		Offset:  input.Offset,
+		Deleted: deleted,
+	}
+	if query.Sort == "" {
+		query.Sort = "id"
+	}
+	if _, ok := csvSortValues[query.Sort]; !ok {
+		return nil, fmt.Errorf("%w: unsupported sort column: %s", ErrInvalidCsvQuery, query.Sort)
+	}
+	if query.Limit == 0 {
+		query.Limit = defaultCsvPageLimit
+	}
+	if input.Cursor != "" {
+		if input.Offset > 0 {
+			return nil, fmt.Errorf("%w: offset and cursor cannot be used together", ErrInvalidCsvQuery)
+		}
+		if query.After, err = decodeCsvCursor(input.Cursor, query.Sort); err != nil {
+			return nil, err
+		}
+	}
+
+	total, err := s.repository.CountCsvs(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	// 次のページがあるか判定するため1件多く取得する
+	limit := query.Limit
+	query.Limit++
+	csvs, err := s.repository.FindCsvs(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &dto.CsvPageOutput{Records: csvs, Total: total, Limit: limit, Offset: input.Offset}
+	if len(csvs) > limit {
+		output.Records = csvs[:limit]
+		if output.NextCursor, err = encodeCsvCursor(&csvs[limit-1], query.Sort); err != nil {
+			return nil, err
+		}
+	}
+	return output, nil
+}
+
+// IDで連絡先を取得
+func (s *CsvService) FindCsvById(ctx context.Context, csvId uint, userId uint) (*models.Csv, error) {
+	return s.repository.FindCsvById(ctx, csvId, userId)
+}
+
+// ページの最後の行からカーソルを作成する
+func encodeCsvCursor(csv *models.Csv, sort string) (string, error) {
+	value, err := json.Marshal(csvSortValues[sort](csv))
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(csvPageCursor{Sort: sort, Value: value, ID: csv.ID})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// カーソルを解析し、列の型に合わせた値に戻す
+func decodeCsvCursor(cursor string, sort string) (*repositories.CsvCursor, error) {
+	invalid := fmt.Errorf("%w: invalid cursor", ErrInvalidCsvQuery)
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, invalid
+	}
+	var decoded csvPageCursor
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, invalid
+	}
+	if decoded.Sort != sort {
+		return nil, fmt.Errorf("%w: cursor was created with a different sort", ErrInvalidCsvQuery)
+	}
+
+	after := &repositories.CsvCursor{ID: decoded.ID}
+	switch sort {
+	case "id":
+		after.Value = decoded.ID
+	case "created_at", "updated_at":
+		var value time.Time
+		if err := json.Unmarshal(decoded.Value, &value); err != nil {
+			return nil, invalid
+		}
+		after.Value = value
+	default:
+		var value string
+		if err := json.Unmarshal(decoded.Value, &value); err != nil {
+			return nil, invalid
+		}
+		after.Value = value
+	}
+	return after, nil
+}
+
+// 絞り込みの条件をリポジトリの条件に変換する, userIdのユーザーの連絡先だけを対象にする
+func toCsvFilter(input dto.CsvFilterInput, userId uint) (repositories.CsvFilter, error) {
+	filter := repositories.CsvFilter{
+		UserID:      userId,
+		FirstName:   input.FirstName,
+		LastName:    input.LastName,
+		Email:       input.Email,
+		PhoneNumber: input.PhoneNumber,
+		Address:     input.Address,
+		City:        input.City,
+		State:       input.State,
+		ZipCode:     input.ZipCode,
+		Country:     input.Country,
+		// 他のユーザーの記録のIDを指定しても、所有者で絞り込むため一致しない
+		ImportBatchID: input.ImportBatchID,
+	}
+	var err error
+	if filter.CreatedFrom, err = parseTimeFilter("created_from", input.CreatedFrom); err != nil {
+		return filter, err
+	}
+	if filter.CreatedTo, err = parseTimeFilter("created_to", input.CreatedTo); err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+// 日付("2006-01-02")またはRFC3339の日時を解析する, 空の場合はnilを返す
+func parseTimeFilter(name string, value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	for _, layout := range []string{time.DateOnly, time.RFC3339} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s must be a date (2006-01-02) or an RFC3339 timestamp", ErrInvalidCsvQuery, name)
+}
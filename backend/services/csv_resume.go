@@ -0,0 +1,163 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+
+	"project/models"
+)
+
+// 中断していないジョブや、取り込みを取り消したジョブを再開しようとした場合のエラー
+var ErrJobNotResumable = errors.New("import job is not resumable")
+
+// 保存したファイルが削除されていて再開できない場合のエラー
+var ErrImportUploadMissing = errors.New("uploaded file of import job is no longer available")
+
+// 起動時に、前回の終了時に実行中だったジョブを中断したものとして記録する, 中断したジョブはResumeJobで再開できる
+// あわせて、期限切れのアップロードを破棄する
+func (s *CsvService) InterruptJobs() error {
+	interrupted, err := s.jobRepository.MarkInterrupted("import was interrupted by server restart")
+	if err != nil {
+		return err
+	}
+	if interrupted > 0 {
+		log.Printf("%d import jobs were interrupted by server restart", interrupted)
+	}
+	return s.expireUploads()
+}
+
+// 中断したジョブを同じジョブIDのまま再開する
+// 保存したファイルを開き直し、登録が確定した位置まで読み飛ばしてから続きを取り込む
+// 中断前のエラー行は保存されていないため、件数だけを引き継ぐ
+func (s *CsvService) ResumeJob(ctx context.Context, jobId uint, userId uint) (*models.ImportJob, error) {
+	job, err := s.jobRepository.FindById(jobId, userId)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	_, running := s.running[job.ID]
+	s.mu.Unlock()
+	if running || job.Status != models.ImportJobStatusInterrupted {
+		return nil, ErrJobNotResumable
+	}
+	batches, err := s.jobRepository.FindBatches(job.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, batch := range batches {
+		if batch.RolledBackAt != nil {
+			return nil, ErrJobNotResumable
+		}
+	}
+
+	prepared, err := s.prepareResume(ctx, job, batches)
+	if err != nil {
+		return nil, err
+	}
+	// 同時に再開された場合は先に再開した方だけを実行する
+	resumed, err := s.jobRepository.MarkResumed(job.ID)
+	if err != nil || !resumed {
+		prepared.close()
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrJobNotResumable
+	}
+
+	job.Status = models.ImportJobStatusPending
+	job.FinishedAt = nil
+	job.ErrorSummary = ""
+	s.launch(*job, prepared)
+	return job, nil
+}
+
+// 取り込むファイルの記録から、中断した位置以降を取り込む準備をする
+// zipの場合は中断前に終了したファイルを取り込み済みとして扱い、その件数を引き継ぐ
+func (s *CsvService) prepareResume(ctx context.Context, job *models.ImportJob, batches []models.ImportBatch) (_ *preparedImport, err error) {
+	prepared := &preparedImport{archive: job.Format == models.ImportFormatZip}
+	defer func() {
+		if err != nil {
+			prepared.close()
+		}
+	}()
+
+	if !prepared.archive {
+		if len(batches) == 0 {
+			return nil, ErrImportUploadMissing
+		}
+		upload, err := openUpload(batches[0], job.Encoding, s.config.MaxUncompressedSize)
+		if err != nil {
+			return nil, err
+		}
+		prepared.entries = []importEntry{{upload: upload, batch: batches[0]}}
+	} else {
+		// zip内のファイルの記録は取り込めるファイルだけを登録順に作成している
+		pending := make(map[string][]models.ImportBatch)
+		for _, batch := range batches {
+			pending[batch.FileName] = append(pending[batch.FileName], batch)
+		}
+		for _, file := range job.Files {
+			entry := importEntry{file: file}
+			if candidates := pending[file.FileName]; len(candidates) > 0 {
+				entry.batch, pending[file.FileName] = candidates[0], candidates[1:]
+			}
+			if entry.batch.ID == 0 || file.Status == models.ImportJobStatusCompleted || file.Status == models.ImportJobStatusFailed {
+				// 終了したファイルは取り込み直さない
+				if entry.batch.UploadPath != "" {
+					os.Remove(entry.batch.UploadPath)
+				}
+				prepared.counts.read += int64(file.TotalRows)
+				prepared.counts.inserted += int64(file.InsertedRows)
+				prepared.counts.updated += int64(file.UpdatedRows)
+				prepared.counts.skipped += int64(file.SkippedRows)
+				prepared.counts.failed += int64(file.FailedRows)
+			} else if entry.upload, err = openUpload(entry.batch, file.Encoding, s.config.MaxUncompressedSize); err != nil {
+				return nil, err
+			}
+			prepared.entries = append(prepared.entries, entry)
+		}
+	}
+
+	// 登録が確定した位置から再開する, それ以降に登録済みの行は登録せずに件数だけを数える
+	checkpoint := job.Checkpoint
+	for i := range prepared.entries {
+		entry := &prepared.entries[i]
+		if entry.upload == nil {
+			continue
+		}
+		if checkpoint != nil && checkpoint.BatchID == entry.batch.ID {
+			finished := prepared.counts
+			entry.resumeFrom = &finished
+			entry.resumeLine = checkpoint.Line
+			entry.resumeOffset = checkpoint.Offset
+			prepared.counts = checkpointCounts(checkpoint)
+		}
+		if entry.committed, err = s.repository.FindImportedLines(ctx, entry.batch.ID, entry.resumeLine); err != nil {
+			return nil, err
+		}
+	}
+	return prepared, nil
+}
+
+// 保存したファイルを開き直し、記録した設定で読み込めるようにする
+func openUpload(batch models.ImportBatch, encoding string, maxPartSize int64) (*preparedUpload, error) {
+	upload := &preparedUpload{encoding: encoding, sha256: batch.Sha256, maxPartSize: maxPartSize}
+	if batch.UploadPath == "" {
+		return nil, ErrImportUploadMissing
+	}
+	if err := json.Unmarshal([]byte(batch.Options), &upload.input); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(batch.UploadPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrImportUploadMissing
+	}
+	if err != nil {
+		return nil, err
+	}
+	upload.file = file
+	return upload, nil
+}
@@ -0,0 +1,70 @@
+package services
+
+import (
+	"context"
+	"errors"
+
+	"project/dto"
+	"project/repositories"
+)
+
+// 既に取り消した取り込みを取り消そうとした場合のエラー
+var ErrBatchRolledBack = repositories.ErrBatchRolledBack
+
+// 取り込み中のファイルを取り消そうとした場合のエラー
+var ErrBatchImportRunning = errors.New("import batch is still being imported")
+
+// 取り込みで登録した連絡先を削除し、上書き・マージした連絡先を取り込み前の値に戻す
+// 後の取り込みで更新された連絡先は後の取り込みの値を残す
+// ドライランの場合は取り消さずに、対象の件数と先頭の行を返す
+func (s *CsvService) RollbackBatch(ctx context.Context, batchId uint, input dto.RollbackImportInput, userId uint) (*dto.ImportRollbackOutput, error) {
+	if input.Mode == "" {
+		input.Mode = "soft"
+	}
+	if input.PreviewLimit == 0 {
+		input.PreviewLimit = defaultPreviewLimit
+	}
+	hard := input.Mode == "hard"
+
+	batch, err := s.jobRepository.FindBatchById(batchId, userId)
+	if err != nil {
+		return nil, err
+	}
+	if batch.RolledBackAt != nil {
+		return nil, ErrBatchRolledBack
+	}
+	// 取り込み中の行は取り消しの対象を確定できない
+	s.mu.Lock()
+	_, running := s.running[batch.ImportJobID]
+	s.mu.Unlock()
+	if running {
+		return nil, ErrBatchImportRunning
+	}
+
+	output := &dto.ImportRollbackOutput{Batch: batch, Mode: input.Mode, DryRun: input.DryRun}
+	if input.DryRun {
+		plan, err := s.repository.PlanBatchRollback(ctx, batchId, userId, hard, input.PreviewLimit)
+		if err != nil {
+			return nil, err
+		}
+		output.DeleteRows, output.RestoreRows, output.SupersededRows = plan.Deleted, plan.Restored, plan.Superseded
+		output.Records = make([]dto.RollbackRecord, 0, len(plan.DeleteSamples)+len(plan.RestoreSamples))
+		for _, csv := range plan.DeleteSamples {
+			output.Records = append(output.Records, dto.RollbackRecord{Action: "delete", Contact: csv})
+		}
+		for _, sample := range plan.RestoreSamples {
+			previous := sample.Previous
+			output.Records = append(output.Records, dto.RollbackRecord{Action: "restore", Contact: sample.Current, Previous: &previous})
+		}
+		return output, nil
+	}
+
+	// 取り消しの日時はリポジトリ層で行の削除・復元と同じトランザクションで記録する
+	result, err := s.repository.RollbackBatch(ctx, batchId, userId, hard)
+	if err != nil {
+		return nil, err
+	}
+	output.DeleteRows, output.RestoreRows, output.SupersededRows = result.Deleted, result.Restored, result.Superseded
+	batch.RolledBackAt = &result.RolledBackAt
+	return output, nil
+}
@@ -1,101 +1,1146 @@
 package services
 
 import (
+	"context"
 	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"project/dto"
 	"project/models"
 	"project/repositories"
 )
 
 // インターフェースを定義
+// userIdはリクエストしたユーザーで、連絡先・ジョブはそのユーザーのものだけを対象にする
 type ICsvService interface {
-	ProcessCsv() error
+	StartImport(reader io.Reader, fileName string, input dto.ImportCsvInput, userId uint) (*models.ImportJob, error)
+	PreviewImport(ctx context.Context, reader io.Reader, input dto.ImportCsvInput, userId uint) (*dto.ImportPreviewOutput, error)
+	FindAllJobs(userId uint) (*[]models.ImportJob, error)
+	FindJobById(jobId uint, userId uint) (*models.ImportJob, error)
+	CancelJob(jobId uint, userId uint) (*models.ImportJob, error)
+	SubscribeJob(jobId uint, userId uint) (<-chan dto.ImportProgressEvent, func(), error)
+	FindRejectedRows(jobId uint, userId uint) (*[]models.ImportRejectedRow, error)
+	WriteRejectedRowsCsv(jobId uint, fileName string, userId uint, writer io.Writer) error
+	ExportCsv(ctx context.Context, input dto.ExportCsvInput, userId uint, writer io.Writer) error
+	FindCsvs(ctx context.Context, input dto.FindCsvsInput, userId uint) (*dto.CsvPageOutput, error)
+	FindCsvById(ctx context.Context, csvId uint, userId uint) (*models.Csv, error)
+	CreateCsv(ctx context.Context, input dto.CreateCsvInput, userId uint) (*models.Csv, error)
+	UpdateCsv(ctx context.Context, csvId uint, input dto.UpdateCsvInput, userId uint) (*models.Csv, error)
+	DeleteCsv(ctx context.Context, csvId uint, userId uint) error
+	FindDeletedCsvs(ctx context.Context, input dto.FindCsvsInput, userId uint) (*dto.CsvPageOutput, error)
+	RestoreCsv(ctx context.Context, csvId uint, userId uint) (*models.Csv, error)
+	PurgeCsv(ctx context.Context, csvId uint, userId uint) error
+	FindAllBatches(userId uint) (*[]models.ImportBatch, error)
+	FindBatchById(batchId uint, userId uint) (*models.ImportBatch, error)
+	FindBatchCsvs(ctx context.Context, batchId uint, input dto.FindCsvsInput, userId uint) (*dto.CsvPageOutput, error)
+	FindCsvProvenance(ctx context.Context, csvId uint, userId uint) (*dto.CsvProvenanceOutput, error)
+	RollbackBatch(ctx context.Context, batchId uint, input dto.RollbackImportInput, userId uint) (*dto.ImportRollbackOutput, error)
+	ResumeJob(ctx context.Context, jobId uint, userId uint) (*models.ImportJob, error)
+	CreateUpload(fileName string, contentType string, length int64, userId uint) (*models.ImportUpload, error)
+	FindUploadById(uploadId uint, userId uint) (*models.ImportUpload, error)
+	AppendUpload(uploadId uint, offset int64, reader io.Reader, userId uint) (*models.ImportUpload, error)
+	FinalizeUpload(uploadId uint, checksum []byte, input dto.ImportCsvInput, userId uint) (*models.ImportJob, error)
+	// サーバーの起動時に1回だけ呼び出す
+	InterruptJobs() error
 }
 
+const (
+	// 取り込み中のジョブの進捗をDBに保存する間隔
+	progressInterval = time.Second
+	// ジョブごとに保存するエラー行の上限
+	maxStoredRejects = 10000
+)
+
+// データ行が1行も無い場合のエラー
+var ErrEmptyCsv = errors.New("csv has no records")
+
+// 終了済みのジョブをキャンセルしようとした場合のエラー
+var ErrJobNotRunning = errors.New("import job is not running")
+
+// zipのジョブのエラー行をCSVで出力する際に、ファイルが指定されていない場合のエラー
+var ErrImportFileRequired = errors.New("file is required for archive imports")
+
 // 構造体を定義
 type CsvService struct {
-	repository repositories.ICsvRepository
-	filePath   string
+	repository    repositories.ICsvRepository
+	jobRepository repositories.IImportJobRepository
+	config        CsvImportConfig
+	// バックグラウンドのジョブの親になるcontext, サーバーの終了時にキャンセルされる
+	ctx context.Context
+	// 実行中のジョブと、データを書き込み中のアップロード
+	mu        sync.Mutex
+	running   map[uint]*runningJob
+	uploading map[uint]bool
+}
+
+// 実行中のジョブをキャンセルするための情報と、進捗イベントの購読者
+type runningJob struct {
+	// ジョブを登録したユーザー, 他のユーザーには進捗を送信しない
+	userId uint
+	cancel context.CancelFunc
+	// ジョブの終了時にcloseされる
+	done chan struct{}
+
+	mu          sync.Mutex
+	subscribers map[chan dto.ImportProgressEvent]struct{}
+	// 終了イベントを送信済みかどうか
+	finished bool
 }
 
 // コンストラクタを定義
-func NewCsvService(repository repositories.ICsvRepository, filePath string) ICsvService {
-	return &CsvService{repository: repository, filePath: filePath}
-}
-
-// ワーカー関数
-func worker(jobs <-chan []string, results chan<- error, repository repositories.ICsvRepository, wg *sync.WaitGroup) {
-	defer wg.Done()
-	for record := range jobs {
-		// CSVデータを構造体に変換
-		csvData := models.Csv{
-			FirstName:   record[1],
-			LastName:    record[2],
-			Email:       record[3],
-			PhoneNumber: record[4],
-			Address:     record[5],
-			City:        record[6],
-			State:       record[7],
-			ZipCode:     record[8],
-			Country:     record[9],
-		}
-		// リポジトリ層のCreateCsvメソッドを呼び出し,以降の処理はリポジトリ層に委ねる
-		_, err := repository.CreateCsv(csvData)
-		results <- err
-	}
-}
-
-// CSVファイルを読み込み、リポジトリ層のCreateCsvメソッドにデータを渡す
-func (s *CsvService) ProcessCsv() error {
-	// CSVファイルを開く
-	file, err := os.Open(s.filePath)
+// ctxがキャンセルされると実行中の全てのジョブを中断する, configはリクエストで上書きされなかった場合の設定になる
+func NewCsvService(ctx context.Context, repository repositories.ICsvRepository, jobRepository repositories.IImportJobRepository, config CsvImportConfig) ICsvService {
+	return &CsvService{
+		repository:    repository,
+		jobRepository: jobRepository,
+		config:        config,
+		ctx:           ctx,
+		running:       make(map[uint]*runningJob),
+		uploading:     make(map[uint]bool),
+	}
+}
+
+// 取り込みの進捗, ワーカーと集計用のgoroutineから同時に更新されるためatomicで保持する
+type importProgress struct {
+	read     atomic.Int64
+	inserted atomic.Int64
+	updated  atomic.Int64
+	skipped  atomic.Int64
+	failed   atomic.Int64
+	// 読み込んだバイト数とファイル全体のバイト数, 残り時間の見積もりに利用する
+	bytesRead  atomic.Int64
+	totalBytes int64
+	// zipの場合に取り込み済みのファイルの合計バイト数, 取り込み中のファイルの読み込んだ位置に加算する
+	bytesDone int64
+	startedAt time.Time
+	// 稼働中のワーカーの数
+	workers atomic.Int64
+	// 中断した場合に再開する位置, 集計用のgoroutineから更新する
+	mu         sync.Mutex
+	checkpoint *models.ImportCheckpoint
+}
+
+// ある時点での件数, zip内のファイルごとの件数を差分から求める
+type importCounts struct {
+	read, inserted, updated, skipped, failed int64
+}
+
+func (p *importProgress) counts() importCounts {
+	return importCounts{
+		read:     p.read.Load(),
+		inserted: p.inserted.Load(),
+		updated:  p.updated.Load(),
+		skipped:  p.skipped.Load(),
+		failed:   p.failed.Load(),
+	}
+}
+
+// 件数を指定した値に戻す
+func (p *importProgress) store(counts importCounts) {
+	p.read.Store(counts.read)
+	p.inserted.Store(counts.inserted)
+	p.updated.Store(counts.updated)
+	p.skipped.Store(counts.skipped)
+	p.failed.Store(counts.failed)
+}
+
+func (p *importProgress) setCheckpoint(checkpoint *models.ImportCheckpoint) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.checkpoint = checkpoint
+}
+
+func (p *importProgress) loadCheckpoint() *models.ImportCheckpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.checkpoint
+}
+
+// 取り込み元のline行目(ファイルのoffsetバイト目)までの登録が確定した時点の件数から、再開する位置を作成する
+func newCheckpoint(batchId uint, line int, offset int64, counts importCounts) *models.ImportCheckpoint {
+	return &models.ImportCheckpoint{
+		BatchID:      batchId,
+		Line:         line,
+		Offset:       offset,
+		ReadRows:     int(counts.read),
+		InsertedRows: int(counts.inserted),
+		UpdatedRows:  int(counts.updated),
+		SkippedRows:  int(counts.skipped),
+		FailedRows:   int(counts.failed),
+	}
+}
+
+// 再開する位置に記録された件数
+func checkpointCounts(checkpoint *models.ImportCheckpoint) importCounts {
+	return importCounts{
+		read:     int64(checkpoint.ReadRows),
+		inserted: int64(checkpoint.InsertedRows),
+		updated:  int64(checkpoint.UpdatedRows),
+		skipped:  int64(checkpoint.SkippedRows),
+		failed:   int64(checkpoint.FailedRows),
+	}
+}
+
+// 進捗をジョブに反映する
+func applyProgress(job *models.ImportJob, progress *importProgress) {
+	job.TotalRows = int(progress.read.Load())
+	job.InsertedRows = int(progress.inserted.Load())
+	job.UpdatedRows = int(progress.updated.Load())
+	job.SkippedRows = int(progress.skipped.Load())
+	job.FailedRows = int(progress.failed.Load())
+	job.Checkpoint = progress.loadCheckpoint()
+}
+
+// CSVの1行分のデータと、ファイル内での行番号
+type csvRecord struct {
+	line   int
+	fields []string
+	// 中断したジョブを再開した場合に、中断前に登録済みだった行, 登録せずに件数だけを数える
+	committed bool
+	// committedの場合に、既存の連絡先を更新した行かどうか
+	updated bool
+	// 読み込めなかった行のエラー, 検証せずに取り込めない行とする
+	errs []models.ImportRowError
+}
+
+// 読み込んだ行を作成する, その行だけが不正な場合はエラーを記録して取り込めない行にする
+// それ以外のエラーは読み込みを続けられないためそのまま返す
+func newCsvRecord(records recordReader, fields []string, err error) (csvRecord, error) {
+	record := csvRecord{line: records.Line(), fields: fields}
+	var invalid *invalidRecordError
+	if errors.As(err, &invalid) {
+		record.fields = invalid.fields
+		record.errs = []models.ImportRowError{{Reason: invalid.reason}}
+		return record, nil
+	}
+	return record, err
+}
+
+// ワーカーに渡す1バッチ分のレコード
+type recordBatch struct {
+	// 読み込んだ順番, 再開する位置を先頭から途切れずに登録できたバッチまでにするため利用する
+	seq     int
+	records []csvRecord
+	// 最後の行を読み終えた位置
+	offset int64
+	// 同じメールアドレスの行を含む先のバッチの登録の完了, 全て閉じられるまで登録を待つ
+	after []chan struct{}
+	// このバッチの登録が終わったら閉じる
+	done chan struct{}
+}
+
+// 複数のワーカーで登録しても、同じメールアドレスの行をファイル内の順番どおりに登録するための記録
+// メールアドレスごとに、最後にそのメールアドレスを含めたバッチの登録の完了を通知するチャネルを保持する
+// 読み込み用のgoroutineからだけ利用する
+type emailOrder struct {
+	mapping *columnMapping
+	last    map[string]chan struct{}
+	// 記録がこの件数を超えたら、登録が終わったバッチの記録を削除する
+	sweepAt int
+	minSize int
+}
+
+func newEmailOrder(mapping *columnMapping, batchSize int) *emailOrder {
+	return &emailOrder{mapping: mapping, last: make(map[string]chan struct{}), sweepAt: batchSize, minSize: batchSize}
+}
+
+// バッチを作成し、同じメールアドレスの行を含む登録中の先のバッチを待つように設定する
+func (o *emailOrder) batch(seq int, records []csvRecord, offset int64) recordBatch {
+	batch := recordBatch{seq: seq, records: records, offset: offset, done: make(chan struct{})}
+	waiting := make(map[chan struct{}]bool)
+	for _, record := range records {
+		if record.committed || len(record.errs) > 0 {
+			continue
+		}
+		email := o.mapping.email(record.fields)
+		if done, ok := o.last[email]; ok && done != batch.done && !waiting[done] && !isClosed(done) {
+			waiting[done] = true
+			batch.after = append(batch.after, done)
+		}
+		o.last[email] = batch.done
+	}
+	// 登録が終わったバッチのメールアドレスは待つ必要がないため、記録がファイルの行数に比例して増えないように削除する
+	if len(o.last) > o.sweepAt {
+		for email, done := range o.last {
+			if isClosed(done) {
+				delete(o.last, email)
+			}
+		}
+		o.sweepAt = max(2*len(o.last), o.minSize)
+	}
+	return batch
+}
+
+// チャネルが閉じられているかどうか
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// ワーカーの処理結果, バッチ単位で返す
+type batchResult struct {
+	counts   repositories.CsvUpsertResult
+	rejected []models.ImportRejectedRow
+	// 元のバッチの順番・行数と、最後の行の行番号・位置
+	seq    int
+	rows   int
+	line   int
+	offset int64
+}
+
+func (r *batchResult) add(counts repositories.CsvUpsertResult) {
+	r.counts.Inserted += counts.Inserted
+	r.counts.Updated += counts.Updated
+	r.counts.Skipped += counts.Skipped
+}
+
+// 1回の取り込みで全てのワーカーが共有する設定
+type importRun struct {
+	ctx        context.Context
+	repository repositories.ICsvRepository
+	mapping    *columnMapping
+	onConflict string
+	// 取り込んだ行の所有者と取り込み元
+	userId  uint
+	batchId uint
+	// 再開した場合に読み飛ばす、登録が確定した位置までの行番号と、それ以降で登録済みの行
+	resumeLine int
+	committed  map[int]bool
+	// 全ての行を1つのトランザクションで登録するかどうか
+	atomic bool
+	// atomicの場合、取り込めない行が見つかった時点でロールバックが確定するため、以降の行は検証だけ行う
+	aborted atomic.Bool
+	// ワーカーの数を調整するための登録の統計
+	stats writeStats
+}
+
+// 1バッチ分のレコードを検証し、正しい行だけをまとめて登録する
+func (run *importRun) insertBatch(batch recordBatch) batchResult {
+	defer close(batch.done)
+	records := batch.records
+	result := batchResult{seq: batch.seq, rows: len(records), offset: batch.offset}
+	if len(records) > 0 {
+		result.line = records[len(records)-1].line
+	}
+	csvs := make([]models.Csv, 0, len(records))
+	valid := make([]csvRecord, 0, len(records))
+	for _, record := range records {
+		if record.committed {
+			if record.updated {
+				result.counts.Updated++
+			} else {
+				result.counts.Inserted++
+			}
+			continue
+		}
+		if len(record.errs) > 0 {
+			result.rejected = append(result.rejected, rejectRow(record, record.errs...))
+			continue
+		}
+		// ヘッダーの列の対応に従ってCSVデータを構造体に変換
+		csv := run.mapping.toCsv(record.fields)
+		csv.UserID = run.userId
+		csv.ImportBatchID = &run.batchId
+		csv.SourceLine = record.line
+		if errs := validateCsv(csv); len(errs) > 0 {
+			result.rejected = append(result.rejected, rejectRow(record, errs...))
+			continue
+		}
+		csvs = append(csvs, csv)
+		valid = append(valid, record)
+	}
+	// 同じメールアドレスの行を含む先のバッチの登録が終わるまで待つ
+	for _, done := range batch.after {
+		select {
+		case <-done:
+		case <-run.ctx.Done():
+			return result
+		}
+	}
+	if run.aborted.Load() {
+		return result
+	}
+
+	// 同じメールアドレスの行が1回の登録に含まれないように分割し、ファイル内の順番どおりに登録する
+	start := 0
+	seen := make(map[string]bool)
+	for i, csv := range csvs {
+		if seen[csv.Email] {
+			run.insertChunk(csvs[start:i], valid[start:i], &result)
+			start = i
+			seen = make(map[string]bool)
+		}
+		seen[csv.Email] = true
+	}
+	run.insertChunk(csvs[start:], valid[start:], &result)
+
+	if run.atomic && len(result.rejected) > 0 {
+		run.aborted.Store(true)
+	}
+	return result
+}
+
+// メールアドレスが重複しない行をまとめて登録する
+func (run *importRun) insertChunk(csvs []models.Csv, records []csvRecord, result *batchResult) {
+	if len(csvs) == 0 {
+		return
+	}
+	start := time.Now()
+	counts, err := run.write(csvs)
+	// キャンセルによって失敗した場合は行のエラーとして扱わない
+	if err != nil && run.ctx.Err() != nil {
+		return
+	}
+	run.stats.record(len(csvs), time.Since(start), err != nil)
+	if err == nil {
+		result.add(counts)
+		return
+	}
+
+	// まとめて登録できなかった場合は、原因の行を特定するため1件ずつ登録し直す
+	for i := range csvs {
+		counts, err := run.write(csvs[i : i+1])
+		if err != nil {
+			result.rejected = append(result.rejected, rejectRow(records[i], models.ImportRowError{Reason: err.Error()}))
+			continue
+		}
+		result.add(counts)
+	}
+}
+
+// 重複時の扱いに応じてリポジトリ層のメソッドを呼び出し,以降の処理はリポジトリ層に委ねる
+func (run *importRun) write(csvs []models.Csv) (repositories.CsvUpsertResult, error) {
+	if run.onConflict == models.OnConflictFail {
+		// 重複を考慮しなくてよいため、最も速いCOPY FROMで登録する
+		if err := run.repository.CopyCsvs(run.ctx, csvs); err != nil {
+			return repositories.CsvUpsertResult{}, err
+		}
+		return repositories.CsvUpsertResult{Inserted: len(csvs)}, nil
+	}
+	return run.repository.UpsertCsvs(run.ctx, csvs, run.onConflict)
+}
+
+// 取り込めなかった行を作成する
+func rejectRow(record csvRecord, errs ...models.ImportRowError) models.ImportRejectedRow {
+	return models.ImportRejectedRow{Line: record.line, Record: record.fields, Errors: errs}
+}
+
+// 受け取った行を取り込む, ファイルのオープン・クローズは呼び出し側の責務とする
+// 部分取り込み(input.Partial)が指定されていない場合は、全ての行を1つのトランザクションで登録し、
+// 1行でも取り込めない行があれば全ての行をロールバックする
+// ctxがキャンセルされた場合は読み込みと登録を中断してctx.Err()を返す
+// inputのヘッダー行はprepareUploadで決定済みであることを前提とする
+// 再開した場合は、entry.resumeLineまでの行を読み飛ばし、それ以降の登録済みの行は件数だけを数える
+func (s *CsvService) processCsv(ctx context.Context, records recordReader, entry *importEntry, progress *importProgress) ([]models.ImportRejectedRow, error) {
+	input := entry.upload.input
+	// ヘッダーから列の対応を作成する
+	_, mapping, err := readHeader(records, input.HeaderRow)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	// 登録が確定した位置まで読み飛ばす, 途中から読み込めない形式はrunWorkersで1行ずつ読み飛ばす
+	if entry.resumeOffset > 0 {
+		seeked, ok, err := entry.upload.seek(entry.resumeOffset)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			records = seeked
+		}
+	}
+	run := &importRun{
+		ctx:        ctx,
+		repository: s.repository,
+		mapping:    mapping,
+		onConflict: input.OnConflict,
+		userId:     entry.batch.UserID,
+		batchId:    entry.batch.ID,
+		resumeLine: entry.resumeLine,
+		committed:  entry.committed,
 	}
-	// 関数の終了時にファイルを閉じる
-	defer file.Close()
+	config := s.config.withInput(input)
+	// zipの場合は前のファイルまでの件数が含まれるため、このファイルの件数は差分で数える
+	before := progress.counts()
 
-	// CSVファイルを読み込む
-	reader := csv.NewReader(file)
+	if input.Partial {
+		return s.runWorkers(records, run, config, progress)
+	}
 
-	// CSVファイルのヘッダーを読み込む
-	records, err := reader.ReadAll()
+	// 失敗した行を特定するため、atomicの場合の登録は1つのワーカーで順番に行う
+	run.atomic = true
+	config.Workers = 1
+	config.Adaptive = false
+	var rejected []models.ImportRejectedRow
+	if s.repository.LocksDatabaseOnWrite() {
+		rejected, err = s.runCompensated(records, run, config, progress, before)
+	} else {
+		err = s.repository.Transaction(ctx, func(repository repositories.ICsvRepository) error {
+			// 失敗した登録はセーブポイントまで戻す
+			run.repository = repository
+			rejected, err = s.runWorkers(records, run, config, progress)
+			if err != nil {
+				return err
+			}
+			return rejectedRowsError(progress, before)
+		})
+	}
 	if err != nil {
-		return err
+		// ロールバックしたため、このファイルで登録・更新した件数は0件になる
+		progress.inserted.Store(before.inserted)
+		progress.updated.Store(before.updated)
+		progress.skipped.Store(before.skipped)
+	}
+	return rejected, err
+}
+
+// このファイルで取り込めない行があった場合に、全ての行をロールバックしたことを示すエラーを返す
+func rejectedRowsError(progress *importProgress, before importCounts) error {
+	if failed := progress.failed.Load() - before.failed; failed > 0 {
+		return fmt.Errorf("import was rolled back because %d of %d rows were rejected", failed, progress.read.Load()-before.read)
+	}
+	return nil
+}
+
+// 書き込み中にDB全体がロックされる場合は、取り込みの間に進捗の更新や他のリクエストの書き込みが待たされないよう、
+// トランザクションを使わずにバッチごとに登録し、失敗した場合は取り込みを取り消して登録・更新した行を元に戻す
+// 取り消すまでの間は登録した行が他のリクエストから見える
+// サーバーの終了で中断した場合は、再開して続きから取り込めるよう取り消さない
+func (s *CsvService) runCompensated(records recordReader, run *importRun, config CsvImportConfig, progress *importProgress, before importCounts) ([]models.ImportRejectedRow, error) {
+	rejected, err := s.runWorkers(records, run, config, progress)
+	if err == nil {
+		err = rejectedRowsError(progress, before)
 	}
+	if err == nil || (errors.Is(err, context.Canceled) && s.ctx.Err() != nil) {
+		return rejected, err
+	}
+	// キャンセルされた場合も取り消せるよう、ctxのキャンセルを引き継がない
+	if _, rollbackErr := s.repository.RollbackBatch(context.WithoutCancel(run.ctx), run.batchId, run.userId, true); rollbackErr != nil {
+		return rejected, errors.Join(err, fmt.Errorf("failed to roll back import: %w", rollbackErr))
+	}
+	return rejected, err
+}
 
-	// ワーカーの数を設定
-	const numWorkers = 30
-	// ジョブキューと結果キューを作成
-	jobs := make(chan []string, len(records)-1)
-	// エラーを格納するチャネル
-	results := make(chan error, len(records)-1)
-	var wg sync.WaitGroup
+// 行を1行ずつ読み込み、config.BatchSize件ごとにワーカーへ渡す
+// ファイル全体をメモリに載せないため、ファイルサイズに関係なくメモリ使用量は一定になる
+// 不正な行は取り込まずに、先頭のmaxStoredRejects件を行番号順に返す
+func (s *CsvService) runWorkers(records recordReader, run *importRun, config CsvImportConfig, progress *importProgress) ([]models.ImportRejectedRow, error) {
+	// ジョブキューと結果キューを作成, バッファは固定長にする
+	jobs := make(chan recordBatch, config.QueueSize)
+	results := make(chan batchResult, config.QueueSize)
+	pool := newWorkerPool(run, jobs, results, progress)
 
-	// ワーカーを起動, numWorkersの数だけgoroutineを起動
-	for w := 1; w <= numWorkers; w++ {
-		wg.Add(1)
-		go worker(jobs, results, s.repository, &wg)
+	// ワーカーを起動, adaptiveの場合は1つから始めて登録の状況に応じて増減する
+	workers := config.Workers
+	if config.Adaptive {
+		workers = 1
+	}
+	for w := 1; w <= workers; w++ {
+		pool.grow()
 	}
+	stopAutoscale := make(chan struct{})
+	autoscaleStopped := make(chan struct{})
+	go func() {
+		defer close(autoscaleStopped)
+		if config.Adaptive {
+			pool.autoscale(config.Workers, stopAutoscale)
+		}
+	}()
+
+	// ワーカーの結果を逐次集計する, メモリを圧迫しないように保持するエラー行の件数には上限を設ける
+	// 部分取り込みの場合は、先頭から途切れずに登録できたバッチまでを再開する位置として記録する
+	var rejected []models.ImportRejectedRow
+	aggregated := make(chan struct{})
+	go func() {
+		defer close(aggregated)
+		pending := make(map[int]batchResult)
+		next := 0
+		committed := progress.counts()
+		for result := range results {
+			progress.inserted.Add(int64(result.counts.Inserted))
+			progress.updated.Add(int64(result.counts.Updated))
+			progress.skipped.Add(int64(result.counts.Skipped))
+			progress.failed.Add(int64(len(result.rejected)))
+			for _, row := range result.rejected {
+				if len(rejected) < maxStoredRejects {
+					rejected = append(rejected, row)
+				}
+			}
+
+			if run.atomic {
+				continue
+			}
+			pending[result.seq] = result
+			for done, ok := pending[next]; ok; done, ok = pending[next] {
+				delete(pending, next)
+				next++
+				committed.read += int64(done.rows)
+				committed.inserted += int64(done.counts.Inserted)
+				committed.updated += int64(done.counts.Updated)
+				committed.skipped += int64(done.counts.Skipped)
+				committed.failed += int64(len(done.rejected))
+				if done.line > 0 {
+					progress.setCheckpoint(newCheckpoint(run.batchId, done.line, done.offset, committed))
+				}
+			}
+		}
+	}()
 
-	// jobsチャネルcsvレコードを送信
-	for _, record := range records[1:] {
-		jobs <- record // jobsにrecordを送信
+	// CSVレコードを1件ずつ読み込み、config.BatchSize件たまったらjobsチャネルに送信する
+	// ワーカーの処理が追いつかない場合はキューが空くまで読み込みが待機する
+	var readErr error
+	read := 0
+	seq := 0
+	order := newEmailOrder(run.mapping, config.BatchSize)
+	batch := make([]csvRecord, 0, config.BatchSize)
+	for run.ctx.Err() == nil {
+		fields, err := records.Read()
+		if err == io.EOF {
+			break
+		}
+		record, err := newCsvRecord(records, fields, err)
+		if err != nil {
+			readErr = err
+			break
+		}
+		read++
+		progress.bytesRead.Store(progress.bytesDone + records.Offset())
+		// 再開した場合、登録が確定した位置までの行は中断前の件数に含まれている
+		if record.line <= run.resumeLine {
+			continue
+		}
+		if updated, ok := run.committed[record.line]; ok {
+			record.committed, record.updated = true, updated
+		}
+		batch = append(batch, record)
+		progress.read.Add(1)
+		if len(batch) == config.BatchSize {
+			select {
+			case jobs <- order.batch(seq, batch, records.Offset()):
+			case <-run.ctx.Done():
+			}
+			seq++
+			batch = make([]csvRecord, 0, config.BatchSize)
+		}
+	}
+	// 端数のレコードを送信する
+	if len(batch) > 0 && run.ctx.Err() == nil {
+		jobs <- order.batch(seq, batch, records.Offset())
 	}
 	close(jobs)
 
-	// ワーカーの終了を待つ
-	wg.Wait()
+	// ワーカーの数の調整を止め、ワーカーの終了を待ってから結果キューを閉じ、集計の完了を待つ
+	close(stopAutoscale)
+	<-autoscaleStopped
+	pool.wait()
 	close(results)
+	<-aggregated
+
+	sort.Slice(rejected, func(i, j int) bool { return rejected[i].Line < rejected[j].Line })
+
+	if err := run.ctx.Err(); err != nil {
+		return rejected, err
+	}
+	if readErr != nil {
+		return rejected, readErr
+	}
+	if read == 0 && run.resumeLine == 0 {
+		return rejected, ErrEmptyCsv
+	}
+
+	return rejected, nil
+}
+
+// アップロードされたデータを一時ファイルに保存し、バックグラウンドで取り込むジョブを登録する
+// ヘッダーが不正な場合は1行も登録せずにエラーを返す
+// gzipで圧縮されている場合は展開して取り込み、zipの場合は中のファイルごとに取り込んで結果をジョブのFilesに記録する
+func (s *CsvService) StartImport(reader io.Reader, fileName string, input dto.ImportCsvInput, userId uint) (job *models.ImportJob, err error) {
+	if input.OnConflict == "" {
+		input.OnConflict = models.OnConflictFail
+	}
 
-	// エラーチェック
-	for err := range results {
+	// ジョブを登録する前にヘッダーを検証する
+	prepared, err := s.prepareImport(reader, input, s.config.UploadDir)
+	if err != nil {
+		return nil, err
+	}
+	// ジョブを開始できなかった場合は一時ファイルを削除する
+	defer func() {
 		if err != nil {
+			prepared.remove()
+		}
+	}()
+
+	newJob := models.ImportJob{
+		UserID:     userId,
+		Status:     models.ImportJobStatusPending,
+		FileName:   fileName,
+		OnConflict: input.OnConflict,
+		Partial:    input.Partial,
+		Format:     input.Format,
+	}
+	applyPrepared(&newJob, prepared)
+	job, err = s.jobRepository.Create(newJob)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.registerPrepared(job, prepared); err != nil {
+		return nil, err
+	}
+
+	s.launch(*job, prepared)
+	return job, nil
+}
+
+// 準備の段階で決定したファイルの形式・文字コード・ヘッダーなどをジョブに記録する
+// zipの場合は中のファイルごとに異なるため、ImportJobFileに記録する
+func applyPrepared(job *models.ImportJob, prepared *preparedImport) {
+	if prepared.archive {
+		return
+	}
+	upload := prepared.entries[0].upload
+	job.Format = upload.input.Format
+	job.Encoding = upload.encoding
+	job.Delimiter = upload.input.Delimiter
+	job.Sheet = upload.input.Sheet
+	job.HeaderRow = upload.input.HeaderRow
+	job.Header = upload.header
+}
+
+// 登録したジョブに、zip内のファイルごとの結果と取り込み元の記録を登録する
+func (s *CsvService) registerPrepared(job *models.ImportJob, prepared *preparedImport) error {
+	if prepared.archive {
+		files := make([]models.ImportJobFile, len(prepared.entries))
+		for i, entry := range prepared.entries {
+			files[i] = entry.file
+		}
+		var err error
+		if job.Files, err = s.jobRepository.CreateFiles(job.ID, files); err != nil {
 			return err
 		}
+		for i := range prepared.entries {
+			prepared.entries[i].file = job.Files[i]
+		}
 	}
+	return s.createBatches(job, prepared)
+}
 
+// ジョブをバックグラウンドで実行する
+func (s *CsvService) launch(job models.ImportJob, prepared *preparedImport) {
+	s.launchFunc(job, func(ctx context.Context, running *runningJob) {
+		s.runImport(ctx, running, job, prepared)
+	})
+}
+
+// 実行中のジョブとして登録し、runをバックグラウンドで実行する, runが終了した時点で実行中の登録を解除する
+func (s *CsvService) launchFunc(job models.ImportJob, run func(ctx context.Context, running *runningJob)) {
+	// ジョブごとにキャンセルできるcontextを作成し、実行中のジョブとして登録する
+	// CSV_IMPORT_TIMEOUTが設定されている場合は実行時間の上限を超えた時点で中断する
+	ctx, cancel := context.WithCancel(s.ctx)
+	if timeout := importTimeout(); timeout > 0 {
+		cancel()
+		ctx, cancel = context.WithTimeout(s.ctx, timeout)
+	}
+	running := &runningJob{
+		userId:      job.UserID,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+		subscribers: make(map[chan dto.ImportProgressEvent]struct{}),
+	}
+	s.mu.Lock()
+	s.running[job.ID] = running
+	s.mu.Unlock()
+
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			delete(s.running, job.ID)
+			s.mu.Unlock()
+			cancel()
+			close(running.done)
+		}()
+		run(ctx, running)
+	}()
+}
+
+// 取り込むファイルごとに取り込み元の記録を登録する, 取り込んだ連絡先にはこのIDを記録する
+// zip内の取り込めないファイルは登録しない
+func (s *CsvService) createBatches(job *models.ImportJob, prepared *preparedImport) error {
+	var batches []models.ImportBatch
+	var entries []*importEntry
+	for i := range prepared.entries {
+		entry := &prepared.entries[i]
+		if entry.upload == nil {
+			continue
+		}
+		fileName := job.FileName
+		if prepared.archive {
+			fileName = entry.file.FileName
+		}
+		// 中断した場合に同じ設定で再開できるよう、保存したファイルと決定済みの設定を記録する
+		options, err := json.Marshal(entry.upload.input)
+		if err != nil {
+			return err
+		}
+		batches = append(batches, models.ImportBatch{
+			UserID:     job.UserID,
+			FileName:   fileName,
+			Sha256:     entry.upload.sha256,
+			UploadPath: entry.upload.file.Name(),
+			Options:    string(options),
+		})
+		entries = append(entries, entry)
+	}
+	batches, err := s.jobRepository.CreateBatches(job.ID, batches)
+	if err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		entry.batch = batches[i]
+	}
 	return nil
 }
+
+// 環境変数CSV_IMPORT_TIMEOUT("10m"などの形式)から1つのジョブの実行時間の上限を取得する, 未設定の場合は無制限
+func importTimeout() time.Duration {
+	timeout, err := time.ParseDuration(os.Getenv("CSV_IMPORT_TIMEOUT"))
+	if err != nil || timeout <= 0 {
+		return 0
+	}
+	return timeout
+}
+
+// アップロードされたデータをdirに保存し、先頭にシークした状態で返す, dirが空の場合は一時ディレクトリに保存する
+func saveUpload(dir string, reader io.Reader) (*os.File, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+	}
+	file, err := os.CreateTemp(dir, "csv-import-*.csv")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(file, reader)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
+// ジョブを実行し、進捗と結果をDBに保存する, 終了後に一時ファイルを削除する
+// サーバーの終了で中断した場合は、再開できるよう一時ファイルを残す
+func (s *CsvService) runImport(ctx context.Context, running *runningJob, job models.ImportJob, prepared *preparedImport) {
+	defer func() {
+		if job.Status == models.ImportJobStatusInterrupted {
+			prepared.close()
+			return
+		}
+		prepared.remove()
+	}()
+
+	startedAt := time.Now()
+	job.Status = models.ImportJobStatusRunning
+	if job.StartedAt == nil {
+		job.StartedAt = &startedAt
+	}
+	s.saveJob(&job)
+
+	// 一定間隔で進捗をDBに保存し、購読者に進捗イベントを送信する
+	// 再開した場合は中断前に確定していた件数から数える
+	progress := &importProgress{startedAt: startedAt, totalBytes: prepared.size(), checkpoint: job.Checkpoint}
+	progress.store(prepared.counts)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		eventTicker := time.NewTicker(progressEventInterval)
+		defer eventTicker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				applyProgress(&job, progress)
+				s.saveJob(&job)
+			case <-eventTicker.C:
+				running.publish(newProgressEvent(progressEventName, &job, progress))
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var rejected []models.ImportRejectedRow
+	var err error
+	if prepared.archive {
+		rejected, err = s.importArchive(ctx, prepared, progress)
+	} else {
+		entry := &prepared.entries[0]
+		rejected, err = s.importUpload(ctx, entry, progress)
+		entry.batch.RowCount = int(progress.read.Load())
+		s.saveBatch(&entry.batch)
+	}
+
+	close(stop)
+	<-stopped
+
+	// エラー行を保存する
+	if len(rejected) > 0 {
+		if err := s.jobRepository.CreateRejectedRows(job.ID, rejected); err != nil {
+			log.Printf("failed to save rejected rows of import job %d: %v", job.ID, err)
+		}
+	}
+
+	finishedAt := time.Now()
+	job.FinishedAt = &finishedAt
+	applyProgress(&job, progress)
+	job.Status, job.ErrorSummary = s.importResult(err, job.TotalRows, job.FailedRows)
+	s.saveJob(&job)
+	running.finish(newProgressEvent(job.Status, &job, progress))
+}
+
+// 1つのファイルを先頭から取り込む
+func (s *CsvService) importUpload(ctx context.Context, entry *importEntry, progress *importProgress) ([]models.ImportRejectedRow, error) {
+	records, err := entry.upload.open()
+	if err != nil {
+		return nil, err
+	}
+	return s.processCsv(ctx, records, entry, progress)
+}
+
+// zip内のファイルを順番に取り込み、ファイルごとの結果を保存する
+// トランザクションはファイルごとのため、アトミックな取り込みでも失敗したファイルだけがロールバックされる
+// 失敗したファイルがあった場合はジョブ全体を失敗とする
+func (s *CsvService) importArchive(ctx context.Context, prepared *preparedImport, progress *importProgress) ([]models.ImportRejectedRow, error) {
+	var rejected []models.ImportRejectedRow
+	failed := 0
+	for i := range prepared.entries {
+		entry := &prepared.entries[i]
+		// 再開した場合は中断前に終了したファイルも含まれる
+		if entry.upload == nil {
+			if entry.file.Status != models.ImportJobStatusCompleted {
+				failed++
+			}
+			continue
+		}
+		file := &entry.file
+		if err := ctx.Err(); err != nil {
+			file.Status, file.ErrorSummary = s.importResult(err, 0, 0)
+			s.saveFile(file)
+			continue
+		}
+		file.Status = models.ImportJobStatusRunning
+		s.saveFile(file)
+
+		before := progress.counts()
+		if entry.resumeFrom != nil {
+			before = *entry.resumeFrom
+		}
+		rows, err := s.importUpload(ctx, entry, progress)
+		progress.bytesDone += entry.upload.size()
+		after := progress.counts()
+
+		file.TotalRows = int(after.read - before.read)
+		file.InsertedRows = int(after.inserted - before.inserted)
+		file.UpdatedRows = int(after.updated - before.updated)
+		file.SkippedRows = int(after.skipped - before.skipped)
+		file.FailedRows = int(after.failed - before.failed)
+		file.Status, file.ErrorSummary = s.importResult(err, file.TotalRows, file.FailedRows)
+		s.saveFile(file)
+		entry.batch.RowCount = file.TotalRows
+		s.saveBatch(&entry.batch)
+		if file.Status != models.ImportJobStatusCompleted {
+			failed++
+		}
+
+		for _, row := range rows {
+			if len(rejected) == maxStoredRejects {
+				break
+			}
+			row.FileName = file.FileName
+			rejected = append(rejected, row)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return rejected, err
+	}
+	if failed > 0 {
+		return rejected, fmt.Errorf("%d of %d files failed", failed, len(prepared.entries))
+	}
+	return rejected, nil
+}
+
+// 取り込みの結果からステータスとエラーの概要を決める
+// サーバーの終了によって中断した場合は、再開できるステータスにする
+func (s *CsvService) importResult(err error, totalRows int, failedRows int) (string, string) {
+	switch {
+	case errors.Is(err, context.Canceled) && s.ctx.Err() != nil:
+		return models.ImportJobStatusInterrupted, "import was interrupted by server shutdown"
+	case errors.Is(err, context.DeadlineExceeded):
+		return models.ImportJobStatusFailed, "import timed out"
+	case errors.Is(err, context.Canceled):
+		return models.ImportJobStatusCancelled, "import was cancelled"
+	case err != nil:
+		return models.ImportJobStatusFailed, err.Error()
+	case failedRows > 0:
+		summary := fmt.Sprintf("%d of %d rows were rejected", failedRows, totalRows)
+		if failedRows > maxStoredRejects {
+			summary += fmt.Sprintf(" (only the first %d are kept)", maxStoredRejects)
+		}
+		return models.ImportJobStatusCompleted, summary
+	}
+	return models.ImportJobStatusCompleted, ""
+}
+
+// zip内のファイルの結果の保存に失敗しても取り込み自体は継続する
+func (s *CsvService) saveFile(file *models.ImportJobFile) {
+	if _, err := s.jobRepository.UpdateFile(*file); err != nil {
+		log.Printf("failed to save file %s of import job %d: %v", file.FileName, file.ImportJobID, err)
+	}
+}
+
+// 取り込んだファイルの記録の保存に失敗しても取り込み自体は継続する
+func (s *CsvService) saveBatch(batch *models.ImportBatch) {
+	if _, err := s.jobRepository.UpdateBatch(*batch); err != nil {
+		log.Printf("failed to save import batch %d of import job %d: %v", batch.ID, batch.ImportJobID, err)
+	}
+}
+
+// 進捗の保存に失敗しても取り込み自体は継続する
+func (s *CsvService) saveJob(job *models.ImportJob) {
+	if _, err := s.jobRepository.Update(*job); err != nil {
+		log.Printf("failed to save import job %d: %v", job.ID, err)
+	}
+}
+
+// 全てのジョブを取得
+func (s *CsvService) FindAllJobs(userId uint) (*[]models.ImportJob, error) {
+	return s.jobRepository.FindAll(userId)
+}
+
+// IDでジョブを取得
+func (s *CsvService) FindJobById(jobId uint, userId uint) (*models.ImportJob, error) {
+	return s.jobRepository.FindById(jobId, userId)
+}
+
+// 実行中のジョブをキャンセルし、中断するまで待ってから最新の状態を返す
+// 登録済みの行は、アトミックな取り込みの場合はロールバックされ、partialの場合はそのまま残る
+func (s *CsvService) CancelJob(jobId uint, userId uint) (*models.ImportJob, error) {
+	// 存在しないジョブ・他のユーザーのジョブの場合はnot foundを返す
+	if _, err := s.jobRepository.FindById(jobId, userId); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	running, ok := s.running[jobId]
+	s.mu.Unlock()
+	if !ok {
+		return nil, ErrJobNotRunning
+	}
+
+	running.cancel()
+	<-running.done
+	return s.jobRepository.FindById(jobId, userId)
+}
+
+// ジョブのエラー行を取得
+func (s *CsvService) FindRejectedRows(jobId uint, userId uint) (*[]models.ImportRejectedRow, error) {
+	// 存在しないジョブ・他のユーザーのジョブの場合はnot foundを返す
+	if _, err := s.jobRepository.FindById(jobId, userId); err != nil {
+		return nil, err
+	}
+	return s.jobRepository.FindRejectedRows(jobId)
+}
+
+// ジョブのエラー行を元のヘッダーのCSVとして書き出す
+// 末尾に行番号とエラーの理由の列を追加する, 取り込み時は対応しない列として無視されるため修正してそのまま再アップロードできる
+// zipの場合はファイルごとにヘッダーが異なるため、fileNameで指定したファイルの行だけを書き出す
+func (s *CsvService) WriteRejectedRowsCsv(jobId uint, fileName string, userId uint, writer io.Writer) error {
+	job, err := s.jobRepository.FindById(jobId, userId)
+	if err != nil {
+		return err
+	}
+	rows, err := s.jobRepository.FindRejectedRows(jobId)
+	if err != nil {
+		return err
+	}
+
+	headerRow, delimiter := job.Header, job.Delimiter
+	if len(job.Files) > 0 {
+		file, err := findJobFile(job, fileName)
+		if err != nil {
+			return err
+		}
+		headerRow, delimiter = file.Header, file.Delimiter
+		fileRows := make([]models.ImportRejectedRow, 0, len(*rows))
+		for _, row := range *rows {
+			if row.FileName == fileName {
+				fileRows = append(fileRows, row)
+			}
+		}
+		rows = &fileRows
+	}
+
+	// 取り込んだファイルと同じ区切り文字で出力する
+	csvWriter := csv.NewWriter(writer)
+	if comma, err := parseDelimiter(delimiter); err == nil {
+		csvWriter.Comma = comma
+	}
+	header := append(append([]string{}, headerRow...), "Error Line", "Error Reason")
+	if err := csvWriter.Write(header); err != nil {
+		return err
+	}
+	for _, row := range *rows {
+		// 列が足りない行はヘッダーの列数に揃える
+		record := make([]string, len(headerRow), len(headerRow)+2)
+		copy(record, row.Record)
+
+		reasons := make([]string, 0, len(row.Errors))
+		for _, rowErr := range row.Errors {
+			if rowErr.Column == "" {
+				reasons = append(reasons, rowErr.Reason)
+				continue
+			}
+			reasons = append(reasons, rowErr.Column+" "+rowErr.Reason)
+		}
+		record = append(record, strconv.Itoa(row.Line), strings.Join(reasons, "; "))
+		if err := csvWriter.Write(record); err != nil {
+			return err
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// zipのジョブから中のファイルを探す
+func findJobFile(job *models.ImportJob, fileName string) (*models.ImportJobFile, error) {
+	if fileName == "" {
+		return nil, ErrImportFileRequired
+	}
+	for i := range job.Files {
+		if job.Files[i].FileName == fileName {
+			return &job.Files[i], nil
+		}
+	}
+	return nil, errors.New("import file not found")
+}
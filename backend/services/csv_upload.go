@@ -0,0 +1,315 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"project/dto"
+	"project/models"
+)
+
+// 送信された位置が受け取り済みの位置と一致しない場合のエラー, クライアントは受け取り済みの位置を確認して送り直す
+var ErrUploadOffsetMismatch = errors.New("upload offset does not match")
+
+// ファイル全体のバイト数を超えて送信された場合のエラー
+var ErrUploadTooLarge = errors.New("upload exceeds the declared length")
+
+// 全てのデータを受け取る前に取り込もうとした場合のエラー
+var ErrUploadIncomplete = errors.New("upload is not complete")
+
+// 受け取った内容のSHA-256が指定された値と一致しない場合のエラー
+var ErrUploadChecksumMismatch = errors.New("upload checksum does not match")
+
+// 取り込みジョブを登録済みのアップロードに送信・取り込みしようとした場合のエラー
+var ErrUploadFinalized = errors.New("upload is already finalized")
+
+// 同じアップロードに同時に送信・取り込みしようとした場合のエラー
+var ErrUploadLocked = errors.New("upload is being written by another request")
+
+// 分割して送信するアップロードを登録し、データを保存する空のファイルを作成する
+// 保存先はCsvImportConfig.UploadDirのため、サーバーを再起動しても続きを送信できる
+func (s *CsvService) CreateUpload(fileName string, contentType string, length int64, userId uint) (*models.ImportUpload, error) {
+	dir := filepath.Join(s.config.UploadDir, "uploads")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(dir, "csv-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	upload, err := s.jobRepository.CreateUpload(models.ImportUpload{
+		UserID:      userId,
+		FileName:    fileName,
+		ContentType: contentType,
+		Length:      length,
+		Path:        file.Name(),
+	})
+	if err != nil {
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return upload, nil
+}
+
+// IDでアップロードを取得
+func (s *CsvService) FindUploadById(uploadId uint, userId uint) (*models.ImportUpload, error) {
+	return s.jobRepository.FindUploadById(uploadId, userId)
+}
+
+// 受け取り済みの位置(offset)から続きのデータを書き込む
+// 途中で通信が途切れた場合も、受け取った分までは保存して受け取り済みの位置を進める
+func (s *CsvService) AppendUpload(uploadId uint, offset int64, reader io.Reader, userId uint) (*models.ImportUpload, error) {
+	if !s.lockUpload(uploadId) {
+		return nil, ErrUploadLocked
+	}
+	defer s.unlockUpload(uploadId)
+
+	upload, err := s.jobRepository.FindUploadById(uploadId, userId)
+	if err != nil {
+		return nil, err
+	}
+	if upload.ImportJobID != nil {
+		return nil, ErrUploadFinalized
+	}
+	if offset != upload.Offset {
+		return nil, ErrUploadOffsetMismatch
+	}
+
+	file, err := openUploadFile(upload.Path, os.O_WRONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	// 前回の書き込みが記録の更新前に中断した場合に備え、受け取り済みの位置より後ろを切り詰める
+	if err := file.Truncate(offset); err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	// 取り込む際に読み直さなくて済むよう、書き込みながら受け取った内容のSHA-256を求める
+	hash, err := restoreUploadHash(upload.HashState)
+	if err != nil {
+		return nil, err
+	}
+	// 超過を検出するため、残りのバイト数より1バイト多く読み込む
+	remaining := upload.Length - offset
+	written, copyErr := io.Copy(io.MultiWriter(file, hash), io.LimitReader(reader, remaining+1))
+	if written > remaining {
+		file.Truncate(offset)
+		return nil, ErrUploadTooLarge
+	}
+	// 受け取り済みの位置を記録する前に、書き込んだデータをディスクに反映する
+	if err := file.Sync(); err != nil {
+		return nil, err
+	}
+
+	upload.Offset += written
+	if upload.HashState, err = hash.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+		return nil, err
+	}
+	if upload, err = s.jobRepository.UpdateUpload(*upload); err != nil {
+		return nil, err
+	}
+	return upload, copyErr
+}
+
+// 保存したSHA-256の途中の状態から、続きを計算できるハッシュを作成する
+func restoreUploadHash(state []byte) (hash.Hash, error) {
+	hash := sha256.New()
+	if len(state) == 0 {
+		return hash, nil
+	}
+	if err := hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		return nil, err
+	}
+	return hash, nil
+}
+
+// 全てのデータを受け取ったアップロードのchecksum(SHA-256)を検証し、取り込みジョブを登録する
+// ファイルが大きい場合に待たせないよう、取り込みの準備(展開・文字コードの変換・ヘッダーの検証)はジョブの中で行う
+// ヘッダーが不正などで準備できなかった場合は、ジョブを失敗として記録し、ファイルを残して別の設定で取り込み直せるようにする
+func (s *CsvService) FinalizeUpload(uploadId uint, checksum []byte, input dto.ImportCsvInput, userId uint) (*models.ImportJob, error) {
+	if input.OnConflict == "" {
+		input.OnConflict = models.OnConflictFail
+	}
+	if !s.lockUpload(uploadId) {
+		return nil, ErrUploadLocked
+	}
+	defer s.unlockUpload(uploadId)
+
+	upload, err := s.jobRepository.FindUploadById(uploadId, userId)
+	if err != nil {
+		return nil, err
+	}
+	if upload.ImportJobID != nil {
+		return nil, ErrUploadFinalized
+	}
+	if upload.Offset != upload.Length {
+		return nil, ErrUploadIncomplete
+	}
+	hash, err := restoreUploadHash(upload.HashState)
+	if err != nil {
+		return nil, err
+	}
+	sum := hash.Sum(nil)
+	if !bytes.Equal(sum, checksum) {
+		return nil, ErrUploadChecksumMismatch
+	}
+	if _, err := os.Stat(upload.Path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrImportUploadMissing
+		}
+		return nil, err
+	}
+
+	job, err := s.jobRepository.Create(models.ImportJob{
+		UserID:     userId,
+		Status:     models.ImportJobStatusPending,
+		FileName:   upload.FileName,
+		OnConflict: input.OnConflict,
+		Partial:    input.Partial,
+		Format:     input.Format,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// ジョブを記録できなかった場合は、取り込まずにやり直せるようにする
+	upload.Sha256 = hex.EncodeToString(sum)
+	upload.ImportJobID = &job.ID
+	if _, err := s.jobRepository.UpdateUpload(*upload); err != nil {
+		s.failJob(job, err)
+		return nil, err
+	}
+
+	s.launchFunc(*job, func(ctx context.Context, running *runningJob) {
+		s.importFinalizedUpload(ctx, running, *job, *upload, input)
+	})
+	return job, nil
+}
+
+// 受け取ったファイルから取り込みの準備をして取り込む, 準備が済んだ時点で受け取ったファイルは削除する
+func (s *CsvService) importFinalizedUpload(ctx context.Context, running *runningJob, job models.ImportJob, upload models.ImportUpload, input dto.ImportCsvInput) {
+	prepared, err := s.prepareFinalizedUpload(ctx, upload, input)
+	if err != nil {
+		// 別の設定で取り込み直せるよう、アップロードを取り込み前の状態に戻す
+		upload.ImportJobID = nil
+		upload.Sha256 = ""
+		if _, err := s.jobRepository.UpdateUpload(upload); err != nil {
+			log.Printf("failed to reopen import upload %d: %v", upload.ID, err)
+		}
+		s.failJob(&job, err)
+		running.finish(newProgressEvent(job.Status, &job, nil))
+		return
+	}
+	if err := os.Remove(upload.Path); err != nil {
+		log.Printf("failed to remove import upload %d: %v", upload.ID, err)
+	}
+
+	applyPrepared(&job, prepared)
+	if err := s.registerPrepared(&job, prepared); err != nil {
+		prepared.remove()
+		s.failJob(&job, err)
+		running.finish(newProgressEvent(job.Status, &job, nil))
+		return
+	}
+	s.runImport(ctx, running, job, prepared)
+}
+
+// 受け取ったファイルを展開・変換して取り込みの準備をする, キャンセルされた場合は読み込みを中断する
+func (s *CsvService) prepareFinalizedUpload(ctx context.Context, upload models.ImportUpload, input dto.ImportCsvInput) (*preparedImport, error) {
+	file, err := openUploadFile(upload.Path, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	prepared, err := s.prepareImport(contextReader{ctx: ctx, reader: file}, input, s.config.UploadDir)
+	// 展開中のエラーなどに包まれていても、キャンセルされた場合はキャンセルとして扱う
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		if err == nil {
+			prepared.remove()
+		}
+		return nil, ctxErr
+	}
+	return prepared, err
+}
+
+// ジョブを開始できなかったものとして記録する
+func (s *CsvService) failJob(job *models.ImportJob, err error) {
+	finishedAt := time.Now()
+	job.FinishedAt = &finishedAt
+	job.Status, job.ErrorSummary = s.importResult(err, 0, 0)
+	s.saveJob(job)
+}
+
+// ctxがキャンセルされた時点で読み込みを中断するreader
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+// 最後に送信してからUploadTTLが過ぎても取り込まれていないアップロードを、受け取ったファイルとともに破棄する
+func (s *CsvService) expireUploads() error {
+	uploads, err := s.jobRepository.FindExpiredUploads(time.Now().Add(-s.config.UploadTTL))
+	if err != nil {
+		return err
+	}
+	for _, upload := range uploads {
+		if err := os.Remove(upload.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("failed to remove expired import upload %d: %v", upload.ID, err)
+			continue
+		}
+		if err := s.jobRepository.DeleteUpload(upload.ID); err != nil {
+			return err
+		}
+	}
+	if len(uploads) > 0 {
+		log.Printf("%d expired import uploads were removed", len(uploads))
+	}
+	return nil
+}
+
+// 書き込み中のアップロードとして登録する, 既に書き込み中の場合はfalseを返す
+func (s *CsvService) lockUpload(uploadId uint) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.uploading[uploadId] {
+		return false
+	}
+	s.uploading[uploadId] = true
+	return true
+}
+
+func (s *CsvService) unlockUpload(uploadId uint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.uploading, uploadId)
+}
+
+// 受け取ったデータを保存しているファイルを開く
+func openUploadFile(path string, flag int) (*os.File, error) {
+	file, err := os.OpenFile(path, flag, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrImportUploadMissing
+	}
+	return file, err
+}
@@ -0,0 +1,56 @@
+package services
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+
+	"project/models"
+)
+
+// 取り込む1行分のデータを検証し、不正な列ごとのエラーを返す
+// models.Csvのnot nullの制約に合わせて、必須の列が空の場合もエラーとする
+func validateCsv(csv models.Csv) []models.ImportRowError {
+	var errs []models.ImportRowError
+	for _, field := range csvFields {
+		value := field.get(&csv)
+		if value == "" {
+			if field.required {
+				errs = append(errs, models.ImportRowError{Column: field.name, Reason: "is required"})
+			}
+			continue
+		}
+		if field.maxLength > 0 && utf8.RuneCountInString(value) > field.maxLength {
+			errs = append(errs, models.ImportRowError{
+				Column: field.name,
+				Reason: fmt.Sprintf("must be at most %d characters", field.maxLength),
+			})
+		}
+	}
+
+	if csv.Email != "" && !isValidEmail(csv.Email) {
+		errs = append(errs, models.ImportRowError{Column: "Email", Reason: "is not a valid email address"})
+	}
+
+	return errs
+}
+
+// "Name <user@example.com>"のような表示名付きの形式は受け付けない
+func isValidEmail(email string) bool {
+	address, err := mail.ParseAddress(email)
+	return err == nil && address.Address == email
+}
+
+// 連絡先の登録・更新で検証に失敗した場合のエラー, 不正な列ごとのエラーを保持する
+type CsvValidationError struct {
+	Errors []models.ImportRowError
+}
+
+func (e *CsvValidationError) Error() string {
+	reasons := make([]string, len(e.Errors))
+	for i, rowErr := range e.Errors {
+		reasons[i] = rowErr.Column + " " + rowErr.Reason
+	}
+	return "invalid contact: " + strings.Join(reasons, "; ")
+}
@@ -0,0 +1,259 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"project/dto"
+)
+
+const (
+	// ワーカーの数の初期値
+	defaultWorkers = 30
+	// 1回のINSERT(COPY)でまとめて登録する行数の初期値
+	defaultBatchSize = 500
+	// adaptiveの場合にワーカーの数を見直す間隔
+	autoscaleInterval = 500 * time.Millisecond
+	// 1行あたりの登録時間がこれまでの最短の何倍を超えたらDBが混雑しているとみなすか
+	autoscaleLatencyFactor = 2.0
+	// 登録に失敗したバッチの割合がこれを超えたらワーカーを半分にする
+	autoscaleErrorRate = 0.1
+	// 混雑によってワーカーを減らした後、再び増やすまでに待つ回数
+	autoscaleCooldown = 10
+	// gzip・zipを展開した後のサイズの上限の初期値
+	defaultMaxUncompressedSize = 2 << 30
+	// zipに含められるファイル数の上限の初期値
+	defaultMaxArchiveEntries = 100
+	// 分割して送信中のアップロードを破棄するまでの期間の初期値
+	defaultUploadTTL = 24 * time.Hour
+)
+
+// CSV取り込みのワーカープールと圧縮ファイルの展開の設定
+type CsvImportConfig struct {
+	// ワーカーの数, Adaptiveの場合は上限
+	Workers int
+	// 1回の登録でまとめる行数
+	BatchSize int
+	// ジョブキュー・結果キューの長さ, 0の場合はワーカーの数の2倍
+	QueueSize int
+	// 登録にかかる時間と失敗の割合に応じてワーカーの数を増減する
+	Adaptive bool
+	// gzip・zipを展開した後の合計サイズ(バイト数)の上限, 圧縮率の高いファイルでディスクを使い切らないようにする
+	MaxUncompressedSize int64
+	// zipに含められるファイル数の上限(ディレクトリを除く)
+	MaxArchiveEntries int
+	// 取り込むファイルを保存するディレクトリ, 中断したジョブを再開できるようサーバーを再起動しても消えない場所を指定する
+	UploadDir string
+	// 最後に送信してからこの期間が過ぎても取り込まれないアップロードは、起動時に破棄する
+	UploadTTL time.Duration
+}
+
+// 設定の初期値
+func DefaultCsvImportConfig() CsvImportConfig {
+	return CsvImportConfig{
+		Workers:             defaultWorkers,
+		BatchSize:           defaultBatchSize,
+		MaxUncompressedSize: defaultMaxUncompressedSize,
+		MaxArchiveEntries:   defaultMaxArchiveEntries,
+		UploadDir:           filepath.Join(os.TempDir(), "csv-imports"),
+		UploadTTL:           defaultUploadTTL,
+	}
+}
+
+// 環境変数CSV_WORKERS, CSV_BATCH_SIZE, CSV_QUEUE_SIZE, CSV_ADAPTIVE_WORKERS,
+// CSV_MAX_UNCOMPRESSED_SIZE, CSV_ZIP_MAX_ENTRIES, CSV_UPLOAD_DIR, CSV_UPLOAD_TTL("24h"などの形式)から設定を読み込む
+// 書き込みが直列化されるSQLiteではCSV_WORKERS=1、PostgreSQLでは接続数に合わせた値を指定する
+func CsvImportConfigFromEnv() CsvImportConfig {
+	config := DefaultCsvImportConfig()
+	config.Workers = envInt("CSV_WORKERS", config.Workers)
+	config.BatchSize = envInt("CSV_BATCH_SIZE", config.BatchSize)
+	config.QueueSize = envInt("CSV_QUEUE_SIZE", config.QueueSize)
+	if adaptive, err := strconv.ParseBool(os.Getenv("CSV_ADAPTIVE_WORKERS")); err == nil {
+		config.Adaptive = adaptive
+	}
+	if size, err := strconv.ParseInt(os.Getenv("CSV_MAX_UNCOMPRESSED_SIZE"), 10, 64); err == nil && size > 0 {
+		config.MaxUncompressedSize = size
+	}
+	config.MaxArchiveEntries = envInt("CSV_ZIP_MAX_ENTRIES", config.MaxArchiveEntries)
+	if dir := os.Getenv("CSV_UPLOAD_DIR"); dir != "" {
+		config.UploadDir = dir
+	}
+	if ttl, err := time.ParseDuration(os.Getenv("CSV_UPLOAD_TTL")); err == nil && ttl > 0 {
+		config.UploadTTL = ttl
+	}
+	return config
+}
+
+// 正の整数の環境変数を読み込む, 未設定・不正な値の場合はdefaultValueを返す
+func envInt(name string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
+// リクエストで指定された値で設定を上書きする
+func (c CsvImportConfig) withInput(input dto.ImportCsvInput) CsvImportConfig {
+	if input.Workers > 0 {
+		c.Workers = input.Workers
+	}
+	if input.BatchSize > 0 {
+		c.BatchSize = input.BatchSize
+	}
+	if input.QueueSize > 0 {
+		c.QueueSize = input.QueueSize
+	}
+	if input.Adaptive != nil {
+		c.Adaptive = *input.Adaptive
+	}
+	if c.Workers <= 0 {
+		c.Workers = defaultWorkers
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = defaultBatchSize
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = c.Workers * 2
+	}
+	return c
+}
+
+// 登録にかかった時間と失敗の回数, ワーカーから同時に更新されるためatomicで保持する
+type writeStats struct {
+	writes   atomic.Int64
+	rows     atomic.Int64
+	failures atomic.Int64
+	nanos    atomic.Int64
+}
+
+// 1回分の登録を記録する
+func (s *writeStats) record(rows int, elapsed time.Duration, failed bool) {
+	s.writes.Add(1)
+	s.rows.Add(int64(rows))
+	s.nanos.Add(int64(elapsed))
+	if failed {
+		s.failures.Add(1)
+	}
+}
+
+// 前回の呼び出しからの集計を返し、0に戻す
+func (s *writeStats) reset() (writes, rows, failures int64, elapsed time.Duration) {
+	return s.writes.Swap(0), s.rows.Swap(0), s.failures.Swap(0), time.Duration(s.nanos.Swap(0))
+}
+
+// 実行中に数を増減できるワーカーの集まり
+// ワーカーの追加・停止はrunWorkersとautoscaleのどちらか一方のgoroutineからだけ行う
+type workerPool struct {
+	run     *importRun
+	jobs    chan recordBatch
+	results chan<- batchResult
+	wg      sync.WaitGroup
+	// ワーカーごとの停止用のチャネル, 後から追加したワーカーから停止する
+	quits    []chan struct{}
+	progress *importProgress
+}
+
+func newWorkerPool(run *importRun, jobs chan recordBatch, results chan<- batchResult, progress *importProgress) *workerPool {
+	return &workerPool{run: run, jobs: jobs, results: results, progress: progress}
+}
+
+// ワーカーを1つ追加する
+func (p *workerPool) grow() {
+	quit := make(chan struct{})
+	p.quits = append(p.quits, quit)
+	p.wg.Add(1)
+	go p.worker(quit)
+	p.progress.workers.Store(int64(len(p.quits)))
+}
+
+// ワーカーを1つ停止する, 処理中のバッチは最後まで登録してから停止する
+func (p *workerPool) shrink() {
+	if len(p.quits) <= 1 {
+		return
+	}
+	last := len(p.quits) - 1
+	close(p.quits[last])
+	p.quits = p.quits[:last]
+	p.progress.workers.Store(int64(len(p.quits)))
+}
+
+// 全てのワーカーの終了を待つ, jobsを閉じてから呼び出す
+func (p *workerPool) wait() {
+	p.wg.Wait()
+}
+
+// ワーカー関数
+func (p *workerPool) worker(quit <-chan struct{}) {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-quit:
+			return
+		case batch, ok := <-p.jobs:
+			if !ok {
+				return
+			}
+			// キャンセルされた場合は残りのバッチを読み捨てる
+			if p.run.ctx.Err() != nil {
+				continue
+			}
+			p.results <- p.run.insertBatch(batch)
+		}
+	}
+}
+
+// 一定間隔で登録の状況を確認し、ワーカーの数をmaxWorkersまでの範囲で増減する
+// - 登録に失敗したバッチが多い場合は、DBの負荷を下げるためワーカーを半分にする
+// - 1行あたりの登録時間が延びた場合は、書き込みが詰まっているとみなしてワーカーを1つ減らす
+// - 読み込んだバッチがキューに溜まっている場合はワーカーを増やす, 混雑するまでは2倍ずつ増やす
+func (p *workerPool) autoscale(maxWorkers int, stop <-chan struct{}) {
+	ticker := time.NewTicker(autoscaleInterval)
+	defer ticker.Stop()
+
+	var fastest time.Duration
+	congested := false
+	cooldown := 0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		writes, rows, failures, elapsed := p.run.stats.reset()
+		if writes == 0 || rows == 0 {
+			continue
+		}
+		perRow := elapsed / time.Duration(rows)
+		if cooldown > 0 {
+			cooldown--
+		}
+
+		switch {
+		case float64(failures)/float64(writes) > autoscaleErrorRate:
+			for n := len(p.quits) / 2; n > 0; n-- {
+				p.shrink()
+			}
+			congested, cooldown = true, autoscaleCooldown
+		case fastest > 0 && float64(perRow) > float64(fastest)*autoscaleLatencyFactor:
+			p.shrink()
+			congested, cooldown = true, autoscaleCooldown
+		case len(p.jobs) > 0 && cooldown == 0:
+			n := 1
+			if !congested {
+				n = len(p.quits)
+			}
+			for ; n > 0 && len(p.quits) < maxWorkers; n-- {
+				p.grow()
+			}
+		}
+		if fastest == 0 || perRow < fastest {
+			fastest = perRow
+		}
+	}
+}
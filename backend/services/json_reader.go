@@ -0,0 +1,189 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// JSONの構文が壊れていて、それ以降を読み込めない場合のエラー
+// JSON Linesの1行や配列の1要素だけが不正な場合は、その行だけを取り込めない行として扱う
+var ErrInvalidJson = errors.New("invalid json")
+
+// JSON Lines、またはトップレベルが配列のJSONを1オブジェクトずつ読み込むrecordReader
+// オブジェクトのキーはCSVのヘッダーと同じ規則でmodels.Csvのフィールドに対応させる
+// 共通の処理でヘッダーとして扱えるよう、最初にcsvFieldsの名前を並べたヘッダー行を返す
+type jsonRecordReader struct {
+	reader *bufio.Reader
+	// 配列の場合のみ利用する
+	decoder *json.Decoder
+	// ヘッダー行を返したかどうか
+	started bool
+	// JSON Linesの場合は行番号、配列の場合は1始まりの要素の番号
+	line   int
+	offset int64
+}
+
+// readerの先頭が"["の場合は配列、それ以外の場合はlinesがtrueでなくてもJSON Linesとして読み込む
+func newJsonRecordReader(reader io.Reader, lines bool) (*jsonRecordReader, error) {
+	r := &jsonRecordReader{reader: bufio.NewReader(reader)}
+	if lines {
+		return r, nil
+	}
+
+	// BOMと先頭の空白を読み飛ばして最初の文字を確認する
+	if bom, err := r.reader.Peek(3); err == nil && bytes.Equal(bom, []byte{0xEF, 0xBB, 0xBF}) {
+		r.reader.Discard(3)
+		r.offset += 3
+	}
+	for {
+		b, err := r.reader.Peek(1)
+		if err != nil {
+			// 空のファイルは行が無いものとして扱う
+			return r, nil
+		}
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+			if b[0] == '[' {
+				r.decoder = json.NewDecoder(r.reader)
+				r.decoder.UseNumber()
+				if _, err := r.decoder.Token(); err != nil {
+					return nil, fmt.Errorf("%w: %v", ErrInvalidJson, err)
+				}
+			}
+			return r, nil
+		}
+		r.reader.Discard(1)
+		r.offset++
+	}
+}
+
+func (r *jsonRecordReader) Read() ([]string, error) {
+	if !r.started {
+		r.started = true
+		header := make([]string, len(csvFields))
+		for i, field := range csvFields {
+			header[i] = field.name
+		}
+		return header, nil
+	}
+	if r.decoder != nil {
+		return r.readElement()
+	}
+	return r.readLine()
+}
+
+// 配列の次の要素を読み込む
+func (r *jsonRecordReader) readElement() ([]string, error) {
+	if !r.decoder.More() {
+		// 閉じ括弧を読み込んで配列が正しく閉じられていることを確認する
+		if _, err := r.decoder.Token(); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidJson, err)
+		}
+		return nil, io.EOF
+	}
+	r.line++
+	var value any
+	if err := r.decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("%w: element %d: %v", ErrInvalidJson, r.line, err)
+	}
+	r.offset = r.decoder.InputOffset()
+	object, ok := value.(map[string]any)
+	if !ok {
+		return nil, &invalidRecordError{reason: fmt.Sprintf("element %d is not an object", r.line)}
+	}
+	return jsonObjectToRecord(object)
+}
+
+// 次の空でない行を読み込む
+func (r *jsonRecordReader) readLine() ([]string, error) {
+	for {
+		text, err := r.reader.ReadBytes('\n')
+		if len(text) == 0 && err != nil {
+			return nil, err
+		}
+		r.line++
+		r.offset += int64(len(text))
+		if r.line == 1 {
+			text = bytes.TrimPrefix(text, []byte{0xEF, 0xBB, 0xBF})
+		}
+		text = bytes.TrimSpace(text)
+		if len(text) == 0 {
+			continue
+		}
+
+		// 行ごとに独立しているため、不正な行があっても次の行から読み込める
+		decoder := json.NewDecoder(bytes.NewReader(text))
+		decoder.UseNumber()
+		var value any
+		if err := decoder.Decode(&value); err != nil {
+			return nil, &invalidRecordError{reason: fmt.Sprintf("invalid json: %v", err)}
+		}
+		object, ok := value.(map[string]any)
+		if !ok || decoder.More() {
+			return nil, &invalidRecordError{reason: "line is not a single json object"}
+		}
+		return jsonObjectToRecord(object)
+	}
+}
+
+func (r *jsonRecordReader) Line() int {
+	return r.line
+}
+
+func (r *jsonRecordReader) Offset() int64 {
+	return r.offset
+}
+
+// オブジェクトをヘッダー行の順番のレコードに変換する, 対応するフィールドが無いキーは無視する
+// CSVのヘッダーの列の重複と同じく、同じフィールドに対応するキーが複数ある場合はその行を取り込めない行とする
+func jsonObjectToRecord(object map[string]any) ([]string, error) {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	// エラーの内容とエラー行に保存する値がキーの順番で変わらないようにする
+	sort.Strings(keys)
+
+	record := make([]string, len(csvFields))
+	matched := make([]string, len(csvFields))
+	var duplicates []string
+	for _, key := range keys {
+		index, ok := csvFieldIndex[normalizeHeader(key)]
+		if !ok {
+			continue
+		}
+		if matched[index] != "" {
+			duplicates = append(duplicates, fmt.Sprintf("%q and %q", matched[index], key))
+			continue
+		}
+		matched[index] = key
+		record[index] = jsonValueString(object[key])
+	}
+	if len(duplicates) > 0 {
+		return nil, &invalidRecordError{fields: record, reason: "duplicate keys: " + strings.Join(duplicates, ", ")}
+	}
+	return record, nil
+}
+
+// 値を文字列に変換する, 数値は桁を変えずにそのままの表記にする
+func jsonValueString(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
+	}
+}
@@ -0,0 +1,248 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"project/dto"
+	"project/models"
+)
+
+// 取り込む行を1行ずつ返すインターフェース, ファイルの形式ごとに実装する
+// マッピング・検証・ワーカーによる登録は形式に関係なく共通の処理で行う
+type recordReader interface {
+	// 次の行を返す, 全ての行を読み終えた場合はio.EOFを返す
+	// その行だけが不正な場合は*invalidRecordErrorを返し、続けて次の行を読み込める
+	Read() ([]string, error)
+	// 直前に読み込んだ行のファイル内での行番号, エラー行の表示に利用する
+	Line() int
+	// ファイル全体のうち読み込んだ位置(バイト数), 残り時間の見積もりに利用する
+	Offset() int64
+}
+
+// 1行分のデータが不正な場合にrecordReaderのReadが返すエラー
+// ファイル全体は読み込めるため、読み込みを中断せずにその行だけを取り込めない行として扱う
+type invalidRecordError struct {
+	// 読み込めた範囲のデータ, エラー行として保存する
+	fields []string
+	reason string
+}
+
+func (e *invalidRecordError) Error() string {
+	return e.reason
+}
+
+// encoding/csvのリーダーをrecordReaderとして扱う
+type csvRecordReader struct {
+	reader *csv.Reader
+	// ファイルの途中から読み込む場合の、読み込みを始めた位置までの行数とバイト数
+	lineBase   int
+	offsetBase int64
+}
+
+func (r *csvRecordReader) Read() ([]string, error) {
+	return r.reader.Read()
+}
+
+func (r *csvRecordReader) Line() int {
+	line, _ := r.reader.FieldPos(0)
+	return r.lineBase + line
+}
+
+func (r *csvRecordReader) Offset() int64 {
+	return r.offsetBase + r.reader.InputOffset()
+}
+
+// 取り込みの準備が済んだアップロード
+type preparedUpload struct {
+	// 取り込むファイル, CSVの場合はUTF-8に変換済み
+	file *os.File
+	// 形式・区切り文字・ヘッダー行・シートを決定済みの設定
+	input    dto.ImportCsvInput
+	encoding string
+	header   []string
+	// 変換前の内容のSHA-256(16進数)
+	sha256 string
+	// Excelのワークブック内のXMLファイルを展開した後のサイズの上限
+	maxPartSize int64
+}
+
+// 一時ファイルを閉じて削除する
+func (u *preparedUpload) remove() {
+	u.file.Close()
+	os.Remove(u.file.Name())
+}
+
+// 中断したジョブを再開できるよう、一時ファイルを削除せずに閉じる
+func (u *preparedUpload) close() {
+	u.file.Close()
+}
+
+// 一時ファイルのサイズ
+func (u *preparedUpload) size() int64 {
+	info, err := u.file.Stat()
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// アップロードされたデータをdirに保存し、形式ごとの設定を決めてヘッダーを検証する
+// リクエストの終了後も読み込めるよう、readerの内容はこの関数内で全て読み切る
+// maxPartSizeはExcelのワークブック内のXMLファイル1つあたりの展開後のサイズの上限
+func prepareUpload(reader io.Reader, input dto.ImportCsvInput, dir string, maxPartSize int64) (_ *preparedUpload, err error) {
+	if input.Format == "" {
+		input.Format = models.ImportFormatCsv
+	}
+	upload := &preparedUpload{input: input, maxPartSize: maxPartSize}
+	// 文字コードを変換する前の内容からハッシュ値を求める
+	hash := sha256.New()
+	reader = io.TeeReader(reader, hash)
+
+	if input.Format == models.ImportFormatCsv {
+		// 一時ファイルにはUTF-8に変換して保存する
+		if reader, upload.encoding, err = newUTF8Reader(reader, input.Encoding); err != nil {
+			return nil, err
+		}
+	}
+	if upload.file, err = saveUpload(dir, reader); err != nil {
+		return nil, err
+	}
+	upload.sha256 = hex.EncodeToString(hash.Sum(nil))
+	// 準備できなかった場合は一時ファイルを削除する
+	defer func() {
+		if err != nil {
+			upload.remove()
+		}
+	}()
+
+	switch input.Format {
+	case models.ImportFormatCsv:
+		// 区切り文字・ヘッダー行を先頭から判定する
+		_, head, err := peekHead(upload.file, dialectSniffSize)
+		if err != nil {
+			return nil, err
+		}
+		if upload.input, err = resolveDialect(head, upload.input); err != nil {
+			return nil, err
+		}
+	case models.ImportFormatXlsx:
+		if upload.input, err = resolveXlsxSheet(upload.file, upload.input, maxPartSize); err != nil {
+			return nil, err
+		}
+	case models.ImportFormatJson, models.ImportFormatJsonl:
+		// 先頭にcsvFieldsの名前を並べたヘッダー行を返すため、ヘッダー行は常に1行目になる
+		upload.input.HeaderRow = 1
+	default:
+		return nil, fmt.Errorf("unsupported format: %s", input.Format)
+	}
+
+	records, err := upload.open()
+	if err != nil {
+		return nil, err
+	}
+	if upload.header, _, err = readHeader(records, upload.input.HeaderRow); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+// 一時ファイルの先頭から行を読み込むreaderを作成する
+func (u *preparedUpload) open() (recordReader, error) {
+	if _, err := u.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	switch u.input.Format {
+	case models.ImportFormatXlsx:
+		return newXlsxReader(u.file, u.size(), u.input.Sheet, u.maxPartSize)
+	case models.ImportFormatJson, models.ImportFormatJsonl:
+		return newJsonRecordReader(u.file, u.input.Format == models.ImportFormatJsonl)
+	default:
+		return &csvRecordReader{reader: newCsvReader(u.file, u.input)}, nil
+	}
+}
+
+// 一時ファイルのoffsetバイト目(行の先頭)から行を読み込むreaderを作成する
+// 途中から読み込めるのはCSVだけのため、それ以外の形式はfalseを返す
+func (u *preparedUpload) seek(offset int64) (recordReader, bool, error) {
+	if u.input.Format != models.ImportFormatCsv {
+		return nil, false, nil
+	}
+	// 行番号を合わせるため、offsetまでの改行を数える, CSVとして解析するより十分に速い
+	if _, err := u.file.Seek(0, io.SeekStart); err != nil {
+		return nil, false, err
+	}
+	lines := 0
+	buf := make([]byte, 64*1024)
+	reader := io.LimitReader(u.file, offset)
+	for {
+		n, err := reader.Read(buf)
+		lines += bytes.Count(buf[:n], []byte{'\n'})
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	if _, err := u.file.Seek(offset, io.SeekStart); err != nil {
+		return nil, false, err
+	}
+	return &csvRecordReader{reader: newCsvReader(u.file, u.input), lineBase: lines, offsetBase: offset}, true, nil
+}
+
+// 判定用に先頭のdialectSniffRecords件の行を読み込む, 解析できない行があればそこで打ち切る
+func readSniffRecords(records recordReader) [][]string {
+	var sniffed [][]string
+	for len(sniffed) < dialectSniffRecords {
+		record, err := records.Read()
+		if err != nil {
+			break
+		}
+		sniffed = append(sniffed, record)
+	}
+	return sniffed
+}
+
+// 先頭から必須の列を含む最初の行をヘッダー行(1始まり)とする, 見つからない場合は1行目とする
+// ファイルの先頭にタイトルや出力日などの行があるファイルを前処理せずに取り込めるようにする
+func findHeaderRow(records [][]string) int {
+	for i, record := range records {
+		if _, err := newColumnMapping(record); err == nil {
+			return i + 1
+		}
+	}
+	return 1
+}
+
+// headerRow(1始まり)の行をヘッダーとして読み込み、列の対応を作成する, それより前の行は読み飛ばす
+// Excelはシートの行番号、それ以外は空の行を除いた行数で数える
+func readHeader(records recordReader, headerRow int) ([]string, *columnMapping, error) {
+	var header []string
+	var err error
+	if sheet, ok := records.(*xlsxReader); ok {
+		header, err = sheet.readRow(max(headerRow, 1))
+	} else {
+		for i := 0; i < max(headerRow, 1); i++ {
+			if header, err = records.Read(); err != nil {
+				break
+			}
+		}
+	}
+	if err == io.EOF {
+		return nil, nil, fmt.Errorf("%w: csv is empty", ErrInvalidHeader)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidHeader, err)
+	}
+	mapping, err := newColumnMapping(header)
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, mapping, nil
+}
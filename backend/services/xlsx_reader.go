@@ -0,0 +1,589 @@
+package services
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"project/dto"
+)
+
+// zipとして開けない、シートが見つからない、XMLが壊れているなど、Excelのファイルとして読み込めない場合のエラー
+// ワークブック内のXMLファイルが展開後のサイズの上限を超える場合も含む
+var ErrInvalidWorkbook = errors.New("invalid xlsx workbook")
+
+// ワークブック内のファイルのパス
+const (
+	xlsxWorkbookPath      = "xl/workbook.xml"
+	xlsxWorkbookRelsPath  = "xl/_rels/workbook.xml.rels"
+	xlsxSharedStringsPath = "xl/sharedStrings.xml"
+	xlsxStylesPath        = "xl/styles.xml"
+)
+
+// Excelのシートの列数(A〜XFD), これを超える位置のセルは不正なファイルとして扱う
+const xlsxMaxColumns = 16384
+
+// xl/workbook.xml, シートの名前と実体のファイルへの参照
+type xlsxWorkbook struct {
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+		// r:idの名前空間はファイルによって異なるため、名前だけで対応させる
+		RelationshipID string `xml:"id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+// xl/_rels/workbook.xml.rels, 参照IDとファイルのパスの対応
+type xlsxRelationships struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+// xl/sharedStrings.xml, 文字列のセルはここへのインデックスを持つ
+type xlsxSharedStrings struct {
+	Items []xlsxRichText `xml:"si"`
+}
+
+// 書式付きの文字列, ふりがな(rPh)は取り込まない
+type xlsxRichText struct {
+	T    string `xml:"t"`
+	Runs []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t *xlsxRichText) text() string {
+	var b strings.Builder
+	b.WriteString(t.T)
+	for _, run := range t.Runs {
+		b.WriteString(run.T)
+	}
+	return b.String()
+}
+
+// xl/styles.xml, セルのスタイル(s属性)から表示形式を引く
+type xlsxStyles struct {
+	NumFmts []struct {
+		ID   int    `xml:"numFmtId,attr"`
+		Code string `xml:"formatCode,attr"`
+	} `xml:"numFmts>numFmt"`
+	CellXfs []struct {
+		NumFmtID int `xml:"numFmtId,attr"`
+	} `xml:"cellXfs>xf"`
+}
+
+// 組み込みの表示形式のうち、数字の桁をそのまま表示するもの
+var xlsxBuiltinNumFmts = map[int]string{
+	0: "General",
+	1: "0",
+}
+
+type xlsxRow struct {
+	R     int        `xml:"r,attr"`
+	Cells []xlsxCell `xml:"c"`
+}
+
+type xlsxCell struct {
+	R string `xml:"r,attr"`
+	// セルの型, s: 共有文字列, inlineStr: セル内の文字列, str: 数式の文字列, b: 真偽値, 省略時: 数値
+	T  string        `xml:"t,attr"`
+	S  int           `xml:"s,attr"`
+	V  string        `xml:"v"`
+	Is *xlsxRichText `xml:"is"`
+}
+
+// シートの行を1行ずつ読み込むrecordReader
+// シート全体をメモリに載せないよう、シートのXMLは先頭から順に読み込む
+type xlsxReader struct {
+	decoder       *xml.Decoder
+	sharedStrings []string
+	// cellXfsのインデックスごとの表示形式
+	formats []string
+	line    int
+	// dimensionから取得したシートの最終行, 読み込んだ位置の見積もりに利用する
+	lastRow int
+	size    int64
+}
+
+// ワークブックを開き、sheet(シート名または1始まりの番号, 空の場合は先頭)の行を読み込むreaderを作成する
+// 共有文字列などのXMLファイルは全体をメモリに載せるため、展開後のサイズがmaxPartSizeを超える場合はエラーにする
+func newXlsxReader(file io.ReaderAt, size int64, sheet string, maxPartSize int64) (*xlsxReader, error) {
+	archive, err := zip.NewReader(file, size)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidWorkbook, err)
+	}
+	_, sheetPath, err := findXlsxSheet(archive, sheet, maxPartSize)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &xlsxReader{size: size}
+	var sharedStrings xlsxSharedStrings
+	if err := decodeXlsxPart(archive, xlsxSharedStringsPath, &sharedStrings, true, maxPartSize); err != nil {
+		return nil, err
+	}
+	reader.sharedStrings = make([]string, len(sharedStrings.Items))
+	for i := range sharedStrings.Items {
+		reader.sharedStrings[i] = sharedStrings.Items[i].text()
+	}
+
+	var styles xlsxStyles
+	if err := decodeXlsxPart(archive, xlsxStylesPath, &styles, true, maxPartSize); err != nil {
+		return nil, err
+	}
+	codes := make(map[int]string, len(xlsxBuiltinNumFmts)+len(styles.NumFmts))
+	for id, code := range xlsxBuiltinNumFmts {
+		codes[id] = code
+	}
+	for _, numFmt := range styles.NumFmts {
+		codes[numFmt.ID] = numFmt.Code
+	}
+	reader.formats = make([]string, len(styles.CellXfs))
+	for i, xf := range styles.CellXfs {
+		reader.formats[i] = codes[xf.NumFmtID]
+	}
+
+	part, err := archive.Open(sheetPath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidWorkbook, err)
+	}
+	reader.decoder = xml.NewDecoder(part)
+	return reader, nil
+}
+
+// シート名を決めたinputを返す, ヘッダー行が省略された場合は先頭の行から判定する
+func resolveXlsxSheet(file *os.File, input dto.ImportCsvInput, maxPartSize int64) (dto.ImportCsvInput, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return input, err
+	}
+	archive, err := zip.NewReader(file, info.Size())
+	if err != nil {
+		return input, fmt.Errorf("%w: %v", ErrInvalidWorkbook, err)
+	}
+	if input.Sheet, _, err = findXlsxSheet(archive, input.Sheet, maxPartSize); err != nil {
+		return input, err
+	}
+
+	if input.HeaderRow == 0 {
+		reader, err := newXlsxReader(file, info.Size(), input.Sheet, maxPartSize)
+		if err != nil {
+			return input, err
+		}
+		input.HeaderRow = findXlsxHeaderRow(reader)
+	}
+	return input, nil
+}
+
+// 先頭のdialectSniffRecords件の行から必須の列を含む最初の行を探し、シートの行番号を返す
+// 見つからない場合は値のある最初の行とする
+func findXlsxHeaderRow(reader *xlsxReader) int {
+	first := 0
+	for i := 0; i < dialectSniffRecords; i++ {
+		record, err := reader.Read()
+		if err != nil {
+			break
+		}
+		if first == 0 {
+			first = reader.Line()
+		}
+		if _, err := newColumnMapping(record); err == nil {
+			return reader.Line()
+		}
+	}
+	return max(first, 1)
+}
+
+// シートのheaderRow行目を読み込む, それより前の行は読み飛ばす
+// CSVと異なり、ヘッダー行は空の行も含めたシートの行番号で数える
+func (r *xlsxReader) readRow(headerRow int) ([]string, error) {
+	for {
+		record, err := r.Read()
+		if err != nil {
+			return nil, err
+		}
+		if r.line == headerRow {
+			return record, nil
+		}
+		if r.line > headerRow {
+			return nil, fmt.Errorf("row %d of the sheet is empty", headerRow)
+		}
+	}
+}
+
+// シート名または1始まりの番号からシート名とシートのファイルのパスを探す
+func findXlsxSheet(archive *zip.Reader, sheet string, maxPartSize int64) (string, string, error) {
+	var workbook xlsxWorkbook
+	if err := decodeXlsxPart(archive, xlsxWorkbookPath, &workbook, false, maxPartSize); err != nil {
+		return "", "", err
+	}
+	var rels xlsxRelationships
+	if err := decodeXlsxPart(archive, xlsxWorkbookRelsPath, &rels, false, maxPartSize); err != nil {
+		return "", "", err
+	}
+	if len(workbook.Sheets) == 0 {
+		return "", "", fmt.Errorf("%w: workbook has no sheets", ErrInvalidWorkbook)
+	}
+
+	index := -1
+	switch {
+	case sheet == "":
+		index = 0
+	default:
+		for i, candidate := range workbook.Sheets {
+			if strings.EqualFold(candidate.Name, sheet) {
+				index = i
+				break
+			}
+		}
+		if n, err := strconv.Atoi(sheet); index == -1 && err == nil && n >= 1 && n <= len(workbook.Sheets) {
+			index = n - 1
+		}
+	}
+	if index == -1 {
+		return "", "", fmt.Errorf("%w: sheet %q not found", ErrInvalidWorkbook, sheet)
+	}
+
+	found := workbook.Sheets[index]
+	for _, rel := range rels.Relationships {
+		if rel.ID != found.RelationshipID {
+			continue
+		}
+		// 参照先はxl/からの相対パス, またはパッケージのルートからの絶対パス
+		target := strings.TrimPrefix(rel.Target, "/")
+		if !strings.HasPrefix(rel.Target, "/") {
+			target = path.Join("xl", rel.Target)
+		}
+		return found.Name, target, nil
+	}
+	return "", "", fmt.Errorf("%w: sheet %q has no worksheet", ErrInvalidWorkbook, found.Name)
+}
+
+// ワークブック内のXMLファイルを読み込む, optionalの場合はファイルが無くてもエラーにしない
+// 小さなファイルが展開後に巨大になってメモリを使い切らないよう、gzip・zipと同じく展開後のサイズをmaxPartSizeまでに制限する
+func decodeXlsxPart(archive *zip.Reader, name string, v any, optional bool, maxPartSize int64) error {
+	part, err := archive.Open(name)
+	if err != nil {
+		if optional && errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("%w: %v", ErrInvalidWorkbook, err)
+	}
+	defer part.Close()
+	if err := xml.NewDecoder(&limitedReader{reader: part, remaining: maxPartSize}).Decode(v); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidWorkbook, name, err)
+	}
+	return nil
+}
+
+// 値のあるセルを含む次の行を返す, 空の行は読み飛ばす
+func (r *xlsxReader) Read() ([]string, error) {
+	for {
+		token, err := r.decoder.Token()
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidWorkbook, err)
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch start.Name.Local {
+		case "dimension":
+			for _, attr := range start.Attr {
+				if attr.Name.Local == "ref" {
+					r.lastRow = xlsxLastRow(attr.Value)
+				}
+			}
+		case "row":
+			var row xlsxRow
+			if err := r.decoder.DecodeElement(&row, &start); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidWorkbook, err)
+			}
+			// 行番号が省略された場合は直前の行の次の行とする
+			if row.R == 0 {
+				row.R = r.line + 1
+			}
+			r.line = row.R
+			record, err := r.record(row)
+			if err != nil {
+				return nil, err
+			}
+			if record != nil {
+				return record, nil
+			}
+		}
+	}
+}
+
+// 行をセルの列の位置に合わせたレコードに変換する, 値のあるセルが無い場合はnilを返す
+// Excelの最終列(XFD)を超える位置のセルがある場合はエラーを返す
+func (r *xlsxReader) record(row xlsxRow) ([]string, error) {
+	var record []string
+	column := -1
+	for _, cell := range row.Cells {
+		// 列の位置が省略された場合は直前のセルの次の列とする
+		column++
+		if cell.R != "" {
+			if index, ok := xlsxColumnIndex(cell.R); ok {
+				column = index
+			}
+		}
+		if column >= xlsxMaxColumns {
+			return nil, fmt.Errorf("%w: cell %s is beyond the last column", ErrInvalidWorkbook, cell.R)
+		}
+		value := r.value(cell)
+		if value == "" {
+			continue
+		}
+		for len(record) <= column {
+			record = append(record, "")
+		}
+		record[column] = value
+	}
+	return record, nil
+}
+
+// セルの型と表示形式に従って、Excelで表示される文字列に変換する
+func (r *xlsxReader) value(cell xlsxCell) string {
+	switch cell.T {
+	case "s":
+		index, err := strconv.Atoi(cell.V)
+		if err != nil || index < 0 || index >= len(r.sharedStrings) {
+			return ""
+		}
+		return r.sharedStrings[index]
+	case "inlineStr":
+		if cell.Is == nil {
+			return ""
+		}
+		return cell.Is.text()
+	case "b":
+		if cell.V == "1" {
+			return "TRUE"
+		}
+		return "FALSE"
+	case "str", "e", "d":
+		return cell.V
+	default:
+		var format string
+		if cell.S >= 0 && cell.S < len(r.formats) {
+			format = r.formats[cell.S]
+		}
+		return formatXlsxNumber(cell.V, format)
+	}
+}
+
+func (r *xlsxReader) Line() int {
+	return r.line
+}
+
+// 圧縮されたシートの読み込み位置は分からないため、最終行に対する行番号の割合からファイル内の位置を見積もる
+func (r *xlsxReader) Offset() int64 {
+	if r.lastRow <= 0 {
+		return 0
+	}
+	return r.size * int64(min(r.line, r.lastRow)) / int64(r.lastRow)
+}
+
+// "B12"のようなセルの位置から0始まりの列番号を返す
+// 桁あふれしないよう、xlsxMaxColumnsを超えた時点でxlsxMaxColumnsを返す
+func xlsxColumnIndex(ref string) (int, bool) {
+	index := 0
+	letters := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		if index <= xlsxMaxColumns {
+			index = index*26 + int(r-'A'+1)
+		}
+		letters++
+	}
+	return min(index, xlsxMaxColumns+1) - 1, letters > 0
+}
+
+// "A1:K1001"のような範囲から最終行を返す
+func xlsxLastRow(ref string) int {
+	last := ref[strings.LastIndex(ref, ":")+1:]
+	row, err := strconv.Atoi(strings.TrimLeft(last, "ABCDEFGHIJKLMNOPQRSTUVWXYZ$"))
+	if err != nil {
+		return 0
+	}
+	return row
+}
+
+// 表示形式の条件, "[<=9999]"のような形式
+var xlsxFormatCondition = regexp.MustCompile(`^\[(<=|>=|<>|<|>|=)(-?[0-9.]+)\]`)
+
+// 数値のセルを文字列に変換する
+// 郵便番号や電話番号は数値として保存されると先頭の0が失われるため、"00000"や"000-0000"のような
+// 桁を0で埋める表示形式が設定されている場合は、Excelでの表示と同じく0で埋めた文字列にする
+// それ以外の表示形式では、指数表記にならない数値の文字列にする
+func formatXlsxNumber(value string, format string) string {
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return value
+	}
+	general := strconv.FormatFloat(number, 'f', -1, 64)
+	if number < 0 || number != math.Trunc(number) || number >= 1e15 {
+		return general
+	}
+	section, ok := selectXlsxFormatSection(format, number)
+	if !ok {
+		return general
+	}
+	formatted, ok := applyXlsxDigitPattern(strconv.FormatInt(int64(number), 10), section)
+	if !ok {
+		return general
+	}
+	return formatted
+}
+
+// 表示形式を";"で区切ったセクションのうち、数値に適用されるものを返す
+// 条件付きのセクションは最初に条件を満たすものを、条件が無い場合は先頭のセクションを使う
+func selectXlsxFormatSection(format string, number float64) (string, bool) {
+	sections := splitXlsxFormat(format)
+	for _, section := range sections {
+		match := xlsxFormatCondition.FindStringSubmatch(section)
+		if match == nil {
+			return section, true
+		}
+		threshold, err := strconv.ParseFloat(match[2], 64)
+		if err != nil {
+			return "", false
+		}
+		var ok bool
+		switch match[1] {
+		case "<=":
+			ok = number <= threshold
+		case ">=":
+			ok = number >= threshold
+		case "<>":
+			ok = number != threshold
+		case "<":
+			ok = number < threshold
+		case ">":
+			ok = number > threshold
+		case "=":
+			ok = number == threshold
+		}
+		if ok {
+			return section[len(match[0]):], true
+		}
+	}
+	return "", false
+}
+
+// 引用符とエスケープを考慮して";"で分割する
+func splitXlsxFormat(format string) []string {
+	var sections []string
+	var current strings.Builder
+	quoted, escaped := false, false
+	for _, r := range format {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case r == ';' && !quoted:
+			sections = append(sections, current.String())
+			current.Reset()
+			continue
+		}
+		current.WriteRune(r)
+	}
+	return append(sections, current.String())
+}
+
+// 0と#の桁だけで構成された表示形式にdigitsを当てはめる, 対応しない表示形式の場合はfalseを返す
+// 0の桁は数字が無ければ0で埋め、#の桁は数字が無ければ何も表示しない, 桁が足りない場合は先頭の桁にまとめて表示する
+func applyXlsxDigitPattern(digits string, pattern string) (string, bool) {
+	// 表示形式をトークンに分割する, 桁はplaceholderに'0'か'#'を、文字はliteralに値を入れる
+	type token struct {
+		placeholder rune
+		literal     string
+	}
+	var tokens []token
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '0' || r == '#':
+			tokens = append(tokens, token{placeholder: r})
+		case r == '\\' && i+1 < len(runes):
+			i++
+			tokens = append(tokens, token{literal: string(runes[i])})
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			tokens = append(tokens, token{literal: string(runes[i+1 : min(end, len(runes))])})
+			i = end
+		case r == '[':
+			// 色やロケールの指定は表示に影響しないため読み飛ばす
+			for i < len(runes) && runes[i] != ']' {
+				i++
+			}
+		case r == '_' || r == '*':
+			// 幅の調整と繰り返しの指定は読み飛ばす
+			i++
+		case strings.ContainsRune("-()/+ :", r):
+			tokens = append(tokens, token{literal: string(r)})
+		default:
+			// 小数点・桁区切り・パーセント・日付などを含む表示形式は対応しない
+			return "", false
+		}
+	}
+
+	first := -1
+	for i, t := range tokens {
+		if t.placeholder != 0 {
+			first = i
+			break
+		}
+	}
+	if first == -1 {
+		return "", false
+	}
+
+	// 末尾の桁から順に数字を当てはめる
+	parts := make([]string, len(tokens))
+	remaining := digits
+	for i := len(tokens) - 1; i >= 0; i-- {
+		t := tokens[i]
+		switch {
+		case t.placeholder == 0:
+			parts[i] = t.literal
+		case i == first:
+			// 残りの数字を全て先頭の桁に表示する
+			if remaining == "" && t.placeholder == '0' {
+				remaining = "0"
+			}
+			parts[i] = remaining
+			remaining = ""
+		case remaining != "":
+			parts[i] = remaining[len(remaining)-1:]
+			remaining = remaining[:len(remaining)-1]
+		case t.placeholder == '0':
+			parts[i] = "0"
+		}
+	}
+	return strings.Join(parts, ""), true
+}